@@ -29,6 +29,10 @@ func main() {
 
 	command.AddCommand(cmd.NewBuildCmd(conf))
 	command.AddCommand(cmd.NewConfigCmd(conf))
+	command.AddCommand(cmd.NewBuilderCmd(conf))
+	command.AddCommand(cmd.NewExplainHashCmd(conf))
+	command.AddCommand(cmd.NewRenderCmd(conf))
+	command.AddCommand(cmd.NewGraphCmd(conf))
 
 	if err := command.Execute(); err != nil {
 		os.Exit(1)
@@ -3,14 +3,18 @@ package builder
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/BurntSushi/locker"
 	"github.com/maxlaverse/image-builder/pkg/config"
 	"github.com/maxlaverse/image-builder/pkg/engine"
 	"github.com/maxlaverse/image-builder/pkg/executor"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
 	"github.com/maxlaverse/image-builder/pkg/registry"
 	"github.com/maxlaverse/image-builder/pkg/template"
+	"github.com/maxlaverse/image-builder/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
@@ -24,6 +28,10 @@ type BuildOptions struct {
 	// Push built stages for reuse
 	CacheImagePush bool
 
+	// LocalTargetImage tells the target image is a local name, in which no
+	// cached image is looked up. The Builder Cache is still looked up.
+	LocalTargetImage bool
+
 	// DryRun disables any actual image build
 	DryRun bool
 
@@ -32,8 +40,35 @@ type BuildOptions struct {
 
 	// PullConcurrency indicates how many concurrent image pull are allowed
 	PullConcurrency int64
+
+	// HashScheme is the algorithm used to compute the Content Hash of stages
+	HashScheme fileutils.HashScheme
+
+	// CacheLookupErrors tells what to do when a registry fails to tell if the
+	// image of a stage exists
+	CacheLookupErrors CacheLookupErrorPolicy
+
+	// Secrets are made available to the builds of all the stages. They are
+	// never part of the Content Hash.
+	Secrets []engine.Secret
+
+	// SSH are the SSH agents forwarded to the builds of all the stages
+	SSH []engine.SSH
 }
 
+// CacheLookupErrorPolicy tells how errors looking up cached images in
+// registries are handled
+type CacheLookupErrorPolicy string
+
+const (
+	// CacheLookupErrorsFail fails the build
+	CacheLookupErrorsFail CacheLookupErrorPolicy = "fail"
+
+	// CacheLookupErrorsWarn logs the error and builds the stage as if no image
+	// existed
+	CacheLookupErrorsWarn CacheLookupErrorPolicy = "warn"
+)
+
 // Build transform BuildConfigurations into Docker images
 type Build struct {
 	buildConf    config.BuildConfiguration
@@ -44,9 +79,14 @@ type Build struct {
 	localContext string
 	opts         BuildOptions
 	targetImage  string
-	locker       *locker.Locker
+	preparing    []string
+	prepErrors   map[string]error
+	prepErrMux   sync.Mutex
+	nestedPrep   []time.Duration
 	semBuild     *semaphore.Weighted
 	semPull      *semaphore.Weighted
+	durations    map[string]StageDurations
+	durationsMux sync.Mutex
 }
 
 // NewBuild returns a new instance of Build
@@ -66,32 +106,36 @@ func NewBuild(e engine.BuildEngine, exec executor.Executor, buildDef Definition,
 		localContext: localContext,
 		opts:         opts,
 		targetImage:  targetImage,
-		locker:       locker.NewLocker(),
 		semBuild:     semaphore.NewWeighted(opts.BuildConcurrency),
 		semPull:      semaphore.NewWeighted(opts.PullConcurrency),
+		durations:    map[string]StageDurations{},
+		prepErrors:   map[string]error{},
 	}
 }
 
-// PrepareStages builds a set of stages
-func (b *Build) PrepareStages(stageNames []string) ([]BuildStage, error) {
+// PrepareStages builds a set of stages. The errors of all the stages that
+// can't be prepared are reported together.
+func (b *Build) PrepareStages(ctx context.Context, stageNames []string) ([]BuildStage, error) {
 	log.Infof("Rendering Dockerfiles")
 	for _, stageName := range stageNames {
-		stage, err := b.prepareStage(stageName)
-		if err != nil {
-			return nil, err
+		if stage, err := b.prepareStage(ctx, stageName); err == nil {
+			b.buildStages.Store(stageName, stage)
 		}
-		b.buildStages.Store(stageName, stage)
+	}
+	if err := b.preparationError(); err != nil {
+		return nil, err
 	}
 
-	var err error
 	b.buildStages.Range(func(stageName, stage interface{}) bool {
 		log.Debugf("Final rendering of template '%s' to resolve stage references", stageName)
-		if err = stage.(BuildStage).Render(); err != nil {
-			return false
+		if err := stage.(BuildStage).Render(); err != nil {
+			b.setPreparationError(stageName.(string), err)
+			return true
 		}
 		files, err := stage.(BuildStage).ContextFiles()
 		if err != nil {
-			return false
+			b.setPreparationError(stageName.(string), err)
+			return true
 		}
 
 		if len(files) == 0 {
@@ -105,74 +149,155 @@ func (b *Build) PrepareStages(stageNames []string) ([]BuildStage, error) {
 		log.Debugf("Dockerfile for stage '%s' is:\n%s", stageName, stage.(BuildStage).Dockerfile())
 		return true
 	})
-	return b.getBuildStages(), err
+	return b.getBuildStages(), b.preparationError()
+}
+
+// preparationError returns an error listing the stages that couldn't be
+// prepared, or nil if there is none
+func (b *Build) preparationError() error {
+	b.prepErrMux.Lock()
+	defer b.prepErrMux.Unlock()
+	if len(b.prepErrors) == 0 {
+		return nil
+	}
+	names := []string{}
+	for name := range b.prepErrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 1 {
+		return b.prepErrors[names[0]]
+	}
+
+	lines := []string{fmt.Sprintf("%d stages could not be prepared:", len(names))}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  - %v", b.prepErrors[name]))
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
 }
 
-// BuildStages builds a set of stages
-func (b *Build) BuildStages(stageNames []string) ([]BuildStage, error) {
-	_, err := b.PrepareStages(stageNames)
+// setPreparationError records why a stage couldn't be prepared
+func (b *Build) setPreparationError(stageName string, err error) {
+	b.prepErrMux.Lock()
+	defer b.prepErrMux.Unlock()
+	b.prepErrors[stageName] = err
+}
+
+// stagePreparationError returns why a stage couldn't be prepared, or nil if
+// it didn't fail
+func (b *Build) stagePreparationError(stageName string) error {
+	b.prepErrMux.Lock()
+	defer b.prepErrMux.Unlock()
+	return b.prepErrors[stageName]
+}
+
+// BuildStages builds a set of stages. The stages are built as soon as their
+// dependencies are available, and the first failure cancels the whole build.
+func (b *Build) BuildStages(ctx context.Context, stageNames []string) ([]BuildStage, error) {
+	_, err := b.PrepareStages(ctx, stageNames)
 	if err != nil {
 		return nil, fmt.Errorf("error while preparing some stages: %w", err)
 	}
 
+	graph, err := b.stageGraph()
+	if err != nil {
+		return nil, err
+	}
+
 	if b.opts.DryRun {
 		return b.getBuildStages(), nil
 	}
 
 	log.Infof("Starting build")
-	g, _ := errgroup.WithContext(context.Background())
-	for _, stageName := range stageNames {
-		stage, ok := b.buildStages.Load(stageName)
-		if !ok {
-			return nil, fmt.Errorf("stage '%s' was not prepared", stageName)
-		}
-
-		g.Go(func() error { return b.buildStage(stage.(BuildStage)) })
-	}
-
-	if err := g.Wait(); err != nil {
+	if err := b.runStages(ctx, graph, stageNames); err != nil {
 		return b.getBuildStages(), err
 	}
-
 	return b.getBuildStages(), nil
 }
 
 // templateStageResolver is called by the renderer to replace a stage
 // reference with its imageURL. It's used to recursively prepare stages
-func (b *Build) templateStageResolver(stageName string) (string, error) {
-	stage, err := b.prepareStage(stageName)
-	if err != nil {
+func (b *Build) templateStageResolver(ctx context.Context, stageName string) (string, error) {
+	stage, err := b.prepareStage(ctx, stageName)
+	if b.stagePreparationError(stageName) != nil {
+		// Already reported with the stage itself
+		return "error-while-resoving-stage", fmt.Errorf("stage '%s' could not be prepared", stageName)
+	} else if err != nil {
 		return "error-while-resoving-stage", err
 	}
 	b.buildStages.Store(stageName, stage)
 	return stage.ImageURL(), nil
 }
 
-// prepareStage renders all the required Dockerfiles and verifies image some
+// prepareStage prepares a stage once, and records why it failed unless the
+// stage is still being prepared, as in a circular dependency
+func (b *Build) prepareStage(ctx context.Context, stageName string) (BuildStage, error) {
+	if err := b.stagePreparationError(stageName); err != nil {
+		return nil, err
+	}
+	stage, err := b.renderStage(ctx, stageName)
+	if err != nil && !utils.ItemExists(b.preparing, stageName) {
+		b.buildStages.Delete(stageName)
+		b.setPreparationError(stageName, err)
+	}
+	return stage, err
+}
+
+// renderStage renders all the required Dockerfiles and verifies image some
 // stages can be pulled from remote registries
-func (b *Build) prepareStage(stageName string) (BuildStage, error) {
+func (b *Build) renderStage(ctx context.Context, stageName string) (BuildStage, error) {
+	// Let the stage being rendered, if any, know how long this took
+	start := time.Now()
+	defer func() {
+		if n := len(b.nestedPrep); n > 0 {
+			b.nestedPrep[n-1] += time.Since(start)
+		}
+	}()
+
 	v, ok := b.buildStages.Load(stageName)
 	if ok {
 		if v.(BuildStage).Status() == Initialized {
-			return v.(BuildStage), fmt.Errorf("stage '%s' is already being built - possible loop in the stage dependencies", stageName)
+			return v.(BuildStage), newCycleError(b.preparationPath(stageName))
 		}
 		return v.(BuildStage), nil
 	}
 
-	dockerfile, err := template.NewDockerfileFromFile(b.buildDef.GetStageDockerfile(stageName), stageName, b.buildConf, b.localContext, b.buildDef.GetStageDirectory(stageName), b.templateStageResolver, b.exec)
+	partials, err := b.buildDef.GetPartials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the partials: %w", err)
+	}
+	dockerfile, err := template.NewDockerfileFromFile(b.buildDef.GetStageDockerfile(stageName), partials, stageName, b.buildConf, b.localContext, b.buildDef.GetStageDirectory(stageName), func(name string) (string, error) {
+		return b.templateStageResolver(ctx, name)
+	}, b.exec)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read the Dockerfile template: %w", err)
 	}
 
-	stage := NewBuildStage(stageName, dockerfile, b.buildConf.IncludePatterns(stageName))
+	buildArgs, err := b.buildConf.BuildArgs(stageName)
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := b.buildConf.Platforms(stageName)
+	if err != nil {
+		return nil, err
+	}
+	stage := NewBuildStage(stageName, dockerfile, b.contextFilter(stageName), buildArgs, platforms, b.opts.HashScheme)
 	b.buildStages.Store(stageName, stage)
 
+	b.preparing = append(b.preparing, stageName)
+	b.nestedPrep = append(b.nestedPrep, 0)
+	renderStart := time.Now()
 	err = stage.Render()
+	b.recordDuration(stageName, stepRender, time.Since(renderStart)-b.nestedPrep[len(b.nestedPrep)-1])
+	b.preparing = b.preparing[:len(b.preparing)-1]
+	b.nestedPrep = b.nestedPrep[:len(b.nestedPrep)-1]
 	if err != nil {
 		return stage, err
 	}
 
+	hashStart := time.Now()
 	tag, err := stage.ImageTag()
+	b.recordDuration(stageName, stepHash, time.Since(hashStart))
 	if err != nil {
 		return stage, err
 	}
@@ -182,26 +307,28 @@ func (b *Build) prepareStage(stageName string) (BuildStage, error) {
 	stage.SetSourceImageURL(b.targetImage + ":" + stageName + "-" + tag)
 	if b.opts.CacheImagePull && b.buildConf.IsBuilderCacheSet() {
 		cachedDockerImageWithTag := b.buildConf.BuilderCache() + "/" + b.buildConf.BuilderName() + ":" + stageName + "-" + tag
-		exists, err := registry.ImageExists(cachedDockerImageWithTag)
+		digest, err := b.imageDigest(ctx, cachedDockerImageWithTag)
 		if err != nil {
-			return stage, fmt.Errorf("error while verifying if image '%s' exists: %w", cachedDockerImageWithTag, err)
+			return stage, err
 		}
 
-		if exists {
+		if len(digest) > 0 {
 			stage.SetStatus(ImageCached)
+			stage.SetDigest(digest)
 			stage.SetSourceImageURL(cachedDockerImageWithTag)
 			return stage, nil
 		}
 	}
 
-	if b.opts.CacheImagePull {
-		exists, err := registry.ImageExists(stage.ImageURL())
+	if b.opts.CacheImagePull && !b.opts.LocalTargetImage {
+		digest, err := b.imageDigest(ctx, stage.ImageURL())
 		if err != nil {
-			return stage, fmt.Errorf("error while verifying if image '%s' exists: %w", stage.ImageURL(), err)
+			return stage, err
 		}
 
-		if exists {
+		if len(digest) > 0 {
 			stage.SetStatus(ImageCached)
+			stage.SetDigest(digest)
 			return stage, nil
 		}
 	}
@@ -211,62 +338,161 @@ func (b *Build) prepareStage(stageName string) (BuildStage, error) {
 	return stage, nil
 }
 
-// buildStage builds a specific stage
-func (b *Build) buildStage(stage BuildStage) error {
-	log.Tracef("Trying to acquire lock on '%s'", stage.Name())
-	b.locker.Lock(stage.Name())
-	defer func() {
-		b.locker.Unlock(stage.Name())
-		log.Tracef("Releasing lock on '%s'", stage.Name())
-	}()
-	log.Tracef("Got lock on '%s'", stage.Name())
+// imageDigest returns the digest of an image in its registry, or an empty
+// string if it doesn't exist. Lookup errors are ignored with a warning if the
+// policy allows it.
+func (b *Build) imageDigest(ctx context.Context, imageURL string) (string, error) {
+	digest, err := registry.ImageDigest(ctx, imageURL)
+	if err == nil {
+		return digest, nil
+	}
+	if b.opts.CacheLookupErrors == CacheLookupErrorsWarn {
+		log.Warnf("Could not verify if image '%s' exists, considering it absent: %v", imageURL, err)
+		return "", nil
+	}
+	return "", fmt.Errorf("error while verifying if image '%s' exists: %w", imageURL, err)
+}
 
-	// Log and exit of the nothing need to be done
-	if stage.Status() == ImageCached {
-		log.Infof("Image for stage '%s' (hash: '%s') is cached", stage.Name(), stage.ContentHash())
-		return nil
-	} else if stage.Status() == ImagePulled {
-		log.Infof("Image for stage '%s' (hash: '%s') has been pulled", stage.Name(), stage.ContentHash())
-		return nil
-	} else if stage.Status() == ImageBuilt {
-		log.Infof("Image for stage '%s' (hash: '%s') was built", stage.Name(), stage.ContentHash())
-		return nil
-	} else if stage.Status() != ImageAbsent {
-		// e.g ImageInitialized
-		return fmt.Errorf("image for stage '%s' (hash: '%s') has an invalid status: %v", stage.Name(), stage.ContentHash(), stage.Status())
+// contextFilter returns the filter the Build Configuration defines for the
+// context of a stage
+func (b *Build) contextFilter(stageName string) fileutils.ContextFilter {
+	return fileutils.ContextFilter{
+		IncludePatterns:  b.buildConf.IncludePatterns(stageName),
+		ExcludePatterns:  b.buildConf.ExcludePatterns(stageName),
+		HonorIgnoreFiles: b.buildConf.HonorIgnoreFiles(stageName),
 	}
+}
 
-	log.Infof("Image for stage '%s' (hash: '%s') needs to be build", stage.Name(), stage.ContentHash())
-	requiredStages := stage.GetRequiredStages()
-	if len(requiredStages) > 0 {
-		log.Debugf("Stage '%s' requires: %v", stage.Name(), stage.GetRequiredStages())
-	} else {
-		log.Debugf("Stage '%s' doesn't depend on any other stage", stage.Name())
+// stageGraph returns the dependency graph of the prepared stages
+func (b *Build) stageGraph() (*stageGraph, error) {
+	deps := map[string][]string{}
+	for _, stage := range b.getBuildStages() {
+		deps[stage.Name()] = stage.GetRequiredStages()
 	}
+	return newStageGraph(deps)
+}
+
+// runStages builds the stages that are absent and pulls the cached images
+// they depend on, in topological order. Each stage waits for its dependencies
+// before being processed, and the first error cancels the context of all the
+// operations in progress.
+func (b *Build) runStages(ctx context.Context, graph *stageGraph, stageNames []string) error {
+	required := b.requiredStages(graph, stageNames)
 
-	// Build dependencies
-	g, _ := errgroup.WithContext(context.Background())
-	for _, s := range requiredStages {
-		stageDep, ok := b.buildStages.Load(s)
+	g, ctx := errgroup.WithContext(ctx)
+	done := map[string]chan struct{}{}
+	for _, stageName := range graph.topologicalOrder(stageNames) {
+		stage, ok := b.buildStages.Load(stageName)
 		if !ok {
-			return fmt.Errorf("stage '%s' dependency of '%s' was not prepared", s, stage.Name())
+			return fmt.Errorf("stage '%s' was not prepared", stageName)
+		}
+		done[stageName] = make(chan struct{})
+
+		if !required[stageName] {
+			logStageStatus(stage.(BuildStage))
+			close(done[stageName])
+			continue
+		}
+
+		stageDone := done[stageName]
+		depsDone := []chan struct{}{}
+		for _, dep := range graph.dependencies(stageName) {
+			depsDone = append(depsDone, done[dep])
 		}
 		g.Go(func() error {
-			log.Infof("Preparing build of stage '%s' as dependency of '%s'", stageDep.(BuildStage).Name(), stage.Name())
-			if err := b.ensureDependencyPresence(stageDep.(BuildStage)); err != nil {
-				return fmt.Errorf("error while ensuring presence of image for stage '%s' dependency of stage '%s': %w", stageDep.(BuildStage).Name(), stage.Name(), err)
+			for _, depDone := range depsDone {
+				select {
+				case <-depDone:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
+			if err := b.processStage(ctx, stage.(BuildStage)); err != nil {
+				return err
+			}
+			close(stageDone)
 			return nil
 		})
 	}
+	return g.Wait()
+}
 
-	if err := g.Wait(); err != nil {
-		return err
+// requiredStages returns the stages that have to be built or pulled in order
+// to build the given stages
+func (b *Build) requiredStages(graph *stageGraph, stageNames []string) map[string]bool {
+	required := map[string]bool{}
+
+	var visit func(stageName string, isDependency bool)
+	visit = func(stageName string, isDependency bool) {
+		stage, ok := b.buildStages.Load(stageName)
+		if !ok || required[stageName] {
+			return
+		}
+
+		switch stage.(BuildStage).Status() {
+		case ImageAbsent:
+			required[stageName] = true
+			for _, dep := range graph.dependencies(stageName) {
+				visit(dep, true)
+			}
+		case ImageCached:
+			required[stageName] = isDependency
+		}
+	}
+
+	for _, stageName := range stageNames {
+		visit(stageName, false)
+	}
+	return required
+}
+
+// processStage builds a stage whose image is absent, or pulls the cached image
+// of a stage and retags it to match the expected name
+func (b *Build) processStage(ctx context.Context, stage BuildStage) error {
+	switch stage.Status() {
+	case ImageCached:
+		if len(stage.Platforms()) > 0 {
+			return b.copyStage(ctx, stage)
+		}
+		log.Infof("Pulling image for stage '%s' (hash: '%s')", stage.Name(), stage.ContentHash())
+		pullFunc := func() error {
+			defer b.timeStep(stage.Name(), stepPull)()
+			return b.engine.Pull(ctx, stage.SourceImageURL())
+		}
+		err := wrapWithSemaphore(ctx, b.semPull, "pull", stage.Name(), pullFunc)
+		if err != nil {
+			return fmt.Errorf("error while pulling image '%s' required for stage '%s': %w", stage.SourceImageURL(), stage.Name(), err)
+		}
+
+		err = b.engine.Tag(ctx, stage.SourceImageURL(), stage.ImageURL())
+		if err != nil {
+			return fmt.Errorf("error while tagging image '%s' required for stage '%s': %w", stage.SourceImageURL(), stage.Name(), err)
+		}
+		stage.SetStatus(ImagePulled)
+		return nil
+	case ImageAbsent:
+	default:
+		// e.g ImageInitialized
+		return fmt.Errorf("image for stage '%s' (hash: '%s') has an invalid status: %v", stage.Name(), stage.ContentHash(), stage.Status())
+	}
+	if len(stage.Platforms()) > 0 && !b.opts.CacheImagePush {
+		return fmt.Errorf("stage '%s' is built for platforms %v, which requires pushing its images to a registry", stage.Name(), stage.Platforms())
+	}
+
+	log.Infof("Image for stage '%s' (hash: '%s') needs to be build", stage.Name(), stage.ContentHash())
+	requiredStages := stage.GetRequiredStages()
+	if len(requiredStages) > 0 {
+		log.Debugf("Stage '%s' requires: %v", stage.Name(), requiredStages)
+	} else {
+		log.Debugf("Stage '%s' doesn't depend on any other stage", stage.Name())
 	}
 
 	// Build image
-	buildFunc := func() error { return stage.Build(b.engine) }
-	if err := wrapWithSemaphore(b.semBuild, "build", stage.Name(), buildFunc); err != nil {
+	buildFunc := func() error {
+		defer b.timeStep(stage.Name(), stepBuild)()
+		return stage.Build(ctx, b.engine, engine.BuildOptions{Secrets: b.opts.Secrets, SSH: b.opts.SSH, Labels: b.imageLabels(stage.Name())})
+	}
+	if err := wrapWithSemaphore(ctx, b.semBuild, "build", stage.Name(), buildFunc); err != nil {
 		return fmt.Errorf("error while building stage '%s': %w", stage.Name(), err)
 	}
 
@@ -274,53 +500,69 @@ func (b *Build) buildStage(stage BuildStage) error {
 	stage.SetStatus(ImageBuilt)
 	log.Infof("Stage '%s' successfully built!", stage.Name())
 	if b.opts.CacheImagePush {
-		if err := b.pushStage(stage); err != nil {
+		if err := b.pushStage(ctx, stage); err != nil {
 			return fmt.Errorf("error while pusing image for stage '%s': %w", stage.Name(), err)
 		}
 	}
 	return nil
 }
 
-// ensureDependencyPresence pull the dependencies for a Stage and retags them to match the expected name
-// or build them
-func (b *Build) ensureDependencyPresence(stage BuildStage) error {
-	if stage.Status() == ImageAbsent {
-		err := b.buildStage(stage)
-		if err != nil {
-			return fmt.Errorf("error while building dependency '%s' required for stage '%s': %w", stage.SourceImageURL(), stage.Name(), err)
+// copyStage makes the cached manifest list of a stage with platforms
+// available under the expected name. It's copied within registries instead
+// of being pulled, since an engine can only hold the image of one platform.
+func (b *Build) copyStage(ctx context.Context, stage BuildStage) error {
+	if stage.SourceImageURL() != stage.ImageURL() {
+		log.Infof("Copying image '%s' to '%s' for stage '%s'", stage.SourceImageURL(), stage.ImageURL(), stage.Name())
+		copyFunc := func() error {
+			defer b.timeStep(stage.Name(), stepPull)()
+			return registry.CopyImage(ctx, stage.SourceImageURL(), stage.ImageURL())
 		}
-		return nil
-	} else if stage.Status() == ImageCached {
-		err := wrapWithSemaphore(b.semPull, "pull", stage.Name(), func() error { return b.engine.Pull(stage.SourceImageURL()) })
-		if err != nil {
-			return fmt.Errorf("error while pulling image '%s' required for stage '%s': %w", stage.SourceImageURL(), stage.Name(), err)
+		if err := wrapWithSemaphore(ctx, b.semPull, "pull", stage.Name(), copyFunc); err != nil {
+			return fmt.Errorf("error while copying image '%s' required for stage '%s': %w", stage.SourceImageURL(), stage.Name(), err)
 		}
-
-		err = b.engine.Tag(stage.SourceImageURL(), stage.ImageURL())
-		if err != nil {
-			return fmt.Errorf("error while tagging image '%s' required for stage '%s': %w", stage.SourceImageURL(), stage.Name(), err)
-		}
-		stage.SetStatus(ImagePulled)
 	}
+	stage.SetStatus(ImagePulled)
 	return nil
 }
 
 // pushStage push stages
-func (b *Build) pushStage(stage BuildStage) error {
-	log.Infof("Pushing image '%s'", stage.(BuildStage).ImageURL())
-	if err := b.engine.Push(stage.(BuildStage).ImageURL()); err != nil {
-		return fmt.Errorf("error while pushing image for stage '%s': %w", stage.Name(), err)
+func (b *Build) pushStage(ctx context.Context, stage BuildStage) error {
+	defer b.timeStep(stage.Name(), stepPush)()
+
+	// The manifest list of a stage with platforms was pushed while building it
+	if len(stage.Platforms()) == 0 {
+		log.Infof("Pushing image '%s'", stage.ImageURL())
+		if err := b.engine.Push(ctx, stage.ImageURL()); err != nil {
+			return fmt.Errorf("error while pushing image for stage '%s': %w", stage.Name(), err)
+		}
+	}
+
+	digest, err := registry.ImageDigest(ctx, stage.ImageURL())
+	if err != nil {
+		log.Warnf("Could not retrieve the digest of the image pushed for stage '%s': %v", stage.Name(), err)
 	}
+	stage.SetDigest(digest)
 
 	for _, tag := range stage.GetTagAliases() {
 		log.Infof("Tagging image '%s' as '%s'", stage.ImageURL(), tag)
-		if err := registry.TagImage(stage.ImageURL(), tag); err != nil {
+		if err := registry.TagImage(ctx, stage.ImageURL(), tag); err != nil {
 			return fmt.Errorf("error while tagging image for stage '%s' with '%s': %w", stage.Name(), tag, err)
 		}
 	}
 	return nil
 }
 
+// preparationPath returns the chain of stages being prepared that lead to a
+// given stage
+func (b *Build) preparationPath(stageName string) []string {
+	for i, s := range b.preparing {
+		if s == stageName {
+			return append(append([]string{}, b.preparing[i:]...), stageName)
+		}
+	}
+	return []string{stageName, stageName}
+}
+
 // getBuildStages returns in which order the stages should be build
 func (b *Build) getBuildStages() []BuildStage {
 	stages := []BuildStage{}
@@ -331,10 +573,19 @@ func (b *Build) getBuildStages() []BuildStage {
 	return stages
 }
 
+// logStageStatus logs the status of a stage that doesn't need to be processed
+func logStageStatus(stage BuildStage) {
+	if stage.Status() == ImageCached {
+		log.Infof("Image for stage '%s' (hash: '%s') is cached", stage.Name(), stage.ContentHash())
+	} else {
+		log.Debugf("Stage '%s' is not required", stage.Name())
+	}
+}
+
 // wrapWithSemaphore wraps a call with a semaphore
-func wrapWithSemaphore(sem *semaphore.Weighted, name, instance string, f func() error) error {
+func wrapWithSemaphore(ctx context.Context, sem *semaphore.Weighted, name, instance string, f func() error) error {
 	log.Tracef("Trying to acquire semaphore for '%s' on '%s'", instance, name)
-	if err := sem.Acquire(context.Background(), 1); err != nil {
+	if err := sem.Acquire(ctx, 1); err != nil {
 		return err
 	}
 	log.Tracef("Acquired semaphore for '%s' on '%s'", instance, name)
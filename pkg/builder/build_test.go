@@ -1,15 +1,29 @@
 package builder
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/maxlaverse/image-builder/pkg/engine"
 	enginetest "github.com/maxlaverse/image-builder/pkg/engine/test"
 	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,7 +32,7 @@ func TestPrepareUnknownStage(t *testing.T) {
 	fakeExecutor := executortest.New()
 	builderDef := NewDefinitionFromPath("self-reference", "../../fixtures/self-reference")
 	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures")
-	_, err := b.PrepareStages([]string{"2"})
+	_, err := b.PrepareStages(context.Background(), []string{"2"})
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "failed to read the Dockerfile template: Failed to read the Dockerfile template: open ../../fixtures/self-reference/2/Dockerfile: no such file or directory")
@@ -29,10 +43,10 @@ func TestPrepareSelfReference(t *testing.T) {
 	fakeExecutor := executortest.New()
 	builderDef := NewDefinitionFromPath("self-reference", "../../fixtures/self-reference")
 	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures")
-	stages, err := b.PrepareStages([]string{"1"})
+	stages, err := b.PrepareStages(context.Background(), []string{"1"})
 
 	assert.Error(t, err)
-	assert.EqualError(t, err, `failed to render the Dockerfile template: template: dockerfile:1:7: executing "dockerfile" at <BuilderStage "1">: error calling BuilderStage: cannot replace BuilderStage('1'): stage '1' is already being built - possible loop in the stage dependencies`)
+	assert.EqualError(t, err, `failed to render the Dockerfile of stage '1' at Dockerfile:1:7: cannot replace BuilderStage('1'): circular dependency between stages: 1 -> 1`)
 	assert.Len(t, stages, 0)
 }
 
@@ -41,10 +55,25 @@ func TestPrepareCircularReference(t *testing.T) {
 	fakeExecutor := executortest.New()
 	builderDef := NewDefinitionFromPath("circular-reference", "../../fixtures/circular-reference")
 	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures")
-	stages, err := b.PrepareStages([]string{"1"})
+	stages, err := b.PrepareStages(context.Background(), []string{"1"})
 
 	assert.Error(t, err)
-	assert.EqualError(t, err, `failed to render the Dockerfile template: template: dockerfile:1:7: executing "dockerfile" at <BuilderStage "2">: error calling BuilderStage: cannot replace BuilderStage('2'): failed to render the Dockerfile template: template: dockerfile:1:7: executing "dockerfile" at <BuilderStage "1">: error calling BuilderStage: cannot replace BuilderStage('1'): stage '1' is already being built - possible loop in the stage dependencies`)
+	assert.EqualError(t, err, `2 stages could not be prepared:
+  - failed to render the Dockerfile of stage '1' at Dockerfile:1:7: cannot replace BuilderStage('2'): stage '2' could not be prepared
+  - failed to render the Dockerfile of stage '2' at Dockerfile:1:7: cannot replace BuilderStage('1'): circular dependency between stages: 1 -> 2 -> 1`)
+	assert.Len(t, stages, 0)
+}
+
+func TestPrepareReportsAllTemplateErrors(t *testing.T) {
+	fakeEngine := enginetest.New()
+	fakeExecutor := executortest.New()
+	builderDef := NewDefinitionFromPath("template-errors", "../../fixtures/template-errors")
+	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
+	stages, err := b.PrepareStages(context.Background(), []string{"file", "parameter"})
+
+	assert.EqualError(t, err, `2 stages could not be prepared:
+  - failed to render the Dockerfile of stage 'file' at Dockerfile:2:13: cannot read File('VERSION'): open ../../fixtures/empty/VERSION: no such file or directory
+  - failed to render the Dockerfile of stage 'parameter' at Dockerfile:2:21: cannot find MandatoryParameter('binary') in the spec of stage 'parameter', which has: []`)
 	assert.Len(t, stages, 0)
 }
 
@@ -53,43 +82,99 @@ func TestPrepareComplex(t *testing.T) {
 	fakeExecutor := executortest.New()
 	builderDef := NewDefinitionFromPath("complex", "../../fixtures/complex")
 	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
-	stages, err := b.PrepareStages([]string{"1"})
+	stages, err := b.PrepareStages(context.Background(), []string{"1"})
 
 	assert.NoError(t, err)
 	if !assert.Len(t, stages, 5) {
 		t.Fail()
 	}
+	assert.Equal(t, []string{"1=v2-46716239899ea1ea122575c1b5288c91317fcc2d37f4fc56658ba324d7d2792c", "2=v2-84a10c3bf9212137c61ed906dffa0d62dc8a45ec103a5628040f2f19631e8c49", "3=v2-3e161b6de20c5e1e4ba669ad0694999fb6f8d8a99eaf31be41d3c2f95fd9e484", "4=v2-ff737829ff4cf8aa0f0305501232fc7d8337e31d532cbf3653cb294c9d29dd7d", "5=v2-ff737829ff4cf8aa0f0305501232fc7d8337e31d532cbf3653cb294c9d29dd7d"}, stagesToHashes(stages))
+}
+
+func TestPrepareComplexWithLegacyHashScheme(t *testing.T) {
+	fakeEngine := enginetest.New()
+	fakeExecutor := executortest.New()
+	builderDef := NewDefinitionFromPath("complex", "../../fixtures/complex")
+	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{HashScheme: fileutils.HashSchemeCRC32}, "fake-target-image", "../../fixtures/empty")
+	stages, err := b.PrepareStages(context.Background(), []string{"1"})
+
+	assert.NoError(t, err)
 	assert.Equal(t, []string{"1=55c0ab23", "2=cae4d907", "3=161aa95e", "4=c7e9afa3", "5=c7e9afa3"}, stagesToHashes(stages))
 }
 
 func TestBuildConcurrently(t *testing.T) {
-	fakeEngine := enginetest.NewWithCallbacks(delayInOrder(t, map[string]time.Duration{
-		"fake-target-image:final-6a965d86":        0,
-		"fake-target-image:parallel-1-1-306aefb8": time.Duration(0),
-		"fake-target-image:parallel-1-2-3d0ef7c4": time.Duration(10) * time.Millisecond,
-		"fake-target-image:parallel-2-1-306aefb8": time.Duration(5) * time.Millisecond,
-		"fake-target-image:parallel-2-2-4a902534": time.Duration(0),
-	}))
+	images := map[string]string{
+		"final":        "fake-target-image:final-v2-4939e1782415676ee12ab7cedd1f6b4f9da732478198ef75aed81076fa1efecf",
+		"parallel-1-1": "fake-target-image:parallel-1-1-v2-3bd9e8d6e2c9d992986ea1b5d5d57483d5f239df7f25fb832c60705bd3ecbf28",
+		"parallel-1-2": "fake-target-image:parallel-1-2-v2-712612c627cfaf50780dea9c0e6232b3f808bc4c7f317d123acc6cc1bdef4907",
+		"parallel-2-1": "fake-target-image:parallel-2-1-v2-3bd9e8d6e2c9d992986ea1b5d5d57483d5f239df7f25fb832c60705bd3ecbf28",
+		"parallel-2-2": "fake-target-image:parallel-2-2-v2-7ba3c59e79f861febae5b8bab63ed115538eab1609244397e6161b849ef45105",
+	}
+	dependencies := map[string][]string{
+		"final":        {"parallel-1-2", "parallel-2-2"},
+		"parallel-1-2": {"parallel-1-1"},
+		"parallel-2-2": {"parallel-2-1"},
+	}
 	fakeExecutor := executortest.New()
 	builderDef := NewDefinitionFromPath("concurrency", "../../fixtures/concurrency")
 
 	for i := 0; i < 10; i++ {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			fakeEngine := enginetest.NewWithCallbacks(delayInOrder(t, map[string]time.Duration{
+				images["final"]:        0,
+				images["parallel-1-1"]: time.Duration(0),
+				images["parallel-1-2"]: time.Duration(10) * time.Millisecond,
+				images["parallel-2-1"]: time.Duration(5) * time.Millisecond,
+				images["parallel-2-2"]: time.Duration(0),
+			}))
 			b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{BuildConcurrency: 2}, "fake-target-image", "../../fixtures/empty")
 
-			stages, err := b.BuildStages([]string{"final"})
+			stages, err := b.BuildStages(context.Background(), []string{"final"})
 			assert.NoError(t, err)
 			if !assert.Len(t, stages, 5) {
 				t.Fail()
 			}
-			assert.Equal(t, []string{"final=6a965d86", "parallel-1-1=306aefb8", "parallel-1-2=3d0ef7c4", "parallel-2-1=306aefb8", "parallel-2-2=4a902534"}, stagesToHashes(stages))
-			assert.Equal(t, "Build(fake-target-image:parallel-2-2-4a902534)", fakeEngine.MethodCalls[2])
-			assert.Equal(t, "Build(fake-target-image:parallel-1-2-3d0ef7c4)", fakeEngine.MethodCalls[3])
-			assert.Equal(t, "Build(fake-target-image:final-6a965d86)", fakeEngine.MethodCalls[4])
+			assert.Equal(t, []string{"final=v2-4939e1782415676ee12ab7cedd1f6b4f9da732478198ef75aed81076fa1efecf", "parallel-1-1=v2-3bd9e8d6e2c9d992986ea1b5d5d57483d5f239df7f25fb832c60705bd3ecbf28", "parallel-1-2=v2-712612c627cfaf50780dea9c0e6232b3f808bc4c7f317d123acc6cc1bdef4907", "parallel-2-1=v2-3bd9e8d6e2c9d992986ea1b5d5d57483d5f239df7f25fb832c60705bd3ecbf28", "parallel-2-2=v2-7ba3c59e79f861febae5b8bab63ed115538eab1609244397e6161b849ef45105"}, stagesToHashes(stages))
+
+			// Builds are recorded once they're done, and a stage is only built
+			// once all of its dependencies are
+			builtAt := map[string]int{}
+			for i, call := range fakeEngine.MethodCalls {
+				builtAt[call] = i
+			}
+			for stage, image := range images {
+				index, ok := builtAt["Build("+image+")"]
+				if !assert.True(t, ok, "stage '%s' was not built", stage) {
+					continue
+				}
+				for _, dep := range dependencies[stage] {
+					assert.Less(t, builtAt["Build("+images[dep]+")"], index, "stage '%s' was built before its dependency '%s'", stage, dep)
+				}
+			}
 		})
 	}
 }
 
+func TestBuildCancelsOnFailure(t *testing.T) {
+	fakeEngine := enginetest.NewWithCallbacks(func(ctx context.Context, image string) error {
+		switch image {
+		case "fake-target-image:parallel-1-1-v2-3bd9e8d6e2c9d992986ea1b5d5d57483d5f239df7f25fb832c60705bd3ecbf28":
+			return errors.New("build failed")
+		case "fake-target-image:parallel-2-1-v2-3bd9e8d6e2c9d992986ea1b5d5d57483d5f239df7f25fb832c60705bd3ecbf28":
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	fakeExecutor := executortest.New()
+	builderDef := NewDefinitionFromPath("concurrency", "../../fixtures/concurrency")
+	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{BuildConcurrency: 2}, "fake-target-image", "../../fixtures/empty")
+
+	_, err := b.BuildStages(context.Background(), []string{"final"})
+	assert.EqualError(t, err, "error while building stage 'parallel-1-1': build failed")
+	assert.Empty(t, fakeEngine.MethodCalls)
+}
+
 func stagesToHashes(stages []BuildStage) []string {
 	contentHashs := []string{}
 	for _, v := range stages {
@@ -99,12 +184,176 @@ func stagesToHashes(stages []BuildStage) []string {
 	return contentHashs
 }
 
-func delayInOrder(t *testing.T, delays map[string]time.Duration) func(string) {
-	return func(image string) {
+func delayInOrder(t *testing.T, delays map[string]time.Duration) func(context.Context, string) error {
+	return func(ctx context.Context, image string) error {
 		v, ok := delays[image]
 		if !ok {
 			t.Fatalf("The image '%s' had no delay defined", image)
 		}
 		time.Sleep(v)
+		return nil
+	}
+}
+
+func TestPrepareWithCacheLookupErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	targetImage := strings.TrimPrefix(server.URL, "http://") + "/app"
+
+	fakeEngine := enginetest.New()
+	fakeExecutor := executortest.New()
+	builderDef := NewDefinitionFromPath("complex", "../../fixtures/complex")
+
+	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{CacheImagePull: true, CacheLookupErrors: CacheLookupErrorsFail}, targetImage, "../../fixtures/empty")
+	_, err := b.PrepareStages(context.Background(), []string{"5"})
+	assert.ErrorContains(t, err, "error while verifying if image '"+targetImage+":5-v2-ff737829")
+	assert.ErrorContains(t, err, "unauthorized error")
+
+	b = NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{CacheImagePull: true, CacheLookupErrors: CacheLookupErrorsWarn}, targetImage, "../../fixtures/empty")
+	stages, err := b.PrepareStages(context.Background(), []string{"5"})
+	assert.NoError(t, err)
+	if assert.Len(t, stages, 1) {
+		assert.Equal(t, ImageAbsent, stages[0].Status())
+	}
+
+	// A local target image is never looked up
+	b = NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{CacheImagePull: true, CacheLookupErrors: CacheLookupErrorsFail, LocalTargetImage: true}, targetImage, "../../fixtures/empty")
+	stages, err = b.PrepareStages(context.Background(), []string{"5"})
+	assert.NoError(t, err)
+	if assert.Len(t, stages, 1) {
+		assert.Equal(t, ImageAbsent, stages[0].Status())
+	}
+}
+
+func TestBuildWithBuildArgsAndSecrets(t *testing.T) {
+	builderDef := NewDefinitionFromPath("build-args", "../../fixtures/build-args")
+	buildConf := readBuildConfiguration(t, `builderName: build-args
+globalSpec:
+  buildArgs:
+    RUBY_VERSION: "3.1"
+`)
+	secrets := []engine.Secret{{ID: "gem_token", Env: "GEM_TOKEN"}}
+
+	fakeEngine := enginetest.New()
+	b := NewBuild(fakeEngine, executortest.New(), builderDef, buildConf, BuildOptions{Secrets: secrets}, "fake-target-image", "../../fixtures/empty")
+	stages, err := b.BuildStages(context.Background(), []string{"release"})
+	if !assert.NoError(t, err) || !assert.Len(t, stages, 1) {
+		return
+	}
+	assert.Equal(t, map[string]string{"RUBY_VERSION": "3.1", "RAILS_ENV": "production"}, stages[0].BuildArgs())
+	assert.Equal(t, stages[0].BuildArgs(), fakeEngine.BuildOptions[stages[0].ImageURL()].BuildArgs)
+	assert.Equal(t, secrets, fakeEngine.BuildOptions[stages[0].ImageURL()].Secrets)
+
+	// Build arguments are part of the Content Hash, secrets are not
+	withoutSecrets := NewBuild(enginetest.New(), executortest.New(), builderDef, buildConf, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
+	sameStages, err := withoutSecrets.PrepareStages(context.Background(), []string{"release"})
+	assert.NoError(t, err)
+	assert.Equal(t, stagesToHashes(stages), stagesToHashes(sameStages))
+
+	withoutBuildArgs := NewBuild(enginetest.New(), executortest.New(), builderDef, config.BuildConfiguration{}, BuildOptions{Secrets: secrets}, "fake-target-image", "../../fixtures/empty")
+	otherStages, err := withoutBuildArgs.PrepareStages(context.Background(), []string{"release"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, stagesToHashes(stages), stagesToHashes(otherStages))
+}
+
+func TestBuildLabels(t *testing.T) {
+	builderDef := NewDefinitionFromPath("build-args", "../../fixtures/build-args")
+	buildConf := readBuildConfiguration(t, `builderName: build-args`)
+
+	fakeEngine := enginetest.New()
+	b := NewBuild(fakeEngine, executortest.New(), builderDef, buildConf, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
+	stages, err := b.BuildStages(context.Background(), []string{"release"})
+	if !assert.NoError(t, err) || !assert.Len(t, stages, 1) {
+		return
+	}
+
+	labels := fakeEngine.BuildOptions[stages[0].ImageURL()].Labels
+	assert.Equal(t, "release", labels["org.opencontainers.image.title"])
+	assert.Equal(t, stages[0].ContentHash(), labels["image-builder.content-hash"])
+	assert.Equal(t, stages[0].ContentHash(), labels["org.opencontainers.image.version"])
+	assert.Equal(t, "build-args", labels["image-builder.builder.name"])
+	_, err = time.Parse(time.RFC3339, labels["org.opencontainers.image.created"])
+	assert.NoError(t, err)
+
+	// Without a Git repository, the labels about it are omitted
+	assert.NotContains(t, labels, "org.opencontainers.image.revision")
+	assert.NotContains(t, labels, "image-builder.builder.commit")
+}
+
+func TestBuildForPlatforms(t *testing.T) {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(stdlog.New(ioutil.Discard, "", 0))))
+	defer server.Close()
+	targetImage := strings.TrimPrefix(server.URL, "http://") + "/app"
+	builderDef := NewDefinitionFromPath("multi-platform", "../../fixtures/multi-platform")
+
+	fakeEngine := enginetest.NewWithCallbacks(pushPlatformImage(t))
+	b := NewBuild(fakeEngine, executortest.New(), builderDef, config.BuildConfiguration{}, BuildOptions{}, targetImage, "../../fixtures/empty")
+	_, err := b.BuildStages(context.Background(), []string{"release"})
+	assert.EqualError(t, err, "stage 'release' is built for platforms [linux/amd64 linux/arm64], which requires pushing its images to a registry")
+
+	b = NewBuild(fakeEngine, executortest.New(), builderDef, config.BuildConfiguration{}, BuildOptions{CacheImagePush: true}, targetImage, "../../fixtures/empty")
+	stages, err := b.BuildStages(context.Background(), []string{"release"})
+	if !assert.NoError(t, err) || !assert.Len(t, stages, 1) {
+		return
+	}
+	imageURL := stages[0].ImageURL()
+	assert.Equal(t, []string{"Build(" + imageURL + "-linux-amd64)", "Push(" + imageURL + "-linux-amd64)", "Build(" + imageURL + "-linux-arm64)", "Push(" + imageURL + "-linux-arm64)"}, fakeEngine.MethodCalls)
+	assert.Equal(t, "linux/arm64", fakeEngine.BuildOptions[imageURL+"-linux-arm64"].Platform)
+
+	ref, err := name.ParseReference(imageURL)
+	assert.NoError(t, err)
+	idx, err := remote.Index(ref)
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := idx.IndexManifest()
+	assert.NoError(t, err)
+	platforms := []string{}
+	for _, m := range manifest.Manifests {
+		platforms = append(platforms, m.Platform.OS+"/"+m.Platform.Architecture)
+	}
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, platforms)
+
+	// The platforms are part of the Content Hash, and the ones of the Build
+	// Configuration replace the directive
+	buildConf := readBuildConfiguration(t, `builderName: multi-platform
+releaseSpec:
+  platforms:
+  - linux/arm64
+`)
+	b = NewBuild(enginetest.New(), executortest.New(), builderDef, buildConf, BuildOptions{}, targetImage, "../../fixtures/empty")
+	otherStages, err := b.PrepareStages(context.Background(), []string{"release"})
+	if assert.NoError(t, err) && assert.Len(t, otherStages, 1) {
+		assert.Equal(t, []string{"linux/arm64"}, otherStages[0].Platforms())
+		assert.NotEqual(t, stagesToHashes(stages), stagesToHashes(otherStages))
+	}
+}
+
+// pushPlatformImage returns a build callback pushing a random image for the
+// platform the tag of an image ends with
+func pushPlatformImage(t *testing.T) func(context.Context, string) error {
+	return func(ctx context.Context, image string) error {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			return err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(image, "-")
+		cfg.OS, cfg.Architecture = parts[len(parts)-2], parts[len(parts)-1]
+		if img, err = mutate.ConfigFile(img, cfg); err != nil {
+			return err
+		}
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			return err
+		}
+		return remote.Write(ref, img)
 	}
 }
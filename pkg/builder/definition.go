@@ -6,38 +6,84 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/maxlaverse/image-builder/pkg/builder/source"
+	"github.com/maxlaverse/image-builder/pkg/config"
 	"github.com/maxlaverse/image-builder/pkg/utils"
 )
 
 // Definition is the interface to a builder definition, allowing to find stages
 // or Dockerfiles to build
 type Definition interface {
-	CheckValidity() error
+	CheckValidity(buildConf *config.BuildConfiguration) error
+	Manifest() (*Manifest, error)
+	Locations() []string
+	GetPartials() (map[string]string, error)
 	GetStages() ([]string, error)
 	GetStageDirectory(stage string) string
 	GetStageDockerfile(stageName string) string
 }
 
+const (
+	// PartialsDir is the folder holding the templates Dockerfiles can
+	// include, in a builder or in its location
+	PartialsDir = "_partials"
+
+	partialExtension = ".tmpl"
+)
+
 type builderDef struct {
-	name string
-	path string
+	name     string
+	path     string
+	location string
+	parent   *builderDef
 }
 
 // NewDefinitionFromLocation returns a builder definition from a local or
-// remote location
-func NewDefinitionFromLocation(name, location string) (Definition, error) {
+// remote location. Git locations are checked out at the commit recorded in
+// the lockfile, and the commit they resolved to is recorded otherwise. The
+// lockfile can be nil. When offline, Git locations are never fetched, and
+// tarballs and OCI artifacts are never downloaded. The builders a builder
+// extends are loaded the same way.
+func NewDefinitionFromLocation(name, location string, lock *source.Lockfile, offline bool) (Definition, error) {
 	cacheRoot, err := getCacheRoot()
 	if err != nil {
 		return nil, err
 	}
 
+	def, err := newDefinitionFromLocation(name, location, cacheRoot, lock, offline, nil)
+	if err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func newDefinitionFromLocation(name, location, cacheRoot string, lock *source.Lockfile, offline bool, children []string) (*builderDef, error) {
+	key := fmt.Sprintf("%s#%s", location, name)
+	if utils.ItemExists(children, key) {
+		return nil, fmt.Errorf("builder '%s' extends itself: %s", name, strings.Join(append(children, key), " -> "))
+	}
+
+	l, err := source.ParseBuilderLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
 	var localPath string
-	if source.IsSourceGit(location) {
-		localPath, err = source.FromGit(name, location, cacheRoot)
-	} else {
-		localPath, err = source.FromFilesystem(name, location)
+	switch l.Kind {
+	case source.LocationGit:
+		localPath, err = source.FromGit(name, l, cacheRoot, lock, offline)
+	case source.LocationTarball:
+		localPath, err = source.FromTarball(name, l, cacheRoot, offline)
+	case source.LocationOCI:
+		localPath, err = source.FromOCI(name, l, cacheRoot, offline)
+	case source.LocationFilesystem:
+		localPath, err = source.FromFilesystem(name, l.Path)
+	default:
+		err = fmt.Errorf("builder location '%s' has an unsupported type '%s'", location, l.Kind)
 	}
 	if err != nil {
 		return nil, err
@@ -47,8 +93,23 @@ func NewDefinitionFromLocation(name, location string) (Definition, error) {
 		return nil, fmt.Errorf("Builder '%s' was not found at '%s'", name, location)
 	}
 
-	def := NewDefinitionFromPath(name, localPath)
-	if err := def.CheckValidity(); err != nil {
+	def := &builderDef{name: name, path: localPath, location: location}
+	manifest, err := readManifest(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil && len(manifest.Extends) > 0 {
+		parentLocation, parentName, err := manifest.parent(localPath)
+		if err != nil {
+			return nil, err
+		}
+		def.parent, err = newDefinitionFromLocation(parentName, parentLocation, cacheRoot, lock, offline, append(children, key))
+		if err != nil {
+			return nil, fmt.Errorf("error loading the builder '%s' extends: %w", name, err)
+		}
+	}
+
+	if err := def.CheckValidity(nil); err != nil {
 		return nil, err
 	}
 
@@ -58,13 +119,17 @@ func NewDefinitionFromLocation(name, location string) (Definition, error) {
 // NewDefinitionFromPath returns a builder definition from the local path
 func NewDefinitionFromPath(name, localPath string) Definition {
 	return &builderDef{
-		name: name,
-		path: localPath,
+		name:     name,
+		path:     localPath,
+		location: localPath,
 	}
 }
 
-// CheckValidity returns if a builder seems valid
-func (b *builderDef) CheckValidity() error {
+// CheckValidity returns if a builder seems valid. When the builder has a
+// manifest and a Build Configuration is given, the spec of the configuration
+// is also validated against the parameters declared in the manifest, and in
+// the ones of the builders it extends.
+func (b *builderDef) CheckValidity(buildConf *config.BuildConfiguration) error {
 	stages, err := b.GetStages()
 	if err != nil {
 		return err
@@ -73,11 +138,82 @@ func (b *builderDef) CheckValidity() error {
 	if len(stages) == 0 {
 		return fmt.Errorf("No stages found for Builder '%s'", b.name)
 	}
-	return nil
+
+	ownStages, err := b.ownStages()
+	if err != nil {
+		return err
+	}
+	ownManifest, err := readManifest(b.path)
+	if err != nil {
+		return err
+	}
+	if ownManifest != nil {
+		if err := ownManifest.check(b.name, ownStages, stages); err != nil {
+			return err
+		}
+	}
+	if b.parent != nil {
+		if err := b.parent.CheckValidity(nil); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := b.Manifest()
+	if err != nil || manifest == nil || buildConf == nil {
+		return err
+	}
+	return manifest.validate(stages, buildConf)
+}
+
+// Manifest returns the manifest of the builder, or nil if it has none. The
+// parameters of the builders it extends are included, unless overridden.
+func (b *builderDef) Manifest() (*Manifest, error) {
+	manifest, err := readManifest(b.path)
+	if err != nil || b.parent == nil {
+		return manifest, err
+	}
+
+	parentManifest, err := b.parent.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return manifest.merge(parentManifest), nil
 }
 
-// GetStages returns the name of the supported stages
+// Locations returns the location of the builder, followed by the ones of
+// the builders it extends
+func (b *builderDef) Locations() []string {
+	locations := []string{b.location}
+	if b.parent != nil {
+		locations = append(locations, b.parent.Locations()...)
+	}
+	return locations
+}
+
+// GetStages returns the name of the supported stages, including the ones
+// inherited from the builders it extends
 func (b *builderDef) GetStages() ([]string, error) {
+	stages, err := b.ownStages()
+	if err != nil || b.parent == nil {
+		return stages, err
+	}
+
+	parentStages, err := b.parent.GetStages()
+	if err != nil {
+		return nil, err
+	}
+	for _, stage := range parentStages {
+		if !utils.ItemExists(stages, stage) {
+			stages = append(stages, stage)
+		}
+	}
+	sort.Strings(stages)
+	return stages, nil
+}
+
+// ownStages returns the name of the stages defined in the folder of the
+// builder
+func (b *builderDef) ownStages() ([]string, error) {
 	files, err := ioutil.ReadDir(b.path)
 	if err != nil {
 		return nil, err
@@ -85,7 +221,7 @@ func (b *builderDef) GetStages() ([]string, error) {
 
 	stages := []string{}
 	for _, file := range files {
-		if !file.IsDir() {
+		if !file.IsDir() || file.Name() == PartialsDir {
 			continue
 		}
 
@@ -98,14 +234,52 @@ func (b *builderDef) GetStages() ([]string, error) {
 	return stages, nil
 }
 
-// GetStageDirectory returns the path of the folder of a stage
+// GetPartials returns the content of the templates found in the partials
+// folder of the builder's location, and of the builder itself, by name. The
+// partials of the builder override the ones of its location, which override
+// the ones of the builders it extends.
+func (b *builderDef) GetPartials() (map[string]string, error) {
+	partials := map[string]string{}
+	if b.parent != nil {
+		parentPartials, err := b.parent.GetPartials()
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range parentPartials {
+			partials[name] = content
+		}
+	}
+
+	for _, dir := range []string{path.Join(path.Dir(b.path), PartialsDir), path.Join(b.path, PartialsDir)} {
+		files, err := filepath.Glob(path.Join(dir, "*"+partialExtension))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			partials[strings.TrimSuffix(path.Base(file), partialExtension)] = string(content)
+		}
+	}
+	return partials, nil
+}
+
+// GetStageDirectory returns the path of the folder of a stage. Stages that
+// are not defined by the builder itself are looked up in the builders it
+// extends.
 func (b *builderDef) GetStageDirectory(stageName string) string {
-	return path.Join(b.path, stageName)
+	stageDir := path.Join(b.path, stageName)
+	if b.parent != nil && !utils.PathExists(path.Join(stageDir, "Dockerfile")) {
+		return b.parent.GetStageDirectory(stageName)
+	}
+	return stageDir
 }
 
 // GetStageDockerfile returns the path of the folder of a stage
 func (b *builderDef) GetStageDockerfile(stageName string) string {
-	return path.Join(b.path, stageName, "Dockerfile")
+	return path.Join(b.GetStageDirectory(stageName), "Dockerfile")
 }
 
 func getCacheRoot() (string, error) {
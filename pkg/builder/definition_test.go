@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/maxlaverse/image-builder/pkg/config"
+	enginetest "github.com/maxlaverse/image-builder/pkg/engine/test"
+	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefinitionExtends(t *testing.T) {
+	location := "../../fixtures/extends"
+	builderDef, err := newDefinitionFromLocation("sidekiq-debian", location, tempDir(t), nil, false, nil)
+	assert.NoError(t, err)
+
+	stages, err := builderDef.GetStages()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"base", "cache-packages", "release"}, stages)
+	assert.Equal(t, path.Join(location, "rails-debian/base"), builderDef.GetStageDirectory("base"))
+	assert.Equal(t, path.Join(location, "sidekiq-debian/release/Dockerfile"), builderDef.GetStageDockerfile("release"))
+	assert.Equal(t, []string{location, location}, builderDef.Locations())
+
+	manifest, err := builderDef.Manifest()
+	assert.NoError(t, err)
+	assert.Equal(t, "sidekiq-debian", manifest.Name)
+	assert.Equal(t, map[string]interface{}{"railsEnv": "production"}, manifest.Defaults())
+	assert.Contains(t, manifest.Parameters, "queues")
+}
+
+func TestPrepareExtendedDefinition(t *testing.T) {
+	builderDef, err := newDefinitionFromLocation("sidekiq-debian", "../../fixtures/extends", tempDir(t), nil, false, nil)
+	assert.NoError(t, err)
+	b := NewBuild(enginetest.New(), executortest.New(), builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
+
+	release, err := b.HashManifest(context.Background(), "release")
+	assert.NoError(t, err)
+	assert.Contains(t, release.Dockerfile, `CMD ["sidekiq"]`)
+	assert.Contains(t, release.BuilderStages, "cache-packages")
+
+	// Inherited stages keep using the folder they come from as builder context
+	cachePackages, err := b.HashManifest(context.Background(), "cache-packages")
+	assert.NoError(t, err)
+	assert.Equal(t, "../../fixtures/extends/rails-debian/cache-packages", cachePackages.BuildContext)
+}
+
+func TestDefinitionExtendsItself(t *testing.T) {
+	_, err := newDefinitionFromLocation("cycle-a", "../../fixtures/extends", tempDir(t), nil, false, nil)
+	assert.EqualError(t, err, "error loading the builder 'cycle-a' extends: error loading the builder 'cycle-b' extends: builder 'cycle-a' extends itself: ../../fixtures/extends#cycle-a -> ../../fixtures/extends#cycle-b -> ../../fixtures/extends#cycle-a")
+}
+
+func TestDefinitionPartials(t *testing.T) {
+	builderDef := NewDefinitionFromPath("app", "../../fixtures/partials/app")
+
+	stages, err := builderDef.GetStages()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"base", "release"}, stages)
+
+	partials, err := builderDef.GetPartials()
+	assert.NoError(t, err)
+	assert.Len(t, partials, 2)
+	assert.Contains(t, partials, "apt-install")
+	assert.Contains(t, partials, "users")
+}
+
+func TestPrepareDefinitionWithPartials(t *testing.T) {
+	builderDef := NewDefinitionFromPath("app", "../../fixtures/partials/app")
+	buildConf := readBuildConfiguration(t, `builderName: app
+globalSpec:
+  runtimePackages:
+  - ca-certificates
+  - curl
+`)
+	b := NewBuild(enginetest.New(), executortest.New(), builderDef, buildConf, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
+
+	base, err := b.HashManifest(context.Background(), "base")
+	assert.NoError(t, err)
+	assert.Contains(t, base.Dockerfile, "apt-get install -y --no-install-recommends ca-certificates curl")
+	assert.Len(t, base.Partials, 1)
+	assert.Contains(t, base.Partials, "apt-install")
+
+	release, err := b.HashManifest(context.Background(), "release")
+	assert.NoError(t, err)
+	assert.Contains(t, release.Dockerfile, "USER app")
+	assert.Len(t, release.Partials, 1)
+	assert.Contains(t, release.Partials, "users")
+}
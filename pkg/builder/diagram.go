@@ -0,0 +1,170 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/maxlaverse/image-builder/pkg/utils"
+)
+
+// DependencyGraph describes the stages of a build, the stages each of them
+// requires and the external images they are based on
+type DependencyGraph struct {
+	Stages []GraphStage `json:"stages"`
+}
+
+// GraphStage is a node of a DependencyGraph. The status is only set when
+// the registries were looked up for cached images.
+type GraphStage struct {
+	Name           string           `json:"name"`
+	ContentHash    string           `json:"contentHash"`
+	Status         StageImageStatus `json:"status,omitempty"`
+	Dependencies   []string         `json:"dependencies"`
+	ExternalImages []string         `json:"externalImages"`
+}
+
+// DependencyGraph prepares a set of stages, and returns the graph of all the
+// stages they require, sorted by name
+func (b *Build) DependencyGraph(ctx context.Context, stageNames []string) (*DependencyGraph, error) {
+	stages, err := b.PrepareStages(ctx, stageNames)
+	if err != nil {
+		return nil, fmt.Errorf("error while preparing some stages: %w", err)
+	}
+	if _, err := b.stageGraph(); err != nil {
+		return nil, err
+	}
+
+	graph := &DependencyGraph{Stages: []GraphStage{}}
+	for _, stage := range stages {
+		deps := append([]string{}, stage.GetRequiredStages()...)
+		sort.Strings(deps)
+		images := []string{}
+		for image := range stage.ExternalImages() {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+
+		node := GraphStage{
+			Name:           stage.Name(),
+			ContentHash:    stage.ContentHash(),
+			Dependencies:   deps,
+			ExternalImages: images,
+		}
+		if b.opts.CacheImagePull {
+			node.Status = stage.Status()
+		}
+		graph.Stages = append(graph.Stages, node)
+	}
+	sort.Slice(graph.Stages, func(i, j int) bool {
+		return graph.Stages[i].Name < graph.Stages[j].Name
+	})
+	return graph, nil
+}
+
+// Dot returns the graph in the DOT language of Graphviz. Edges go from a
+// stage or an external image to the stages based on it.
+func (g *DependencyGraph) Dot() string {
+	lines := []string{"digraph stages {", "  rankdir=LR;"}
+	for _, stage := range g.Stages {
+		lines = append(lines, fmt.Sprintf("  %s [shape=box, label=%s];", dotID("stage:"+stage.Name), dotID(strings.Join(stage.label(), "\n"))))
+	}
+	for _, image := range g.externalImages() {
+		lines = append(lines, fmt.Sprintf("  %s [shape=box, style=dashed, label=%s];", dotID("image:"+image), dotID(image)))
+	}
+	for _, stage := range g.Stages {
+		for _, dep := range stage.Dependencies {
+			lines = append(lines, fmt.Sprintf("  %s -> %s;", dotID("stage:"+dep), dotID("stage:"+stage.Name)))
+		}
+		for _, image := range stage.ExternalImages {
+			lines = append(lines, fmt.Sprintf("  %s -> %s [style=dashed];", dotID("image:"+image), dotID("stage:"+stage.Name)))
+		}
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Mermaid returns the graph as a Mermaid flowchart, which can be embedded in
+// Markdown documents. Edges go from a stage or an external image to the
+// stages based on it.
+func (g *DependencyGraph) Mermaid() string {
+	images := g.externalImages()
+	imageIDs := map[string]string{}
+	for i, image := range images {
+		imageIDs[image] = fmt.Sprintf("image%d", i)
+	}
+	stageIDs := map[string]string{}
+	for i, stage := range g.Stages {
+		stageIDs[stage.Name] = fmt.Sprintf("stage%d", i)
+	}
+
+	lines := []string{"flowchart LR"}
+	for _, stage := range g.Stages {
+		lines = append(lines, fmt.Sprintf("  %s[%s]", stageIDs[stage.Name], mermaidLabel(stage.label())))
+	}
+	for _, image := range images {
+		lines = append(lines, fmt.Sprintf("  %s[(%s)]", imageIDs[image], mermaidLabel([]string{image})))
+	}
+	for _, stage := range g.Stages {
+		for _, dep := range stage.Dependencies {
+			lines = append(lines, fmt.Sprintf("  %s --> %s", stageIDs[dep], stageIDs[stage.Name]))
+		}
+		for _, image := range stage.ExternalImages {
+			lines = append(lines, fmt.Sprintf("  %s -.-> %s", imageIDs[image], stageIDs[stage.Name]))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// externalImages returns the external images referenced by any stage
+func (g *DependencyGraph) externalImages() []string {
+	images := []string{}
+	for _, stage := range g.Stages {
+		for _, image := range stage.ExternalImages {
+			if !utils.ItemExists(images, image) {
+				images = append(images, image)
+			}
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+// label returns the lines describing a stage in a diagram
+func (s GraphStage) label() []string {
+	lines := []string{s.Name, shortContentHash(s.ContentHash)}
+	if len(s.Status) > 0 {
+		lines = append(lines, string(s.Status))
+	}
+	return lines
+}
+
+// shortContentHash shortens a Content Hash to keep diagrams readable
+func shortContentHash(hash string) string {
+	const length = 12
+	scheme := ""
+	if i := strings.Index(hash, "-"); i >= 0 {
+		scheme, hash = hash[:i+1], hash[i+1:]
+	}
+	if len(hash) > length {
+		hash = hash[:length]
+	}
+	return scheme + hash
+}
+
+// dotID quotes a string to be used as an identifier in the DOT language
+func dotID(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+// mermaidLabel quotes the lines of a label of a Mermaid node
+func mermaidLabel(lines []string) string {
+	escaped := []string{}
+	for _, l := range lines {
+		escaped = append(escaped, strings.ReplaceAll(l, `"`, "#quot;"))
+	}
+	return `"` + strings.Join(escaped, "<br/>") + `"`
+}
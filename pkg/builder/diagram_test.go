@@ -0,0 +1,56 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/maxlaverse/image-builder/pkg/config"
+	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/maxlaverse/image-builder/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	template.SetPlaceholders(true)
+	defer template.SetPlaceholders(false)
+
+	builderDef := NewDefinitionFromPath("render", "../../fixtures/render")
+	b := NewBuild(nil, executortest.New(), builderDef, config.BuildConfiguration{}, BuildOptions{DryRun: true}, "fake-target-image", "../../fixtures/folder-listing")
+	graph, err := b.DependencyGraph(context.Background(), []string{"release"})
+	if !assert.NoError(t, err) || !assert.Len(t, graph.Stages, 2) {
+		return
+	}
+
+	assert.Equal(t, "base", graph.Stages[0].Name)
+	assert.Equal(t, []string{}, graph.Stages[0].Dependencies)
+	assert.Equal(t, []string{"debian:bullseye-slim"}, graph.Stages[0].ExternalImages)
+	assert.Empty(t, graph.Stages[0].Status)
+	assert.Equal(t, "release", graph.Stages[1].Name)
+	assert.Equal(t, []string{"base"}, graph.Stages[1].Dependencies)
+	assert.Equal(t, []string{}, graph.Stages[1].ExternalImages)
+}
+
+func TestDependencyGraphFormats(t *testing.T) {
+	graph := &DependencyGraph{Stages: []GraphStage{
+		{Name: "base", ContentHash: "v2-0123456789abcdef", Status: ImageCached, Dependencies: []string{}, ExternalImages: []string{"debian:bullseye-slim"}},
+		{Name: "release", ContentHash: "v2-fedcba9876543210", Status: ImageAbsent, Dependencies: []string{"base"}, ExternalImages: []string{}},
+	}}
+
+	assert.Equal(t, `digraph stages {
+  rankdir=LR;
+  "stage:base" [shape=box, label="base\nv2-0123456789ab\npresent-in-cache"];
+  "stage:release" [shape=box, label="release\nv2-fedcba987654\nabsent"];
+  "image:debian:bullseye-slim" [shape=box, style=dashed, label="debian:bullseye-slim"];
+  "image:debian:bullseye-slim" -> "stage:base" [style=dashed];
+  "stage:base" -> "stage:release";
+}
+`, graph.Dot())
+
+	assert.Equal(t, `flowchart LR
+  stage0["base<br/>v2-0123456789ab<br/>present-in-cache"]
+  stage1["release<br/>v2-fedcba987654<br/>absent"]
+  image0[("debian:bullseye-slim")]
+  image0 -.-> stage0
+  stage0 --> stage1
+`, graph.Mermaid())
+}
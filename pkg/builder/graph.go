@@ -0,0 +1,123 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stageGraph represents the dependencies between stages
+type stageGraph struct {
+	deps map[string][]string
+}
+
+// newStageGraph returns the dependency graph of stages, given the stages each
+// of them requires. It fails if a dependency is unknown or if there is a
+// circular dependency.
+func newStageGraph(deps map[string][]string) (*stageGraph, error) {
+	g := &stageGraph{deps: map[string][]string{}}
+	for name, stageDeps := range deps {
+		sortedDeps := append([]string{}, stageDeps...)
+		sort.Strings(sortedDeps)
+		g.deps[name] = sortedDeps
+	}
+
+	for _, name := range g.names() {
+		for _, dep := range g.deps[name] {
+			if _, ok := g.deps[dep]; !ok {
+				return nil, fmt.Errorf("stage '%s' dependency of '%s' was not prepared", dep, name)
+			}
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, newCycleError(cycle)
+	}
+	return g, nil
+}
+
+// dependencies returns the stages a stage directly depends on
+func (g *stageGraph) dependencies(name string) []string {
+	return g.deps[name]
+}
+
+// topologicalOrder returns the stages reachable from the targets, each stage
+// appearing after all of its dependencies
+func (g *stageGraph) topologicalOrder(targets []string) []string {
+	order := []string{}
+	visited := map[string]bool{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, dep := range g.deps[name] {
+			visit(dep)
+		}
+		order = append(order, name)
+	}
+
+	for _, name := range targets {
+		visit(name)
+	}
+	return order
+}
+
+// findCycle returns the path of the first circular dependency found, if any
+func (g *stageGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := map[string]int{}
+	path := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case done:
+			return nil
+		case inProgress:
+			for i, n := range path {
+				if n == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+
+		state[name] = inProgress
+		path = append(path, name)
+		for _, dep := range g.deps[name] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+
+	for _, name := range g.names() {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+func (g *stageGraph) names() []string {
+	names := []string{}
+	for name := range g.deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newCycleError returns an error describing a circular dependency
+func newCycleError(path []string) error {
+	return fmt.Errorf("circular dependency between stages: %s", strings.Join(path, " -> "))
+}
@@ -0,0 +1,37 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStageGraphTopologicalOrder(t *testing.T) {
+	g, err := newStageGraph(map[string][]string{
+		"final":        {"parallel-2-2", "parallel-1-2"},
+		"parallel-1-1": {},
+		"parallel-1-2": {"parallel-1-1"},
+		"parallel-2-1": {},
+		"parallel-2-2": {"parallel-2-1"},
+		"unrelated":    {},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"parallel-1-1", "parallel-1-2", "parallel-2-1", "parallel-2-2", "final"}, g.topologicalOrder([]string{"final"}))
+	assert.Equal(t, []string{"parallel-1-2", "parallel-2-2"}, g.dependencies("final"))
+}
+
+func TestStageGraphCycle(t *testing.T) {
+	_, err := newStageGraph(map[string][]string{
+		"1": {"2"},
+		"2": {"3"},
+		"3": {"1"},
+	})
+	assert.EqualError(t, err, "circular dependency between stages: 1 -> 2 -> 3 -> 1")
+}
+
+func TestStageGraphUnknownDependency(t *testing.T) {
+	_, err := newStageGraph(map[string][]string{
+		"1": {"2"},
+	})
+	assert.EqualError(t, err, "stage '2' dependency of '1' was not prepared")
+}
@@ -0,0 +1,202 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
+)
+
+// HashManifest lists all the inputs the Content Hash of a stage is computed
+// from
+type HashManifest struct {
+	Stage          string                 `json:"stage"`
+	ContentHash    string                 `json:"contentHash"`
+	HashScheme     fileutils.HashScheme   `json:"hashScheme"`
+	BuildContext   string                 `json:"buildContext"`
+	Files          []fileutils.FileDigest `json:"files"`
+	Dockerfile     string                 `json:"dockerfile"`
+	ExternalImages map[string]string      `json:"externalImages"`
+	BuilderStages  map[string]string      `json:"builderStages"`
+	Partials       map[string]string      `json:"partials,omitempty"`
+	BuildArgs      map[string]string      `json:"buildArgs,omitempty"`
+	Platforms      map[string]string      `json:"platforms,omitempty"`
+}
+
+// ReadHashManifest reads a manifest previously saved with Save
+func ReadHashManifest(filepath string) (*HashManifest, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	m := HashManifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing hash manifest '%s': %w", filepath, err)
+	}
+	return &m, nil
+}
+
+// Save writes the manifest as JSON into a file
+func (m *HashManifest) Save(filepath string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, append(data, '\n'), 0644)
+}
+
+// HashManifest prepares a stage and returns the manifest of its Content Hash
+func (b *Build) HashManifest(ctx context.Context, stageName string) (*HashManifest, error) {
+	if _, err := b.PrepareStages(ctx, []string{stageName}); err != nil {
+		return nil, fmt.Errorf("error while preparing some stages: %w", err)
+	}
+
+	v, ok := b.buildStages.Load(stageName)
+	if !ok {
+		return nil, fmt.Errorf("stage '%s' was not prepared", stageName)
+	}
+	stage := v.(BuildStage)
+
+	m, err := stage.HashManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dep := range stage.GetRequiredStages() {
+		depStage, ok := b.buildStages.Load(dep)
+		if !ok {
+			return nil, fmt.Errorf("stage '%s' dependency of '%s' was not prepared", dep, stageName)
+		}
+		m.BuilderStages[dep] = depStage.(BuildStage).ContentHash()
+	}
+	return m, nil
+}
+
+// DiffHashManifests returns a human readable list of the differences between
+// two manifests
+func DiffHashManifests(previous, current *HashManifest) []string {
+	diff := []string{}
+	if previous.ContentHash != current.ContentHash {
+		diff = append(diff, fmt.Sprintf("Content Hash changed from '%s' to '%s'", previous.ContentHash, current.ContentHash))
+	}
+	if previous.HashScheme != current.HashScheme {
+		diff = append(diff, fmt.Sprintf("Hash scheme changed from '%s' to '%s'", previous.HashScheme, current.HashScheme))
+	}
+	if previous.BuildContext != current.BuildContext {
+		diff = append(diff, fmt.Sprintf("Build context changed from '%s' to '%s'", previous.BuildContext, current.BuildContext))
+	}
+
+	previousFiles := map[string]fileutils.FileDigest{}
+	for _, f := range previous.Files {
+		previousFiles[f.Path] = f
+	}
+	currentFiles := map[string]fileutils.FileDigest{}
+	for _, f := range current.Files {
+		currentFiles[f.Path] = f
+		p, ok := previousFiles[f.Path]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("File '%s' was added", f.Path))
+		} else if p.Mode != f.Mode {
+			diff = append(diff, fmt.Sprintf("File '%s' mode changed from %s to %s", f.Path, p.Mode, f.Mode))
+		} else if p.Link != f.Link {
+			diff = append(diff, fmt.Sprintf("File '%s' link changed from '%s' to '%s'", f.Path, p.Link, f.Link))
+		} else if p.Digest != f.Digest {
+			diff = append(diff, fmt.Sprintf("File '%s' content changed (%d bytes -> %d bytes)", f.Path, p.Size, f.Size))
+		}
+	}
+	for _, f := range previous.Files {
+		if _, ok := currentFiles[f.Path]; !ok {
+			diff = append(diff, fmt.Sprintf("File '%s' was removed", f.Path))
+		}
+	}
+
+	diff = append(diff, diffMaps("External image", previous.ExternalImages, current.ExternalImages)...)
+	diff = append(diff, diffMaps("Builder stage", previous.BuilderStages, current.BuilderStages)...)
+	diff = append(diff, diffMaps("Partial", previous.Partials, current.Partials)...)
+	diff = append(diff, diffMaps("Build argument", previous.BuildArgs, current.BuildArgs)...)
+	diff = append(diff, diffMaps("Platform", previous.Platforms, current.Platforms)...)
+
+	dockerfileDiff := diffLines(previous.Dockerfile, current.Dockerfile)
+	if len(dockerfileDiff) > 0 {
+		diff = append(diff, "Dockerfile changed:")
+		diff = append(diff, dockerfileDiff...)
+	}
+	return diff
+}
+
+// diffMaps returns the keys that were added, removed or changed between two
+// maps
+func diffMaps(kind string, previous, current map[string]string) []string {
+	keys := []string{}
+	for k := range previous {
+		keys = append(keys, k)
+	}
+	for k := range current {
+		if _, ok := previous[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	diff := []string{}
+	for _, k := range keys {
+		p, inPrevious := previous[k]
+		c, inCurrent := current[k]
+		if !inPrevious {
+			diff = append(diff, fmt.Sprintf("%s '%s' was added (%s)", kind, k, c))
+		} else if !inCurrent {
+			diff = append(diff, fmt.Sprintf("%s '%s' was removed", kind, k))
+		} else if p != c {
+			diff = append(diff, fmt.Sprintf("%s '%s' changed from '%s' to '%s'", kind, k, p, c))
+		}
+	}
+	return diff
+}
+
+// diffLines returns the lines removed and added between two texts, based on
+// their longest common subsequence
+func diffLines(previous, current string) []string {
+	if previous == current {
+		return nil
+	}
+	a := strings.Split(previous, "\n")
+	b := strings.Split(current, "\n")
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,97 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/maxlaverse/image-builder/pkg/config"
+	enginetest "github.com/maxlaverse/image-builder/pkg/engine/test"
+	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashManifest(t *testing.T) {
+	fakeEngine := enginetest.New()
+	fakeExecutor := executortest.New()
+	builderDef := NewDefinitionFromPath("complex", "../../fixtures/complex")
+	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{}, "fake-target-image", "../../fixtures/empty")
+
+	m, err := b.HashManifest(context.Background(), "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", m.Stage)
+	assert.Equal(t, "v2-84a10c3bf9212137c61ed906dffa0d62dc8a45ec103a5628040f2f19631e8c49", m.ContentHash)
+	assert.Equal(t, fileutils.HashSchemeSHA256, m.HashScheme)
+	assert.Equal(t, map[string]string{
+		"3": "v2-3e161b6de20c5e1e4ba669ad0694999fb6f8d8a99eaf31be41d3c2f95fd9e484",
+		"4": "v2-ff737829ff4cf8aa0f0305501232fc7d8337e31d532cbf3653cb294c9d29dd7d",
+	}, m.BuilderStages)
+	assert.Contains(t, m.Dockerfile, "FROM fake-target-image:4-v2-ff737829")
+	assert.Empty(t, m.Files)
+	assert.Empty(t, m.ExternalImages)
+}
+
+func TestHashManifestSaveAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &HashManifest{
+		Stage:          "release",
+		ContentHash:    "v2-abc",
+		Files:          []fileutils.FileDigest{{Path: "Gemfile", Mode: "100644", Size: 3, Digest: "sha256:123"}},
+		ExternalImages: map[string]string{"ruby:2.7": "ruby@sha256:456"},
+		BuilderStages:  map[string]string{},
+	}
+	assert.NoError(t, m.Save(path.Join(dir, "manifest.json")))
+
+	read, err := ReadHashManifest(path.Join(dir, "manifest.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, m, read)
+}
+
+func TestDiffHashManifests(t *testing.T) {
+	previous := &HashManifest{
+		ContentHash: "v2-abc",
+		HashScheme:  fileutils.HashSchemeSHA256,
+		Files: []fileutils.FileDigest{
+			{Path: "Gemfile", Mode: "100644", Size: 3, Digest: "sha256:1"},
+			{Path: "Gemfile.lock", Mode: "100644", Size: 3, Digest: "sha256:2"},
+			{Path: "bin/run", Mode: "100644", Size: 3, Digest: "sha256:3"},
+		},
+		Dockerfile:     "FROM ruby\nCOPY Gemfile .\nRUN bundle",
+		ExternalImages: map[string]string{"ruby": "ruby@sha256:1"},
+		BuilderStages:  map[string]string{"base": "v2-1"},
+	}
+	current := &HashManifest{
+		ContentHash: "v2-def",
+		HashScheme:  fileutils.HashSchemeSHA256,
+		Files: []fileutils.FileDigest{
+			{Path: "Gemfile", Mode: "100644", Size: 4, Digest: "sha256:4"},
+			{Path: "bin/run", Mode: "100755", Size: 3, Digest: "sha256:5"},
+			{Path: "config.ru", Mode: "100644", Size: 3, Digest: "sha256:6"},
+		},
+		Dockerfile:     "FROM ruby\nCOPY Gemfile Gemfile.lock .\nRUN bundle",
+		ExternalImages: map[string]string{"ruby": "ruby@sha256:2"},
+		BuilderStages:  map[string]string{"base": "v2-1", "deps": "v2-2"},
+	}
+
+	assert.Equal(t, []string{
+		"Content Hash changed from 'v2-abc' to 'v2-def'",
+		"File 'Gemfile' content changed (3 bytes -> 4 bytes)",
+		"File 'bin/run' mode changed from 100644 to 100755",
+		"File 'config.ru' was added",
+		"File 'Gemfile.lock' was removed",
+		"External image 'ruby' changed from 'ruby@sha256:1' to 'ruby@sha256:2'",
+		"Builder stage 'deps' was added (v2-2)",
+		"Dockerfile changed:",
+		"- COPY Gemfile .",
+		"+ COPY Gemfile Gemfile.lock .",
+	}, DiffHashManifests(previous, current))
+	assert.Empty(t, DiffHashManifests(current, current))
+}
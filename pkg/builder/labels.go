@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"time"
+
+	"github.com/maxlaverse/image-builder/pkg/template"
+)
+
+const (
+	// labelCreated is the date and time the image was built at
+	labelCreated = "org.opencontainers.image.created"
+
+	// labelRevision is the commit of the application the image was built from
+	labelRevision = "org.opencontainers.image.revision"
+
+	// labelSource is the URL of the repository of the application
+	labelSource = "org.opencontainers.image.source"
+
+	// labelTitle is the name of the stage
+	labelTitle = "org.opencontainers.image.title"
+
+	// labelVersion is the tag of the image of the stage
+	labelVersion = "org.opencontainers.image.version"
+
+	// labelContentHash is the Content Hash of the stage
+	labelContentHash = "image-builder.content-hash"
+
+	// labelBuilderName is the name of the Builder of the stage
+	labelBuilderName = "image-builder.builder.name"
+
+	// labelBuilderCommit is the commit of the Builder the stage was defined in
+	labelBuilderCommit = "image-builder.builder.commit"
+)
+
+// imageLabels returns the labels describing the application and the Builder
+// the image of a stage is built from. Labels without value are omitted.
+func (b *Build) imageLabels(stageName string) map[string]string {
+	return nonEmptyValues(map[string]string{
+		labelCreated:       time.Now().UTC().Format(time.RFC3339),
+		labelRevision:      template.SourceRevision(b.exec, b.localContext),
+		labelSource:        template.SourceURL(b.exec, b.localContext),
+		labelBuilderName:   b.buildConf.BuilderName(),
+		labelBuilderCommit: template.CheckoutRevision(b.exec, b.buildDef.GetStageDirectory(stageName)),
+	})
+}
+
+// stageLabels completes the labels of a build with the ones describing the
+// stage itself
+func (b *buildStage) stageLabels(labels map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[labelTitle] = b.name
+	result[labelContentHash] = b.ContentHash()
+	if tag, err := b.ImageTag(); err == nil {
+		result[labelVersion] = tag
+	}
+	return nonEmptyValues(result)
+}
+
+func nonEmptyValues(m map[string]string) map[string]string {
+	for k, v := range m {
+		if len(v) == 0 {
+			delete(m, k)
+		}
+	}
+	return m
+}
@@ -0,0 +1,355 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/maxlaverse/image-builder/pkg/builder/source"
+	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/maxlaverse/image-builder/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestName is the name of the file describing a builder, at the root of
+// its definition
+const ManifestName = "builder.yaml"
+
+// ParameterType is the type of value a parameter accepts
+type ParameterType string
+
+const (
+	// ParameterString accepts a string, or a number
+	ParameterString ParameterType = "string"
+
+	// ParameterList accepts a list of strings
+	ParameterList ParameterType = "list"
+
+	// ParameterBool accepts a boolean
+	ParameterBool ParameterType = "bool"
+
+	// ParameterEnum accepts one of the values of the parameter
+	ParameterEnum ParameterType = "enum"
+)
+
+// builtinParameters are the parameters every builder supports, whether they
+// are declared or not
+var builtinParameters = []string{"buildArgs", "contextInclude", "contextExclude", "contextHonorIgnoreFiles", "platforms"}
+
+// Manifest describes a builder and the parameters it accepts
+type Manifest struct {
+	Name        string                `yaml:"name"`
+	Version     string                `yaml:"version"`
+	Description string                `yaml:"description"`
+	Stages      []string              `yaml:"stages"`
+	Parameters  map[string]*Parameter `yaml:"parameters"`
+
+	// Extends is the builder whose stages are used when not defined by this
+	// builder, in the form <location>#<builder>
+	Extends string `yaml:"extends"`
+
+	path  string
+	lines map[string]int
+}
+
+// Parameter is a parameter a builder accepts in the spec of a Build
+// Configuration
+type Parameter struct {
+	Type        ParameterType `yaml:"type"`
+	Description string        `yaml:"description"`
+	Default     interface{}   `yaml:"default"`
+	Required    bool          `yaml:"required"`
+	Values      []string      `yaml:"values"`
+
+	// Stages are the only stages the parameter is used by, if any
+	Stages []string `yaml:"stages"`
+
+	line int
+}
+
+// validationError is an error found in a YAML file, at a given line
+type validationError struct {
+	line int
+	msg  string
+}
+
+// UnmarshalYAML records the line a parameter is declared at
+func (p *Parameter) UnmarshalYAML(value *yaml.Node) error {
+	type parameter Parameter
+	if err := value.Decode((*parameter)(p)); err != nil {
+		return err
+	}
+	p.line = value.Line
+	return nil
+}
+
+// readManifest returns the manifest of a builder, or nil if it has none
+func readManifest(builderPath string) (*Manifest, error) {
+	filepath := path.Join(builderPath, ManifestName)
+	data, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	node := yaml.Node{}
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("error parsing '%s': %w", filepath, err)
+	}
+	m := &Manifest{path: filepath, lines: map[string]int{}}
+	if err := node.Decode(m); err != nil {
+		return nil, fmt.Errorf("error parsing '%s': %w", filepath, err)
+	}
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.MappingNode {
+		root := node.Content[0]
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			m.lines[root.Content[i].Value] = root.Content[i].Line
+		}
+	}
+	return m, nil
+}
+
+// Defaults returns the default value of each parameter that has one
+func (m *Manifest) Defaults() map[string]interface{} {
+	defaults := map[string]interface{}{}
+	for name, p := range m.Parameters {
+		if p.Default != nil {
+			defaults[name] = p.Default
+		}
+	}
+	return defaults
+}
+
+// parent returns the location and the name of the builder a manifest
+// extends. Relative filesystem locations are relative to the folder of the
+// builder.
+func (m *Manifest) parent(builderPath string) (string, string, error) {
+	i := strings.LastIndex(m.Extends, "#")
+	if i < 0 || i == len(m.Extends)-1 {
+		return "", "", fmt.Errorf("invalid extends '%s' in '%s': missing builder name after '#'", m.Extends, m.path)
+	}
+	location, name := m.Extends[:i], m.Extends[i+1:]
+	if len(location) == 0 {
+		return "", "", fmt.Errorf("invalid extends '%s' in '%s': missing location before '#'", m.Extends, m.path)
+	}
+
+	l, err := source.ParseBuilderLocation(location)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid extends '%s' in '%s': %w", m.Extends, m.path, err)
+	}
+	if l.Kind == source.LocationFilesystem && !path.IsAbs(l.Path) {
+		location = path.Join(builderPath, l.Path)
+	}
+	return location, name, nil
+}
+
+// merge returns a manifest with the parameters of a parent manifest that are
+// not overridden
+func (m *Manifest) merge(parent *Manifest) *Manifest {
+	if m == nil {
+		return parent
+	} else if parent == nil {
+		return m
+	}
+
+	merged := *m
+	merged.Parameters = map[string]*Parameter{}
+	for name, p := range parent.Parameters {
+		merged.Parameters[name] = p
+	}
+	for name, p := range m.Parameters {
+		merged.Parameters[name] = p
+	}
+	return &merged
+}
+
+// check verifies that a manifest is consistent with the stages found in the
+// folder of a builder, and the ones it inherits
+func (m *Manifest) check(builderName string, ownStages, stages []string) error {
+	errs := []validationError{}
+	if len(m.Name) > 0 && m.Name != builderName {
+		errs = append(errs, validationError{m.lines["name"], fmt.Sprintf("name '%s' doesn't match the builder '%s'", m.Name, builderName)})
+	}
+	if len(m.Stages) > 0 {
+		for _, stage := range m.Stages {
+			if !utils.ItemExists(ownStages, stage) {
+				errs = append(errs, validationError{m.lines["stages"], fmt.Sprintf("stage '%s' has no folder", stage)})
+			}
+		}
+		for _, stage := range ownStages {
+			if !utils.ItemExists(m.Stages, stage) {
+				errs = append(errs, validationError{m.lines["stages"], fmt.Sprintf("stage '%s' is not declared", stage)})
+			}
+		}
+	}
+
+	for _, name := range sortedParameterNames(m.Parameters) {
+		p := m.Parameters[name]
+		switch p.Type {
+		case ParameterString, ParameterList, ParameterBool:
+		case ParameterEnum:
+			if len(p.Values) == 0 {
+				errs = append(errs, validationError{p.line, fmt.Sprintf("parameter '%s' is an enum without values", name)})
+			}
+		default:
+			errs = append(errs, validationError{p.line, fmt.Sprintf("parameter '%s' has an unknown type '%s', expected one of string, list, bool or enum", name, p.Type)})
+			continue
+		}
+		if p.Default != nil {
+			if msg := p.checkValue(p.Default); len(msg) > 0 {
+				errs = append(errs, validationError{p.line, fmt.Sprintf("default value of parameter '%s' %s", name, msg)})
+			}
+		}
+		for _, stage := range p.Stages {
+			if !utils.ItemExists(stages, stage) {
+				errs = append(errs, validationError{p.line, fmt.Sprintf("parameter '%s' is used by an unknown stage '%s'", name, stage)})
+			}
+		}
+	}
+	return formatValidationErrors(fmt.Sprintf("invalid builder manifest '%s'", m.path), m.path, errs)
+}
+
+// validate verifies that the spec of a Build Configuration only holds
+// parameters declared by the builder, with values of the right type, and
+// that the required parameters are set for every stage using them
+func (m *Manifest) validate(stages []string, buildConf *config.BuildConfiguration) error {
+	errs := []validationError{}
+	specs := buildConf.Specs()
+	for _, section := range sortedSectionNames(specs) {
+		stage := strings.TrimSuffix(section, "Spec")
+		if section != "globalSpec" && !utils.ItemExists(stages, stage) {
+			errs = append(errs, validationError{buildConf.Line(section), fmt.Sprintf("'%s' refers to an unknown stage '%s'", section, stage)})
+			continue
+		}
+
+		for _, name := range utils.MapKeys(specs[section]) {
+			line := buildConf.Line(section, name)
+			if utils.ItemExists(builtinParameters, name) {
+				continue
+			}
+			p, ok := m.Parameters[name]
+			if !ok {
+				errs = append(errs, validationError{line, fmt.Sprintf("unknown parameter '%s' in '%s'", name, section)})
+				continue
+			}
+			if section != "globalSpec" && len(p.Stages) > 0 && !utils.ItemExists(p.Stages, stage) {
+				errs = append(errs, validationError{line, fmt.Sprintf("parameter '%s' is not used by stage '%s'", name, stage)})
+			}
+			if msg := p.checkValue(specs[section][name]); len(msg) > 0 {
+				errs = append(errs, validationError{line, fmt.Sprintf("parameter '%s' %s", name, msg)})
+			}
+		}
+	}
+
+	for _, name := range sortedParameterNames(m.Parameters) {
+		p := m.Parameters[name]
+		if !p.Required || p.Default != nil {
+			continue
+		}
+		for _, stage := range p.stagesUsing(stages) {
+			if _, ok := buildConf.SpecAttribute(stage, name); !ok {
+				errs = append(errs, validationError{buildConf.Line(stage+"Spec", name), fmt.Sprintf("missing required parameter '%s' for stage '%s'", name, stage)})
+			}
+		}
+	}
+	return formatValidationErrors(fmt.Sprintf("build configuration '%s' doesn't match builder '%s'", buildConf.Path(), m.path), buildConf.Path(), errs)
+}
+
+// stagesUsing returns the stages a parameter is used by
+func (p *Parameter) stagesUsing(stages []string) []string {
+	if len(p.Stages) > 0 {
+		return p.Stages
+	}
+	return stages
+}
+
+// checkValue returns why a value doesn't match the type of a parameter, or
+// an empty string
+func (p *Parameter) checkValue(value interface{}) string {
+	switch p.Type {
+	case ParameterString:
+		switch value.(type) {
+		case string, int, float64:
+			return ""
+		}
+		return fmt.Sprintf("must be a string, got %s", describeValue(value))
+	case ParameterBool:
+		if _, ok := value.(bool); ok {
+			return ""
+		}
+		return fmt.Sprintf("must be a boolean, got %s", describeValue(value))
+	case ParameterList:
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Sprintf("must be a list, got %s", describeValue(value))
+		}
+		for _, item := range items {
+			switch item.(type) {
+			case string, int, float64:
+			default:
+				return fmt.Sprintf("must be a list of strings, got an item of type %s", describeValue(item))
+			}
+		}
+	case ParameterEnum:
+		if s, ok := value.(string); !ok || !utils.ItemExists(p.Values, s) {
+			return fmt.Sprintf("must be one of %s, got %s", strings.Join(p.Values, ", "), describeValue(value))
+		}
+	}
+	return ""
+}
+
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("'%s'", v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a map"
+	case nil:
+		return "nothing"
+	}
+	return fmt.Sprintf("'%v'", value)
+}
+
+// formatValidationErrors returns an error listing validation errors sorted
+// by line, or nil if there is none
+func formatValidationErrors(title, filepath string, errs []validationError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].line < errs[j].line
+	})
+	lines := []string{title + ":"}
+	for _, e := range errs {
+		if e.line > 0 {
+			lines = append(lines, fmt.Sprintf("  %s:%d: %s", filepath, e.line, e.msg))
+		} else {
+			lines = append(lines, fmt.Sprintf("  %s: %s", filepath, e.msg))
+		}
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
+
+func sortedParameterNames(parameters map[string]*Parameter) []string {
+	names := []string{}
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedSectionNames(specs map[string]map[string]interface{}) []string {
+	names := []string{}
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
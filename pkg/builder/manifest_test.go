@@ -0,0 +1,114 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	builderDef := NewDefinitionFromPath("manifest", "../../fixtures/manifest")
+	manifest, err := builderDef.Manifest()
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0", manifest.Version)
+	assert.Equal(t, []string{"base", "release"}, manifest.Stages)
+	assert.Equal(t, ParameterEnum, manifest.Parameters["osRelease"].Type)
+	assert.Equal(t, map[string]interface{}{"osRelease": "bullseye"}, manifest.Defaults())
+
+	withoutManifest, err := NewDefinitionFromPath("complex", "../../fixtures/complex").Manifest()
+	assert.NoError(t, err)
+	assert.Nil(t, withoutManifest)
+}
+
+func TestCheckValidityWithManifest(t *testing.T) {
+	builderDef := NewDefinitionFromPath("manifest", "../../fixtures/manifest")
+	buildConf := readBuildConfiguration(t, `builderName: manifest
+globalSpec:
+  osRelease: buster
+  runtimePackages:
+  - ca-certificates
+  contextExclude:
+  - log
+releaseSpec:
+  binary: app
+`)
+	assert.NoError(t, builderDef.CheckValidity(&buildConf))
+}
+
+func TestCheckValidityReportsAllErrors(t *testing.T) {
+	builderDef := NewDefinitionFromPath("manifest", "../../fixtures/manifest")
+	buildConf := readBuildConfiguration(t, `builderName: manifest
+globalSpec:
+  osRelease: stretch
+  runtimePackages: ca-certificates
+  debug: "yes"
+  passengerVersion: 6.0.22
+baseSpec:
+  binary: app
+testSpec:
+  debug: true
+`)
+
+	err := builderDef.CheckValidity(&buildConf)
+	assert.EqualError(t, err, `build configuration '`+buildConf.Path()+`' doesn't match builder '../../fixtures/manifest/builder.yaml':
+  `+buildConf.Path()+`: missing required parameter 'binary' for stage 'release'
+  `+buildConf.Path()+`:3: parameter 'osRelease' must be one of buster, bullseye, got 'stretch'
+  `+buildConf.Path()+`:4: parameter 'runtimePackages' must be a list, got 'ca-certificates'
+  `+buildConf.Path()+`:5: parameter 'debug' must be a boolean, got 'yes'
+  `+buildConf.Path()+`:6: unknown parameter 'passengerVersion' in 'globalSpec'
+  `+buildConf.Path()+`:8: parameter 'binary' is not used by stage 'base'
+  `+buildConf.Path()+`:9: 'testSpec' refers to an unknown stage 'test'`)
+}
+
+func TestCheckValidityWithInvalidManifest(t *testing.T) {
+	builderPath := path.Join(tempDir(t), "invalid")
+	assert.NoError(t, os.MkdirAll(path.Join(builderPath, "release"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(builderPath, "release/Dockerfile"), []byte("FROM debian"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(builderPath, ManifestName), []byte(`name: other
+stages: [release, test]
+parameters:
+  osRelease:
+    type: enum
+  debug:
+    type: boolean
+  binary:
+    type: string
+    default: [app]
+    stages: [build]
+`), 0644))
+
+	err := NewDefinitionFromPath("invalid", builderPath).CheckValidity(nil)
+	manifestPath := path.Join(builderPath, ManifestName)
+	assert.EqualError(t, err, `invalid builder manifest '`+manifestPath+`':
+  `+manifestPath+`:1: name 'other' doesn't match the builder 'invalid'
+  `+manifestPath+`:2: stage 'test' has no folder
+  `+manifestPath+`:5: parameter 'osRelease' is an enum without values
+  `+manifestPath+`:7: parameter 'debug' has an unknown type 'boolean', expected one of string, list, bool or enum
+  `+manifestPath+`:9: default value of parameter 'binary' must be a string, got a list
+  `+manifestPath+`:9: parameter 'binary' is used by an unknown stage 'build'`)
+}
+
+func readBuildConfiguration(t *testing.T, content string) config.BuildConfiguration {
+	filepath := path.Join(tempDir(t), "build.yaml")
+	if err := ioutil.WriteFile(filepath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildConf, err := config.ReadBuildConfiguration(filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildConf
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
@@ -0,0 +1,100 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// RenderedStage is what the build of a stage is made of: its rendered
+// Dockerfile and the files of its build context
+type RenderedStage struct {
+	Name         string   `json:"name" yaml:"name"`
+	ContentHash  string   `json:"contentHash" yaml:"contentHash"`
+	Platforms    []string `json:"platforms,omitempty" yaml:"platforms,omitempty"`
+	Dependencies []string `json:"dependencies" yaml:"dependencies"`
+	Dockerfile   string   `json:"dockerfile" yaml:"dockerfile"`
+	Dockerignore string   `json:"dockerignore" yaml:"dockerignore"`
+	ContextFiles []string `json:"contextFiles" yaml:"contextFiles"`
+}
+
+// RenderStages prepares a set of stages, and returns all the stages they
+// required to render, sorted by name
+func (b *Build) RenderStages(ctx context.Context, stageNames []string) ([]RenderedStage, error) {
+	stages, err := b.PrepareStages(ctx, stageNames)
+	if err != nil {
+		return nil, fmt.Errorf("error while preparing some stages: %w", err)
+	}
+
+	rendered := []RenderedStage{}
+	for _, stage := range stages {
+		files, err := stage.ContextFiles()
+		if err != nil {
+			return nil, err
+		}
+		deps := append([]string{}, stage.GetRequiredStages()...)
+		sort.Strings(deps)
+		rendered = append(rendered, RenderedStage{
+			Name:         stage.Name(),
+			ContentHash:  stage.ContentHash(),
+			Platforms:    stage.Platforms(),
+			Dependencies: deps,
+			Dockerfile:   stage.Dockerfile(),
+			Dockerignore: explicitDockerignore(files),
+			ContextFiles: files,
+		})
+	}
+	sort.Slice(rendered, func(i, j int) bool {
+		return rendered[i].Name < rendered[j].Name
+	})
+	return rendered, nil
+}
+
+// Save writes the Dockerfile, the .dockerignore, the list of context files
+// and the Content Hash of a stage in a folder named after the stage
+func (s RenderedStage) Save(dir string) error {
+	stageDir := path.Join(dir, s.Name)
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"Dockerfile":    s.Dockerfile,
+		".dockerignore": s.Dockerignore,
+		"context-files": strings.Join(append(append([]string{}, s.ContextFiles...), ""), "\n"),
+		"content-hash":  s.ContentHash + "\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(stageDir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explicitDockerignore returns a .dockerignore excluding everything but the
+// files of a build context
+func explicitDockerignore(files []string) string {
+	lines := []string{"*"}
+	for _, f := range files {
+		lines = append(lines, "!"+escapeDockerignorePattern(f))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// escapeDockerignorePattern escapes the characters with a special meaning in
+// a .dockerignore pattern
+func escapeDockerignorePattern(p string) string {
+	var sb strings.Builder
+	for _, c := range p {
+		if strings.ContainsRune(`*?[\`, c) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
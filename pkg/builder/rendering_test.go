@@ -0,0 +1,53 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/maxlaverse/image-builder/pkg/config"
+	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/maxlaverse/image-builder/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderStagesWithPlaceholders(t *testing.T) {
+	template.SetPlaceholders(true)
+	defer template.SetPlaceholders(false)
+
+	builderDef := NewDefinitionFromPath("render", "../../fixtures/render")
+	b := NewBuild(nil, executortest.New(), builderDef, config.BuildConfiguration{}, BuildOptions{DryRun: true}, "fake-target-image", "../../fixtures/folder-listing")
+	stages, err := b.RenderStages(context.Background(), []string{"release"})
+	if !assert.NoError(t, err) || !assert.Len(t, stages, 2) {
+		return
+	}
+
+	assert.Equal(t, "base", stages[0].Name)
+	assert.Equal(t, "FROM <ExternalImage:debian:bullseye-slim>\nRUN apt-get update && apt-get install -y curl\n", stages[0].Dockerfile)
+	assert.Equal(t, []string{}, stages[0].Dependencies)
+
+	assert.Equal(t, "release", stages[1].Name)
+	assert.Equal(t, "# ContextInclude some-file\nFROM fake-target-image:base-"+stages[0].ContentHash+"\nCOPY some-file /app/\n", stages[1].Dockerfile)
+	assert.Equal(t, []string{"base"}, stages[1].Dependencies)
+	assert.Equal(t, []string{"some-file"}, stages[1].ContextFiles)
+	assert.Equal(t, "*\n!some-file\n", stages[1].Dockerignore)
+
+	dir := tempDir(t)
+	assert.NoError(t, stages[1].Save(dir))
+	for name, expected := range map[string]string{
+		"Dockerfile":    stages[1].Dockerfile,
+		".dockerignore": "*\n!some-file\n",
+		"context-files": "some-file\n",
+		"content-hash":  stages[1].ContentHash + "\n",
+	} {
+		content, err := ioutil.ReadFile(path.Join(dir, "release", name))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content), name)
+	}
+}
+
+func TestExplicitDockerignore(t *testing.T) {
+	assert.Equal(t, "*\n", explicitDockerignore(nil))
+	assert.Equal(t, "*\n!app/main.go\n!docs/\\[draft]\\*.md\n", explicitDockerignore([]string{"app/main.go", "docs/[draft]*.md"}))
+}
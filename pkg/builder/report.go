@@ -0,0 +1,133 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// BuildReport is a machine readable summary of a build
+type BuildReport struct {
+	TargetImage string        `json:"targetImage"`
+	StartedAt   time.Time     `json:"startedAt"`
+	FinishedAt  time.Time     `json:"finishedAt"`
+	Succeeded   bool          `json:"succeeded"`
+	Error       string        `json:"error,omitempty"`
+	Stages      []StageReport `json:"stages"`
+}
+
+// StageReport is the summary of a stage in a BuildReport. The digest is the
+// one of the image found in the registry at the source image URL, or of the
+// image pushed after being built.
+type StageReport struct {
+	Name           string           `json:"name"`
+	ContentHash    string           `json:"contentHash"`
+	ImageURL       string           `json:"imageURL"`
+	SourceImageURL string           `json:"sourceImageURL"`
+	Status         StageImageStatus `json:"status"`
+	Digest         string           `json:"digest,omitempty"`
+	TagAliases     []string         `json:"tagAliases"`
+	ExtraTags      []string         `json:"extraTags"`
+	Dependencies   []string         `json:"dependencies"`
+	Durations      StageDurations   `json:"durations"`
+}
+
+// StageDurations is the time spent in each step of the processing of a stage.
+// Rendering excludes the time spent preparing the stages it references.
+type StageDurations struct {
+	Render time.Duration
+	Hash   time.Duration
+	Pull   time.Duration
+	Build  time.Duration
+	Push   time.Duration
+}
+
+// MarshalJSON writes the durations in seconds
+func (d StageDurations) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{
+		"render": d.Render.Seconds(),
+		"hash":   d.Hash.Seconds(),
+		"pull":   d.Pull.Seconds(),
+		"build":  d.Build.Seconds(),
+		"push":   d.Push.Seconds(),
+	})
+}
+
+// Report returns the summary of the stages prepared so far, sorted by name
+func (b *Build) Report() *BuildReport {
+	report := &BuildReport{
+		TargetImage: b.targetImage,
+		Stages:      []StageReport{},
+	}
+	for _, stage := range b.getBuildStages() {
+		report.Stages = append(report.Stages, StageReport{
+			Name:           stage.Name(),
+			ContentHash:    stage.ContentHash(),
+			ImageURL:       stage.ImageURL(),
+			SourceImageURL: stage.SourceImageURL(),
+			Status:         stage.Status(),
+			Digest:         stage.Digest(),
+			TagAliases:     append([]string{}, stage.GetTagAliases()...),
+			ExtraTags:      []string{},
+			Dependencies:   append([]string{}, stage.GetRequiredStages()...),
+			Durations:      b.stageDurations(stage.Name()),
+		})
+	}
+	sort.Slice(report.Stages, func(i, j int) bool {
+		return report.Stages[i].Name < report.Stages[j].Name
+	})
+	return report
+}
+
+// Save writes the report as JSON into a file
+func (r *BuildReport) Save(filepath string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, append(data, '\n'), 0644)
+}
+
+// Steps of the processing of a stage whose duration is recorded
+const (
+	stepRender = "render"
+	stepHash   = "hash"
+	stepPull   = "pull"
+	stepBuild  = "build"
+	stepPush   = "push"
+)
+
+// recordDuration adds the time spent in a step to the durations of a stage
+func (b *Build) recordDuration(stageName, step string, d time.Duration) {
+	b.durationsMux.Lock()
+	defer b.durationsMux.Unlock()
+	durations := b.durations[stageName]
+	switch step {
+	case stepRender:
+		durations.Render += d
+	case stepHash:
+		durations.Hash += d
+	case stepPull:
+		durations.Pull += d
+	case stepBuild:
+		durations.Build += d
+	case stepPush:
+		durations.Push += d
+	}
+	b.durations[stageName] = durations
+}
+
+// timeStep starts timing a step and returns a function recording its duration
+func (b *Build) timeStep(stageName, step string) func() {
+	start := time.Now()
+	return func() {
+		b.recordDuration(stageName, step, time.Since(start))
+	}
+}
+
+func (b *Build) stageDurations(stageName string) StageDurations {
+	b.durationsMux.Lock()
+	defer b.durationsMux.Unlock()
+	return b.durations[stageName]
+}
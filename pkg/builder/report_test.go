@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/maxlaverse/image-builder/pkg/config"
+	enginetest "github.com/maxlaverse/image-builder/pkg/engine/test"
+	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReport(t *testing.T) {
+	fakeEngine := enginetest.NewWithCallbacks(func(ctx context.Context, image string) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	fakeExecutor := executortest.New()
+	builderDef := NewDefinitionFromPath("concurrency", "../../fixtures/concurrency")
+	b := NewBuild(fakeEngine, fakeExecutor, builderDef, config.BuildConfiguration{}, BuildOptions{BuildConcurrency: 2}, "fake-target-image", "../../fixtures/empty")
+
+	_, err := b.BuildStages(context.Background(), []string{"final"})
+	assert.NoError(t, err)
+
+	report := b.Report()
+	assert.Equal(t, "fake-target-image", report.TargetImage)
+	if !assert.Len(t, report.Stages, 5) {
+		t.FailNow()
+	}
+
+	final := report.Stages[0]
+	assert.Equal(t, "final", final.Name)
+	assert.Equal(t, "v2-4939e1782415676ee12ab7cedd1f6b4f9da732478198ef75aed81076fa1efecf", final.ContentHash)
+	assert.Equal(t, "fake-target-image:final-v2-4939e1782415676ee12ab7cedd1f6b4f9da732478198ef75aed81076fa1efecf", final.ImageURL)
+	assert.Equal(t, ImageBuilt, final.Status)
+	assert.ElementsMatch(t, []string{"parallel-1-2", "parallel-2-2"}, final.Dependencies)
+	assert.Empty(t, final.Digest)
+	assert.True(t, final.Durations.Build >= time.Millisecond)
+	assert.Zero(t, final.Durations.Pull)
+	assert.Zero(t, final.Durations.Push)
+}
+
+func TestStageDurationsMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(StageDurations{Render: 10 * time.Millisecond, Build: 2 * time.Second})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"render":0.01,"hash":0,"pull":0,"build":2,"push":0}`, string(data))
+}
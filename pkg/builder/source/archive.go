@@ -0,0 +1,140 @@
+package source
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/maxlaverse/image-builder/pkg/utils"
+)
+
+// cachedDigestFile is the file holding the digest of the archive a builder
+// location last resolved to. The archive itself is extracted in a folder
+// named after its digest, next to this file.
+const cachedDigestFile = "digest"
+
+// extractTar extracts a tarball. Entries that would be written outside of
+// the destination are rejected.
+func extractTar(r io.Reader, dstPath string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeXGlobalHeader:
+			// Written by 'git archive', and holding no file
+		case tar.TypeDir:
+			target, err := archiveEntryPath(dstPath, header.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			target, err := archiveEntryPath(dstPath, header.Name)
+			if err != nil {
+				return err
+			}
+			if err := writeArchiveEntry(target, tr, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported type of file '%s' in archive", header.Name)
+		}
+	}
+}
+
+// extractZip extracts a zip archive. Entries that would be written outside
+// of the destination are rejected.
+func extractZip(archivePath, dstPath string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		target, err := archiveEntryPath(dstPath, f.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = writeArchiveEntry(target, rc, mode)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported type of file '%s' in archive", f.Name)
+		}
+	}
+	return nil
+}
+
+// archiveEntryPath returns where an entry of an archive is extracted, or an
+// error if it would be outside of the destination
+func archiveEntryPath(dstPath, name string) (string, error) {
+	relFilePath := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(relFilePath) || relFilePath == ".." || strings.HasPrefix(relFilePath, "../") {
+		return "", fmt.Errorf("invalid file '%s' in archive", name)
+	}
+	return filepath.Join(dstPath, filepath.FromSlash(relFilePath)), nil
+}
+
+func writeArchiveEntry(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readCachedDigest(cachePath string) (v1.Hash, error) {
+	data, err := ioutil.ReadFile(path.Join(cachePath, cachedDigestFile))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	digest, err := v1.NewHash(strings.TrimSpace(string(data)))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if !utils.PathExists(path.Join(cachePath, digest.Hex)) {
+		return v1.Hash{}, fmt.Errorf("archive '%s' is missing from the cache", digest)
+	}
+	return digest, nil
+}
+
+func writeCachedDigest(cachePath string, digest v1.Hash) error {
+	return ioutil.WriteFile(path.Join(cachePath, cachedDigestFile), []byte(digest.String()+"\n"), 0644)
+}
@@ -1,58 +1,107 @@
 package source
 
 import (
+	"bytes"
 	"crypto/md5"
 	"fmt"
 	"path"
+	"regexp"
 	"strings"
 
 	"github.com/maxlaverse/image-builder/pkg/executor"
 	"github.com/maxlaverse/image-builder/pkg/utils"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	defaultBranch = "master"
 )
 
+var (
+	commitPattern         = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+	commitLocationPattern = regexp.MustCompile(`^(.+)@([0-9a-fA-F]{7,40})(?::(.*))?$`)
+)
+
 // IsSourceGit returns wether a location is a Git repository or not
 func IsSourceGit(location string) bool {
-	return strings.Contains(location, "http") || strings.Contains(location, "git@")
+	l, err := ParseBuilderLocation(location)
+	return err == nil && l.Kind == LocationGit
 }
 
-// FromGit cache a builder definition hosted in a Git repository
-// Format is ssh://git@github.com:maxlaverse/image-builder-collection.git[#branch:[subfolder]]
-func FromGit(name, location, cacheRoot string) (string, error) {
-	locationParts := strings.Split(location, "#")
-	repository := locationParts[0]
-	branch := defaultBranch
-	subdirectory := ""
-	if len(locationParts) > 1 {
-		otherParts := strings.Split(locationParts[1], ":")
-		branch = otherParts[0]
-		if len(otherParts) > 1 {
-			subdirectory = otherParts[1]
+// FromGit cache a builder definition hosted in a Git repository. The repository is checked out at
+// the commit recorded in the lockfile if any, and the resolved commit is
+// recorded otherwise. When offline, the repository is never fetched and
+// references are resolved from the last fetch.
+func FromGit(name string, location BuilderLocation, cacheRoot string, lock *Lockfile, offline bool) (string, error) {
+	cachePath := path.Join(cacheRoot, locationFingerprint(location.String()))
+	commit := lock.Commit(location.String())
+	switch {
+	case offline && !utils.PathExists(cachePath):
+		return "", fmt.Errorf("builder location '%s' is not available offline, as it was never fetched", location)
+	case offline && len(commit) > 0 && !hasCommit(cachePath, commit):
+		return "", fmt.Errorf("builder location '%s' is locked at commit '%s', which is not available offline as it was never fetched", location, commit)
+	case offline:
+		log.Debugf("Using the cached checkout of builder location '%s'", location)
+	case !utils.PathExists(cachePath):
+		err := executor.New().NewCommand("git", "clone", location.Repository, cachePath).WithConsoleOutput().Run()
+		if err != nil {
+			return "", err
 		}
-	}
-
-	cachePath := path.Join(cacheRoot, locationFingerprint(location))
-	if utils.PathExists(cachePath) {
-		err := executor.New().NewCommand("git", "fetch", "--all").WithDir(cachePath).WithConsoleOutput().Run()
+	case len(commit) > 0 && hasCommit(cachePath, commit):
+		log.Debugf("Builder location '%s' is locked at commit '%s'", location, commit)
+	default:
+		err := executor.New().NewCommand("git", "fetch", "--all", "--tags", "--force").WithDir(cachePath).WithConsoleOutput().Run()
 		if err != nil {
 			return "", err
 		}
-	} else {
-		err := executor.New().NewCommand("git", "clone", repository, cachePath).WithConsoleOutput().Run()
+	}
+
+	if len(commit) == 0 {
+		var err error
+		commit, err = resolveRef(cachePath, location.Ref)
 		if err != nil {
 			return "", err
 		}
+		lock.SetCommit(location.String(), commit)
 	}
 
-	err := executor.New().NewCommand("git", "reset", "--hard", fmt.Sprintf("origin/%s", branch)).WithDir(cachePath).WithConsoleOutput().Run()
+	err := executor.New().NewCommand("git", "reset", "--hard", commit).WithDir(cachePath).WithConsoleOutput().Run()
 	if err != nil {
 		return "", err
 	}
 
-	return path.Join(cachePath, subdirectory, name), nil
+	return path.Join(cachePath, location.Subdirectory, name), nil
+}
+
+// resolveRef returns the commit a branch, a tag or an abbreviated commit
+// points to
+func resolveRef(repoPath, ref string) (string, error) {
+	candidates := []string{"refs/remotes/origin/" + ref, "refs/tags/" + ref}
+	if commitPattern.MatchString(ref) {
+		candidates = append(candidates, ref)
+	}
+	for _, candidate := range candidates {
+		commit, err := revParse(repoPath, candidate)
+		if err == nil {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("no branch, tag or commit named '%s' was found in the builder repository", ref)
+}
+
+// hasCommit returns if a commit is present in a local repository
+func hasCommit(repoPath, commit string) bool {
+	_, err := revParse(repoPath, commit)
+	return err == nil
+}
+
+func revParse(repoPath, rev string) (string, error) {
+	var out bytes.Buffer
+	err := executor.New().NewCommand("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}").WithDir(repoPath).WithCombinedOutput(&out).Run()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
 }
 
 func locationFingerprint(location string) string {
@@ -1,6 +1,11 @@
 package source
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -30,3 +35,112 @@ func TestNonGitSource(t *testing.T) {
 	isOfType := IsSourceGit("/etc/motd")
 	assert.False(t, isOfType)
 }
+
+func TestFromGitWithLockfile(t *testing.T) {
+	repo := tempDir(t)
+	git(t, repo, "init", "-q", "-b", "master")
+	commitFile(t, repo, "ruby/base/Dockerfile", "FROM ruby:2.7")
+	git(t, repo, "tag", "v1")
+	first := git(t, repo, "rev-parse", "HEAD")
+	commitFile(t, repo, "ruby/base/Dockerfile", "FROM ruby:3.0")
+	second := git(t, repo, "rev-parse", "HEAD")
+
+	location := "git+file://" + repo
+	cacheRoot := tempDir(t)
+	lock, err := ReadLockfile(path.Join(tempDir(t), LockfileName))
+	assert.NoError(t, err)
+
+	// Tags and commits are resolved and recorded
+	_, err = FromGit("ruby", parseLocation(t, location+"#v1"), cacheRoot, lock, false)
+	assert.NoError(t, err)
+	assert.Equal(t, first, lock.Commit(location+"#v1"))
+
+	_, err = FromGit("ruby", parseLocation(t, location+"@"+second[:7]), cacheRoot, lock, false)
+	assert.NoError(t, err)
+	assert.Equal(t, second, lock.Commit(location+"@"+second[:7]))
+
+	// Branches are checked out at the locked commit
+	lock.SetCommit(location, first)
+	localPath, err := FromGit("ruby", parseLocation(t, location), cacheRoot, lock, false)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby:2.7")
+
+	lock.Unlock(location)
+	localPath, err = FromGit("ruby", parseLocation(t, location), cacheRoot, lock, false)
+	assert.NoError(t, err)
+	assert.Equal(t, second, lock.Commit(location))
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby:3.0")
+
+	_, err = FromGit("ruby", parseLocation(t, location+"#unknown"), cacheRoot, lock, false)
+	assert.EqualError(t, err, "no branch, tag or commit named 'unknown' was found in the builder repository")
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func commitFile(t *testing.T, repo, name, content string) {
+	if err := os.MkdirAll(path.Dir(path.Join(repo, name)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(repo, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo, "add", "-A")
+	git(t, repo, "commit", "-q", "-m", "Update "+name)
+}
+
+func assertFileContent(t *testing.T, filepath, expected string) {
+	data, err := ioutil.ReadFile(filepath)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+}
+
+func parseLocation(t *testing.T, location string) BuilderLocation {
+	l, err := ParseBuilderLocation(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestFromGitOffline(t *testing.T) {
+	repo := tempDir(t)
+	git(t, repo, "init", "-q", "-b", "master")
+	commitFile(t, repo, "ruby/base/Dockerfile", "FROM ruby:2.7")
+	location := "git+file://" + repo
+	cacheRoot := tempDir(t)
+
+	_, err := FromGit("ruby", parseLocation(t, location), cacheRoot, nil, true)
+	assert.EqualError(t, err, "builder location '"+location+"' is not available offline, as it was never fetched")
+
+	_, err = FromGit("ruby", parseLocation(t, location), cacheRoot, nil, false)
+	assert.NoError(t, err)
+
+	// The cached checkout is used without reaching the repository
+	assert.NoError(t, os.RemoveAll(repo))
+	localPath, err := FromGit("ruby", parseLocation(t, location), cacheRoot, nil, true)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby:2.7")
+
+	lock, err := ReadLockfile(path.Join(tempDir(t), LockfileName))
+	assert.NoError(t, err)
+	lock.SetCommit(location, "0123456789abcdef0123456789abcdef01234567")
+	_, err = FromGit("ruby", parseLocation(t, location), cacheRoot, lock, true)
+	assert.EqualError(t, err, "builder location '"+location+"' is locked at commit '0123456789abcdef0123456789abcdef01234567', which is not available offline as it was never fetched")
+}
@@ -0,0 +1,210 @@
+package source
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const checksumPrefix = "sha256="
+
+var checksumPattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// LocationKind is the type of storage a builder location points to
+type LocationKind string
+
+const (
+	// LocationFilesystem is a directory on the local filesystem
+	LocationFilesystem LocationKind = "filesystem"
+
+	// LocationGit is a Git repository
+	LocationGit LocationKind = "git"
+
+	// LocationTarball is a tarball or a zip archive downloaded over HTTP
+	LocationTarball LocationKind = "tarball"
+
+	// LocationOCI is an artifact stored in an image registry
+	LocationOCI LocationKind = "oci"
+)
+
+// BuilderLocation is a parsed builder location. The supported formats are:
+//   - file:///path/to/builders, or a path without scheme
+//   - git+https://host/repo.git[#ref[:subfolder]], ref being a branch, a tag
+//     or a commit
+//   - git+ssh://git@host/repo.git[#ref[:subfolder]], or git+file:// for a
+//     repository on the local filesystem
+//   - https://host/builders.tar.gz[#[sha256=checksum:]subfolder], or a .tgz or
+//     .zip archive
+//   - oci://registry/repository:tag[#subfolder]
+//
+// Git repositories can also be given without scheme, as long as they start
+// with 'http://', 'https://', 'ssh://', 'git://' or 'git@', and a commit can
+// be given after a '@' instead of a '#'.
+type BuilderLocation struct {
+	Kind LocationKind
+
+	// Path is the directory of a filesystem location
+	Path string
+
+	// Repository is the URL of a Git repository or of a tarball, or the
+	// reference of an OCI artifact
+	Repository string
+
+	// Ref is the branch, tag or commit of a Git repository
+	Ref string
+
+	// Subdirectory is the folder holding the builders in a Git repository, a
+	// tarball or an OCI artifact
+	Subdirectory string
+
+	// Checksum is the expected sha256 checksum of a tarball, if any
+	Checksum string
+
+	raw string
+}
+
+// ParseBuilderLocation parses a builder location
+func ParseBuilderLocation(location string) (BuilderLocation, error) {
+	if len(location) == 0 {
+		return BuilderLocation{}, fmt.Errorf("builder location is empty")
+	}
+
+	scheme := ""
+	if i := strings.Index(location, "://"); i > 0 {
+		scheme = location[:i]
+	}
+
+	var l BuilderLocation
+	var err error
+	switch {
+	case scheme == "file":
+		l, err = parseFilesystemLocation(location, strings.TrimPrefix(location, "file://"))
+	case scheme == "git+https" || scheme == "git+http" || scheme == "git+ssh" || scheme == "git+file":
+		l, err = parseGitLocation(location, strings.TrimPrefix(location, "git+"))
+	case scheme == "oci":
+		l, err = parseOCILocation(location)
+	case (scheme == "https" || scheme == "http") && isArchive(location):
+		l, err = parseTarballLocation(location)
+	case scheme == "http" || scheme == "https" || scheme == "ssh" || scheme == "git" || strings.HasPrefix(location, "git@"):
+		l, err = parseGitLocation(location, location)
+	case len(scheme) > 0:
+		err = fmt.Errorf("invalid builder location '%s': unsupported scheme '%s'", location, scheme)
+	default:
+		l, err = parseFilesystemLocation(location, location)
+	}
+	if err != nil {
+		return BuilderLocation{}, err
+	}
+	l.raw = location
+	return l, nil
+}
+
+// String returns the location as it was given
+func (l BuilderLocation) String() string {
+	return l.raw
+}
+
+func parseFilesystemLocation(location, p string) (BuilderLocation, error) {
+	if len(p) == 0 {
+		return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': missing path", location)
+	}
+	return BuilderLocation{Kind: LocationFilesystem, Path: p}, nil
+}
+
+// parseGitLocation splits a Git location into its repository, reference and
+// subdirectory. The reference is a branch, a tag or a commit given after a
+// '#', or a commit given after a '@'.
+func parseGitLocation(location, repository string) (BuilderLocation, error) {
+	l := BuilderLocation{Kind: LocationGit, Ref: defaultBranch}
+	if i := strings.Index(repository, "#"); i >= 0 {
+		fragment := repository[i+1:]
+		repository = repository[:i]
+		ref, subdirectory, hasSubdirectory := cut(fragment, ":")
+		if len(ref) == 0 {
+			return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': missing Git reference after '#'", location)
+		}
+		if hasSubdirectory && len(subdirectory) == 0 {
+			return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': missing subfolder after ':'", location)
+		}
+		l.Ref = ref
+		l.Subdirectory = subdirectory
+	} else if m := commitLocationPattern.FindStringSubmatch(repository); m != nil {
+		repository = m[1]
+		l.Ref = m[2]
+		l.Subdirectory = m[3]
+	}
+
+	if strings.HasPrefix(repository, "http://") || strings.HasPrefix(repository, "https://") {
+		u, err := url.Parse(repository)
+		if err != nil {
+			return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': invalid repository URL: %w", location, err)
+		}
+		if len(u.Host) == 0 || len(strings.Trim(u.Path, "/")) == 0 {
+			return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': repository URL '%s' has no host or path", location, repository)
+		}
+	} else if _, rest, hasScheme := cut(repository, "://"); len(repository) == 0 || hasScheme && len(rest) == 0 {
+		return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': missing repository", location)
+	}
+	l.Repository = repository
+	return l, nil
+}
+
+// parseTarballLocation splits a tarball location into its URL, checksum and
+// subdirectory
+func parseTarballLocation(location string) (BuilderLocation, error) {
+	tarball, fragment, _ := cut(location, "#")
+	checksum := ""
+	subdirectory := fragment
+	if strings.HasPrefix(fragment, checksumPrefix) {
+		checksum, subdirectory, _ = cut(strings.TrimPrefix(fragment, checksumPrefix), ":")
+		if !checksumPattern.MatchString(checksum) {
+			return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': invalid checksum '%s', expected 64 hexadecimal characters", location, checksum)
+		}
+		checksum = strings.ToLower(checksum)
+	}
+
+	u, err := url.Parse(tarball)
+	if err != nil {
+		return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': invalid tarball URL: %w", location, err)
+	}
+	if len(u.Host) == 0 {
+		return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': tarball URL has no host", location)
+	}
+	return BuilderLocation{Kind: LocationTarball, Repository: tarball, Subdirectory: subdirectory, Checksum: checksum}, nil
+}
+
+func parseOCILocation(location string) (BuilderLocation, error) {
+	reference, subdirectory, _ := cut(strings.TrimPrefix(location, "oci://"), "#")
+	if _, err := name.ParseReference(reference, name.StrictValidation); err != nil {
+		return BuilderLocation{}, fmt.Errorf("invalid builder location '%s': invalid artifact reference: %w", location, err)
+	}
+	return BuilderLocation{Kind: LocationOCI, Repository: reference, Subdirectory: subdirectory}, nil
+}
+
+// isArchive returns if an URL points to a tarball or a zip archive
+func isArchive(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	return isTarball(u.Path) || isZip(u.Path)
+}
+
+func isTarball(p string) bool {
+	return strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")
+}
+
+func isZip(p string) bool {
+	return strings.HasSuffix(p, ".zip")
+}
+
+// cut slices s around the first instance of sep
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,66 @@
+package source
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := map[string]BuilderLocation{
+		"/home/http-builders":           {Kind: LocationFilesystem, Path: "/home/http-builders"},
+		"../builders":                   {Kind: LocationFilesystem, Path: "../builders"},
+		"file:///home/builders":         {Kind: LocationFilesystem, Path: "/home/builders"},
+		"/srv/git@host/builders#latest": {Kind: LocationFilesystem, Path: "/srv/git@host/builders#latest"},
+
+		"git+https://github.com/maxlaverse/image-builder.git":                 {Kind: LocationGit, Repository: "https://github.com/maxlaverse/image-builder.git", Ref: "master"},
+		"git+https://github.com/maxlaverse/image-builder.git#v1.4.0:builders": {Kind: LocationGit, Repository: "https://github.com/maxlaverse/image-builder.git", Ref: "v1.4.0", Subdirectory: "builders"},
+		"git+ssh://git@github.com/maxlaverse/image-builder.git#main":          {Kind: LocationGit, Repository: "ssh://git@github.com/maxlaverse/image-builder.git", Ref: "main"},
+		"git+file:///srv/builders.git#4f2c1a9:ruby":                           {Kind: LocationGit, Repository: "file:///srv/builders.git", Ref: "4f2c1a9", Subdirectory: "ruby"},
+
+		"https://github.com/maxlaverse/image-builder.git":                   {Kind: LocationGit, Repository: "https://github.com/maxlaverse/image-builder.git", Ref: "master"},
+		"https://github.com/maxlaverse/image-builder.git#4f2c1a9:builders":  {Kind: LocationGit, Repository: "https://github.com/maxlaverse/image-builder.git", Ref: "4f2c1a9", Subdirectory: "builders"},
+		"ssh://git@github.com:maxlaverse/image-builder.git#master:builders": {Kind: LocationGit, Repository: "ssh://git@github.com:maxlaverse/image-builder.git", Ref: "master", Subdirectory: "builders"},
+		"git@github.com:maxlaverse/image-builder.git#main":                  {Kind: LocationGit, Repository: "git@github.com:maxlaverse/image-builder.git", Ref: "main"},
+		"git@github.com:maxlaverse/image-builder.git@4f2c1a9":               {Kind: LocationGit, Repository: "git@github.com:maxlaverse/image-builder.git", Ref: "4f2c1a9"},
+		"git@github.com:maxlaverse/image-builder.git@4f2c1a9:builders":      {Kind: LocationGit, Repository: "git@github.com:maxlaverse/image-builder.git", Ref: "4f2c1a9", Subdirectory: "builders"},
+
+		"https://example.com/builders.tar.gz":       {Kind: LocationTarball, Repository: "https://example.com/builders.tar.gz"},
+		"https://example.com/builders.tgz?v=2#ruby": {Kind: LocationTarball, Repository: "https://example.com/builders.tgz?v=2", Subdirectory: "ruby"},
+		"https://example.com/builders.zip#sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef":         {Kind: LocationTarball, Repository: "https://example.com/builders.zip", Checksum: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		"https://example.com/builders.tar.gz#sha256=0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF:ruby": {Kind: LocationTarball, Repository: "https://example.com/builders.tar.gz", Subdirectory: "ruby", Checksum: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		"oci://registry.example.com/builders:v1":      {Kind: LocationOCI, Repository: "registry.example.com/builders:v1"},
+		"oci://registry.example.com/builders:v1#ruby": {Kind: LocationOCI, Repository: "registry.example.com/builders:v1", Subdirectory: "ruby"},
+	}
+	for location, expected := range tests {
+		t.Run(location, func(t *testing.T) {
+			l, err := ParseBuilderLocation(location)
+			assert.NoError(t, err)
+			expected.raw = location
+			assert.Equal(t, expected, l)
+			assert.Equal(t, location, l.String())
+		})
+	}
+}
+
+func TestParseLocationErrors(t *testing.T) {
+	tests := map[string]string{
+		"":                  "builder location is empty",
+		"file://":           "invalid builder location 'file://': missing path",
+		"s3://bucket/path":  "invalid builder location 's3://bucket/path': unsupported scheme 's3'",
+		"git+ssh://":        "invalid builder location 'git+ssh://': missing repository",
+		"git+https://host/": "invalid builder location 'git+https://host/': repository URL 'https://host/' has no host or path",
+		"https://github.com/maxlaverse/image-builder.git#":          "invalid builder location 'https://github.com/maxlaverse/image-builder.git#': missing Git reference after '#'",
+		"https://github.com/maxlaverse/image-builder.git#:builders": "invalid builder location 'https://github.com/maxlaverse/image-builder.git#:builders': missing Git reference after '#'",
+		"https://github.com/maxlaverse/image-builder.git#main:":     "invalid builder location 'https://github.com/maxlaverse/image-builder.git#main:': missing subfolder after ':'",
+		"https:///builders.tar.gz":                                  "invalid builder location 'https:///builders.tar.gz': tarball URL has no host",
+		"https://example.com/builders.zip#sha256=abc:ruby":          "invalid builder location 'https://example.com/builders.zip#sha256=abc:ruby': invalid checksum 'abc', expected 64 hexadecimal characters",
+		"oci://registry.example.com/Builders:v1":                    "invalid builder location 'oci://registry.example.com/Builders:v1': invalid artifact reference: could not parse reference: registry.example.com/Builders:v1",
+	}
+	for location, expected := range tests {
+		t.Run(location, func(t *testing.T) {
+			_, err := ParseBuilderLocation(location)
+			assert.EqualError(t, err, expected)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package source
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockfileName is the name of the lockfile of the default Build
+// Configuration, written next to it
+const LockfileName = "image-builder.lock"
+
+// defaultBuildConfigurationName is the name of the Build Configuration whose
+// lockfile is named LockfileName
+const defaultBuildConfigurationName = "build.yaml"
+
+const lockfileHeader = "# This file is generated by image-builder. Run 'image-builder builder update' to update it.\n"
+
+// Lockfile records the commit each Git builder location resolved to, so that
+// builds keep using the same version of the builders until they are
+// explicitly updated
+type Lockfile struct {
+	path     string
+	builders map[string]string
+	changed  bool
+}
+
+type lockfileContent struct {
+	Builders []lockedBuilder `yaml:"builders"`
+}
+
+type lockedBuilder struct {
+	Location string `yaml:"location"`
+	Commit   string `yaml:"commit"`
+}
+
+// LockfilePath returns the path of the lockfile of a Build Configuration.
+// Each Build Configuration has its own lockfile, so that the ones sharing a
+// folder don't drop the locations locked by each other.
+func LockfilePath(buildConfPath string) string {
+	name := filepath.Base(buildConfPath)
+	if name == defaultBuildConfigurationName {
+		return filepath.Join(filepath.Dir(buildConfPath), LockfileName)
+	}
+	return filepath.Join(filepath.Dir(buildConfPath), strings.TrimSuffix(name, filepath.Ext(name))+"."+LockfileName)
+}
+
+// ReadLockfile reads a lockfile. A missing file is considered empty.
+func ReadLockfile(filepath string) (*Lockfile, error) {
+	l := &Lockfile{path: filepath, builders: map[string]string{}}
+	data, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	content := lockfileContent{}
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("error parsing lockfile '%s': %w", filepath, err)
+	}
+	for _, b := range content.Builders {
+		l.builders[b.Location] = b.Commit
+	}
+	return l, nil
+}
+
+// Commit returns the commit a location is locked at, or an empty string
+func (l *Lockfile) Commit(location string) string {
+	if l == nil {
+		return ""
+	}
+	return l.builders[location]
+}
+
+// Commits returns the commit each location is locked at
+func (l *Lockfile) Commits() map[string]string {
+	commits := map[string]string{}
+	if l == nil {
+		return commits
+	}
+	for location, commit := range l.builders {
+		commits[location] = commit
+	}
+	return commits
+}
+
+// SetCommit locks a location at a commit
+func (l *Lockfile) SetCommit(location, commit string) {
+	if l == nil || l.builders[location] == commit {
+		return
+	}
+	l.builders[location] = commit
+	l.changed = true
+}
+
+// Unlock removes the commit recorded for a location, for it to be resolved
+// again
+func (l *Lockfile) Unlock(location string) {
+	if l == nil {
+		return
+	}
+	if _, ok := l.builders[location]; ok {
+		delete(l.builders, location)
+		l.changed = true
+	}
+}
+
+// Retain removes the locations that are not in the given list
+func (l *Lockfile) Retain(locations ...string) {
+	if l == nil {
+		return
+	}
+	kept := map[string]string{}
+	for _, location := range locations {
+		if commit, ok := l.builders[location]; ok {
+			kept[location] = commit
+		}
+	}
+	if len(kept) != len(l.builders) {
+		l.builders = kept
+		l.changed = true
+	}
+}
+
+// Changed returns if the lockfile has to be saved
+func (l *Lockfile) Changed() bool {
+	return l != nil && l.changed
+}
+
+// Save writes the lockfile
+func (l *Lockfile) Save() error {
+	if l == nil {
+		return nil
+	}
+	content := lockfileContent{Builders: []lockedBuilder{}}
+	for location, commit := range l.builders {
+		content.Builders = append(content.Builders, lockedBuilder{Location: location, Commit: commit})
+	}
+	sort.Slice(content.Builders, func(i, j int) bool {
+		return content.Builders[i].Location < content.Builders[j].Location
+	})
+
+	data, err := yaml.Marshal(&content)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(l.path, append([]byte(lockfileHeader), data...), 0644); err != nil {
+		return err
+	}
+	l.changed = false
+	return nil
+}
@@ -0,0 +1,47 @@
+package source
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockfileSaveAndRead(t *testing.T) {
+	filepath := path.Join(tempDir(t), LockfileName)
+	lock, err := ReadLockfile(filepath)
+	assert.NoError(t, err)
+	assert.False(t, lock.Changed())
+
+	lock.SetCommit("git@github.com:maxlaverse/builders.git#v1:builders", "4f2c1a9e")
+	lock.SetCommit("git@github.com:maxlaverse/other.git", "9b1d2e3f")
+	lock.Retain("git@github.com:maxlaverse/builders.git#v1:builders")
+	assert.True(t, lock.Changed())
+	assert.NoError(t, lock.Save())
+	assert.False(t, lock.Changed())
+
+	data, err := ioutil.ReadFile(filepath)
+	assert.NoError(t, err)
+	assert.Equal(t, lockfileHeader+"builders:\n    - location: git@github.com:maxlaverse/builders.git#v1:builders\n      commit: 4f2c1a9e\n", string(data))
+
+	reloaded, err := ReadLockfile(filepath)
+	assert.NoError(t, err)
+	assert.Equal(t, "4f2c1a9e", reloaded.Commit("git@github.com:maxlaverse/builders.git#v1:builders"))
+	assert.Empty(t, reloaded.Commit("git@github.com:maxlaverse/other.git"))
+}
+
+func TestLockfilePath(t *testing.T) {
+	assert.Equal(t, "image-builder.lock", LockfilePath("build.yaml"))
+	assert.Equal(t, "app/image-builder.lock", LockfilePath("app/build.yaml"))
+	assert.Equal(t, "app/build-worker.image-builder.lock", LockfilePath("app/build-worker.yaml"))
+	assert.Equal(t, "app/image-builder.image-builder.lock", LockfilePath("app/image-builder.yaml"))
+}
+
+func TestNilLockfile(t *testing.T) {
+	var lock *Lockfile
+	lock.SetCommit("git@github.com:maxlaverse/builders.git", "4f2c1a9e")
+	assert.Empty(t, lock.Commit("git@github.com:maxlaverse/builders.git"))
+	assert.False(t, lock.Changed())
+	assert.NoError(t, lock.Save())
+}
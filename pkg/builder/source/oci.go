@@ -0,0 +1,232 @@
+package source
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/maxlaverse/image-builder/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BuilderConfigMediaType is the media type of the config of a builder
+	// artifact
+	BuilderConfigMediaType types.MediaType = "application/vnd.maxlaverse.image-builder.builder.config.v1+json"
+
+	// BuilderLayerMediaType is the media type of the layer holding the files
+	// of a builder artifact
+	BuilderLayerMediaType types.MediaType = "application/vnd.maxlaverse.image-builder.builder.layer.v1.tar+gzip"
+)
+
+// PushOCI packages a builder definition as an OCI artifact and pushes it to
+// an image registry. The files of the builder are stored in a folder named
+// after the builder, for the artifact to be used like a Git repository
+// holding builders. It returns the digest of the artifact.
+func PushOCI(name, builderPath, reference string) (string, error) {
+	ref, err := parseArtifactReference(reference)
+	if err != nil {
+		return "", err
+	}
+
+	archive, err := archiveBuilder(name, builderPath)
+	if err != nil {
+		return "", fmt.Errorf("error packaging builder '%s': %w", builderPath, err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	}, tarball.WithMediaType(BuilderLayerMediaType))
+	if err != nil {
+		return "", err
+	}
+
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return "", err
+	}
+	img = mutate.MediaType(img, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, BuilderConfigMediaType)
+
+	if err := remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return "", fmt.Errorf("error pushing builder to '%s': %w", reference, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// FromOCI cache a builder definition stored as an OCI artifact. The artifact
+// is pulled by digest, verified and extracted once, and its last resolved
+// digest is reused when offline.
+func FromOCI(name string, location BuilderLocation, cacheRoot string, offline bool) (string, error) {
+	cachePath := path.Join(cacheRoot, locationFingerprint(location.String()))
+
+	var digest v1.Hash
+	var err error
+	if offline {
+		digest, err = readCachedDigest(cachePath)
+		if err != nil {
+			return "", fmt.Errorf("builder location '%s' is not available offline, as it was never pulled", location)
+		}
+		log.Debugf("Using the cached artifact of builder location '%s'", location)
+	} else {
+		digest, err = pullOCI(location, cachePath)
+		if err != nil {
+			return "", fmt.Errorf("error pulling builder location '%s': %w", location, err)
+		}
+	}
+
+	return path.Join(cachePath, digest.Hex, location.Subdirectory, name), nil
+}
+
+// pullOCI resolves the digest of an artifact and extracts it into the cache,
+// unless it was already extracted
+func pullOCI(location BuilderLocation, cachePath string) (v1.Hash, error) {
+	ref, err := parseArtifactReference(location.Repository)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if d, ok := ref.(name.Digest); ok && d.DigestStr() != desc.Digest.String() {
+		return v1.Hash{}, fmt.Errorf("expected digest '%s' but the registry returned '%s'", d.DigestStr(), desc.Digest)
+	}
+
+	artifactPath := path.Join(cachePath, desc.Digest.Hex)
+	if utils.PathExists(artifactPath) {
+		log.Debugf("Builder location '%s' is already cached at digest '%s'", location, desc.Digest)
+		return desc.Digest, writeCachedDigest(cachePath, desc.Digest)
+	}
+
+	log.Infof("Pulling builder location '%s'", location)
+	img, err := desc.Image()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if digest != desc.Digest {
+		return v1.Hash{}, fmt.Errorf("expected digest '%s' but the manifest has digest '%s'", desc.Digest, digest)
+	}
+	layer, err := builderLayer(img)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	if err := os.MkdirAll(cachePath, 0755); err != nil {
+		return v1.Hash{}, err
+	}
+	tmpPath, err := ioutil.TempDir(cachePath, desc.Digest.Hex+".")
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	// Reading the layer from the registry verifies its digest
+	content, err := layer.Uncompressed()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer content.Close()
+	if err := extractTar(content, tmpPath); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := os.Rename(tmpPath, artifactPath); err != nil {
+		return v1.Hash{}, err
+	}
+	return desc.Digest, writeCachedDigest(cachePath, desc.Digest)
+}
+
+// builderLayer returns the layer holding the files of a builder artifact
+func builderLayer(img v1.Image) (v1.Layer, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Config.MediaType != BuilderConfigMediaType || len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != BuilderLayerMediaType {
+		return nil, fmt.Errorf("the artifact is not a builder, as it has a config of type '%s' and %d layer(s)", manifest.Config.MediaType, len(manifest.Layers))
+	}
+	return img.LayerByDigest(manifest.Layers[0].Digest)
+}
+
+// archiveBuilder returns a tarball of the files of a builder, stored under a
+// folder named after the builder. Modification times and owners are left
+// out, for the same files to always result in the same artifact.
+func archiveBuilder(name, builderPath string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.WalkDir(builderPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relFilePath, err := filepath.Rel(builderPath, filePath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		header := &tar.Header{
+			Name: path.Join(name, filepath.ToSlash(relFilePath)),
+			Mode: int64(info.Mode().Perm()),
+		}
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			return tw.WriteHeader(header)
+		case info.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		return fmt.Errorf("file '%s' is neither a regular file nor a directory", filePath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseArtifactReference(reference string) (name.Reference, error) {
+	ref, err := name.ParseReference(strings.TrimPrefix(reference, "oci://"), name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact reference '%s': %w", reference, err)
+	}
+	return ref, nil
+}
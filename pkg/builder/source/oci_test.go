@@ -0,0 +1,94 @@
+package source
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushAndPullOCI(t *testing.T) {
+	server := newRegistry()
+	defer server.Close()
+	reference := strings.TrimPrefix(server.URL, "http://") + "/builders/go-debian:1.2"
+
+	builderPath := path.Join(tempDir(t), "go-debian")
+	writeFile(t, path.Join(builderPath, "base/Dockerfile"), "FROM debian")
+	writeFile(t, path.Join(builderPath, "base/assets/entrypoint.sh"), "#!/bin/sh")
+
+	digest, err := PushOCI("go-debian", builderPath, reference)
+	assert.NoError(t, err)
+
+	// The same files always result in the same artifact
+	sameDigest, err := PushOCI("go-debian", builderPath, reference)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, sameDigest)
+
+	cacheRoot := tempDir(t)
+	location := parseLocation(t, "oci://"+reference)
+	_, err = FromOCI("go-debian", location, cacheRoot, true)
+	assert.EqualError(t, err, "builder location 'oci://"+reference+"' is not available offline, as it was never pulled")
+
+	localPath, err := FromOCI("go-debian", location, cacheRoot, false)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM debian")
+	assertFileContent(t, path.Join(localPath, "base/assets/entrypoint.sh"), "#!/bin/sh")
+
+	// The cached artifact is used without reaching the registry
+	server.Close()
+	offlinePath, err := FromOCI("go-debian", location, cacheRoot, true)
+	assert.NoError(t, err)
+	assert.Equal(t, localPath, offlinePath)
+}
+
+func TestPullOCIByDigest(t *testing.T) {
+	server := newRegistry()
+	defer server.Close()
+	repository := strings.TrimPrefix(server.URL, "http://") + "/builders"
+
+	builderPath := path.Join(tempDir(t), "ruby")
+	writeFile(t, path.Join(builderPath, "base/Dockerfile"), "FROM ruby")
+	digest, err := PushOCI("ruby", builderPath, repository+":latest")
+	assert.NoError(t, err)
+
+	localPath, err := FromOCI("ruby", parseLocation(t, "oci://"+repository+"@"+digest), tempDir(t), false)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby")
+}
+
+func TestPullOCIWithRegularImage(t *testing.T) {
+	server := newRegistry()
+	defer server.Close()
+	reference := strings.TrimPrefix(server.URL, "http://") + "/debian:latest"
+
+	img, err := random.Image(16, 1)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(reference)
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+
+	_, err = FromOCI("ruby", parseLocation(t, "oci://"+reference), tempDir(t), false)
+	assert.EqualError(t, err, "error pulling builder location 'oci://"+reference+"': the artifact is not a builder, as it has a config of type 'application/vnd.docker.container.image.v1+json' and 1 layer(s)")
+}
+
+func writeFile(t *testing.T, filepath, content string) {
+	if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newRegistry() *httptest.Server {
+	return httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(ioutil.Discard, "", 0))))
+}
@@ -0,0 +1,123 @@
+package source
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/maxlaverse/image-builder/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// FromTarball cache a builder definition stored in a tarball or a zip
+// archive downloaded over HTTP. The archive is verified against the checksum
+// of the location if there is one, and is then not downloaded again once
+// cached. Archives without checksum are downloaded on every call, unless
+// offline.
+func FromTarball(name string, location BuilderLocation, cacheRoot string, offline bool) (string, error) {
+	cachePath := path.Join(cacheRoot, locationFingerprint(location.String()))
+	expected := v1.Hash{Algorithm: "sha256", Hex: location.Checksum}
+
+	var digest v1.Hash
+	var err error
+	switch {
+	case len(location.Checksum) > 0 && utils.PathExists(path.Join(cachePath, expected.Hex)):
+		log.Debugf("Builder location '%s' is already cached", location)
+		digest = expected
+		err = writeCachedDigest(cachePath, digest)
+	case offline:
+		digest, err = readCachedDigest(cachePath)
+		if err != nil || len(location.Checksum) > 0 {
+			return "", fmt.Errorf("builder location '%s' is not available offline, as it was never downloaded", location)
+		}
+		log.Debugf("Using the cached archive of builder location '%s'", location)
+	default:
+		digest, err = downloadArchive(location, cachePath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error downloading builder location '%s': %w", location, err)
+	}
+
+	return path.Join(cachePath, digest.Hex, location.Subdirectory, name), nil
+}
+
+// downloadArchive downloads an archive, verifies its checksum and extracts it
+// into the cache, unless an archive with the same checksum was already
+// extracted
+func downloadArchive(location BuilderLocation, cachePath string) (v1.Hash, error) {
+	if err := os.MkdirAll(cachePath, 0755); err != nil {
+		return v1.Hash{}, err
+	}
+	archive, err := ioutil.TempFile(cachePath, "download.*")
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	log.Infof("Downloading builder location '%s'", location)
+	resp, err := http.Get(location.Repository)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v1.Hash{}, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(archive, h), resp.Body); err != nil {
+		return v1.Hash{}, err
+	}
+	digest := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+	if len(location.Checksum) > 0 && digest.Hex != location.Checksum {
+		return v1.Hash{}, fmt.Errorf("expected checksum '%s' but the archive has checksum '%s'", location.Checksum, digest.Hex)
+	}
+
+	archivePath := path.Join(cachePath, digest.Hex)
+	if utils.PathExists(archivePath) {
+		log.Debugf("Builder location '%s' is already cached with checksum '%s'", location, digest.Hex)
+		return digest, writeCachedDigest(cachePath, digest)
+	}
+
+	tmpPath, err := ioutil.TempDir(cachePath, digest.Hex+".")
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer os.RemoveAll(tmpPath)
+	if err := extractArchive(location, archive, tmpPath); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := os.Rename(tmpPath, archivePath); err != nil {
+		return v1.Hash{}, err
+	}
+	return digest, writeCachedDigest(cachePath, digest)
+}
+
+func extractArchive(location BuilderLocation, archive *os.File, dstPath string) error {
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	u, err := url.Parse(location.Repository)
+	if err != nil {
+		return err
+	}
+	if isZip(u.Path) {
+		return extractZip(archive.Name(), dstPath)
+	}
+
+	gr, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	return extractTar(gr, dstPath)
+}
@@ -0,0 +1,138 @@
+package source
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromTarball(t *testing.T) {
+	archive := tarGz(t, map[string]string{"builders/ruby/base/Dockerfile": "FROM ruby"})
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	cacheRoot := tempDir(t)
+	location := parseLocation(t, server.URL+"/builders.tar.gz#sha256="+checksum(archive)+":builders")
+	_, err := FromTarball("ruby", location, cacheRoot, true)
+	assert.EqualError(t, err, "builder location '"+location.String()+"' is not available offline, as it was never downloaded")
+
+	localPath, err := FromTarball("ruby", location, cacheRoot, false)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby")
+
+	// Archives with a checksum are downloaded once
+	cachedPath, err := FromTarball("ruby", location, cacheRoot, false)
+	assert.NoError(t, err)
+	assert.Equal(t, localPath, cachedPath)
+	assert.Equal(t, 1, downloads)
+
+	// Archives without checksum are downloaded again, unless offline
+	location = parseLocation(t, server.URL+"/builders.tar.gz#builders")
+	_, err = FromTarball("ruby", location, cacheRoot, false)
+	assert.NoError(t, err)
+	server.Close()
+	localPath, err = FromTarball("ruby", location, cacheRoot, true)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby")
+	assert.Equal(t, 2, downloads)
+}
+
+func TestFromTarballWithZip(t *testing.T) {
+	archive := zipArchive(t, map[string]string{"ruby/base/Dockerfile": "FROM ruby"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	localPath, err := FromTarball("ruby", parseLocation(t, server.URL+"/builders.zip"), tempDir(t), false)
+	assert.NoError(t, err)
+	assertFileContent(t, path.Join(localPath, "base/Dockerfile"), "FROM ruby")
+}
+
+func TestFromTarballErrors(t *testing.T) {
+	archive := tarGz(t, map[string]string{"ruby/base/Dockerfile": "FROM ruby"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/builders.tar.gz":
+			w.Write(archive)
+		case "/escaping.tar.gz":
+			w.Write(tarGz(t, map[string]string{"../outside": "content"}))
+		case "/escaping.zip":
+			w.Write(zipArchive(t, map[string]string{"ruby/../../outside": "content"}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	wrongChecksum := checksum([]byte("something else"))
+	tests := map[string]string{
+		"/builders.tar.gz#sha256=" + wrongChecksum: "expected checksum '" + wrongChecksum + "' but the archive has checksum '" + checksum(archive) + "'",
+		"/escaping.tar.gz":                         "invalid file '../outside' in archive",
+		"/escaping.zip":                            "invalid file 'ruby/../../outside' in archive",
+		"/missing.tar.gz":                          "unexpected status '404 Not Found'",
+	}
+	for suffix, expected := range tests {
+		t.Run(suffix, func(t *testing.T) {
+			_, err := FromTarball("ruby", parseLocation(t, server.URL+suffix), tempDir(t), false)
+			assert.EqualError(t, err, "error downloading builder location '"+server.URL+suffix+"': "+expected)
+		})
+	}
+}
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
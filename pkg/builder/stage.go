@@ -1,22 +1,21 @@
 package builder
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"sort"
 	"strings"
 
 	"github.com/maxlaverse/image-builder/pkg/engine"
 	"github.com/maxlaverse/image-builder/pkg/fileutils"
+	"github.com/maxlaverse/image-builder/pkg/registry"
 	"github.com/maxlaverse/image-builder/pkg/template"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	dockerIgnoreName = ".dockerignore"
-)
-
 // StageImageStatus represents the status of the image corresponding to a
 // stage (e.g. absent, cached, pulled)
 type StageImageStatus string
@@ -40,17 +39,23 @@ const (
 
 // BuildStage represents a individual stage which can be built
 type BuildStage interface {
-	Build(engineBuild engine.BuildEngine) error
+	Build(ctx context.Context, engineBuild engine.BuildEngine, opts engine.BuildOptions) error
+	BuildArgs() map[string]string
 	ComputeContentHash() error
 	ContentHash() string
+	Digest() string
 	Dockerfile() string
 	ContextFiles() ([]string, error)
+	ExternalImages() map[string]string
 	GetRequiredStages() []string
 	GetTagAliases() []string
+	HashManifest() (*HashManifest, error)
 	ImageTag() (string, error)
 	ImageURL() string
 	Name() string
+	Platforms() []string
 	Render() error
+	SetDigest(digest string)
 	SetImageURL(source string)
 	SetSourceImageURL(source string)
 	SetStatus(status StageImageStatus)
@@ -60,22 +65,33 @@ type BuildStage interface {
 
 // buildStage represents a individual stage which can be built
 type buildStage struct {
-	extraIncludePatterns []string
-	contentHash          string
-	dockerfile           template.Dockerfile
-	imageURL             string
-	name                 string
-	sourceImageURL       string
-	status               StageImageStatus
+	buildArgs      map[string]string
+	contentHash    string
+	contextFilter  fileutils.ContextFilter
+	digest         string
+	dockerfile     template.Dockerfile
+	hashScheme     fileutils.HashScheme
+	imageURL       string
+	name           string
+	platforms      []string
+	sourceImageURL string
+	status         StageImageStatus
+	variants       map[string]template.Dockerfile
 }
 
-// NewBuildStage returns a individual stage
-func NewBuildStage(name string, dockerfile template.Dockerfile, extraIncludePatterns []string) BuildStage {
+// NewBuildStage returns a individual stage. The context filter and the build
+// arguments are completed with the directives of the Dockerfile, and the
+// platforms replace the ones of the directives if any.
+func NewBuildStage(name string, dockerfile template.Dockerfile, contextFilter fileutils.ContextFilter, buildArgs map[string]string, platforms []string, hashScheme fileutils.HashScheme) BuildStage {
 	return &buildStage{
-		extraIncludePatterns: extraIncludePatterns,
-		dockerfile:           dockerfile,
-		name:                 name,
-		status:               Initialized,
+		buildArgs:     buildArgs,
+		contextFilter: contextFilter,
+		dockerfile:    dockerfile,
+		hashScheme:    hashScheme,
+		name:          name,
+		platforms:     platforms,
+		status:        Initialized,
+		variants:      map[string]template.Dockerfile{},
 	}
 }
 
@@ -83,6 +99,10 @@ func (b *buildStage) SetSourceImageURL(source string) {
 	b.sourceImageURL = source
 }
 
+func (b *buildStage) SetDigest(digest string) {
+	b.digest = digest
+}
+
 func (b *buildStage) SetImageURL(source string) {
 	b.imageURL = source
 }
@@ -91,33 +111,116 @@ func (b *buildStage) SetStatus(status StageImageStatus) {
 	b.status = status
 }
 
-// Build writes a Dockerfile and .dockerignore and calls the engine's build command
-func (b *buildStage) Build(engineBuild engine.BuildEngine) error {
+// Build writes a Dockerfile and calls the engine's build command with a
+// context only containing the files of the stage, and its build arguments.
+// The image gets labels describing the stage, which are not part of the
+// Content Hash. A stage with platforms is built and pushed once per
+// platform, and its image is a manifest list referencing all of them.
+func (b *buildStage) Build(ctx context.Context, engineBuild engine.BuildEngine, opts engine.BuildOptions) error {
+	opts.BuildArgs = b.BuildArgs()
+	opts.Labels = b.stageLabels(opts.Labels)
 	log.Infof("Build context for '%s' is '%s'", b.Name(), b.dockerfile.GetBuildContext())
-	dockerfilePath, err := writeDockerfile(b.dockerfile.GetContent())
+	if len(b.Platforms()) == 0 {
+		return b.build(ctx, engineBuild, b.dockerfile, b.imageURL, opts)
+	}
+
+	images := []string{}
+	for _, platform := range b.Platforms() {
+		dockerfile, err := b.platformDockerfile(platform)
+		if err != nil {
+			return err
+		}
+		image := platformImageURL(b.imageURL, platform)
+		log.Infof("Building stage '%s' for platform '%s'", b.Name(), platform)
+		opts.Platform = platform
+		if err := b.build(ctx, engineBuild, dockerfile, image, opts); err != nil {
+			return err
+		}
+		if err := engineBuild.Push(ctx, image); err != nil {
+			return fmt.Errorf("error while pushing image '%s': %w", image, err)
+		}
+		images = append(images, image)
+	}
+
+	log.Infof("Pushing manifest list '%s'", b.imageURL)
+	return registry.WriteManifestList(ctx, b.imageURL, images)
+}
+
+// build builds the image of a Dockerfile
+func (b *buildStage) build(ctx context.Context, engineBuild engine.BuildEngine, dockerfile template.Dockerfile, image string, opts engine.BuildOptions) error {
+	dockerfilePath, err := writeDockerfile(dockerfile.GetContent())
 	if err != nil {
 		return fmt.Errorf("error writing 'Dockerfile' file: %w", err)
 	}
 	defer os.Remove(dockerfilePath)
 
-	dockerignorePath := path.Join(b.dockerfile.GetBuildContext(), dockerIgnoreName)
-
 	files, err := b.ContextFiles()
 	if err != nil {
 		return err
 	}
 
-	err = writeExplicitDockerIgnore(dockerignorePath, files)
+	// Some engines can restrict the context on their own
+	if e, ok := engineBuild.(engine.FileListBuilder); ok {
+		return e.BuildWithFileList(ctx, dockerfilePath, image, b.dockerfile.GetBuildContext(), files, opts)
+	}
+
+	contextDir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		return fmt.Errorf("error creating build context: %w", err)
+	}
+	defer os.RemoveAll(contextDir)
+
+	log.Debugf("Copying %d files in the build context of '%s' (%s)", len(files), b.Name(), contextDir)
+	err = fileutils.CopyFiles(b.dockerfile.GetBuildContext(), contextDir, files)
 	if err != nil {
-		return fmt.Errorf("error writing '.dockerignore' file: %w", err)
+		return fmt.Errorf("error copying files in build context: %w", err)
+	}
+
+	return engineBuild.Build(ctx, dockerfilePath, image, contextDir, opts)
+}
+
+// Platforms returns the platforms the stage is built for, or an empty list
+// if it's built for the platform of the engine only
+func (b *buildStage) Platforms() []string {
+	if len(b.platforms) > 0 {
+		return b.platforms
 	}
-	defer os.Remove(dockerignorePath)
+	return b.dockerfile.GetPlatforms()
+}
+
+// platformDockerfile returns the Dockerfile of the stage rendered for a
+// platform by Render
+func (b *buildStage) platformDockerfile(platform string) (template.Dockerfile, error) {
+	d, ok := b.variants[platform]
+	if !ok {
+		return nil, fmt.Errorf("stage '%s' was not rendered for platform '%s'", b.name, platform)
+	}
+	return d, nil
+}
 
-	return engineBuild.Build(dockerfilePath, b.imageURL, b.dockerfile.GetBuildContext())
+// platformImageURL returns the image a platform of a stage is built as before
+// being added to the manifest list, e.g 'app:release-1a2b3c-linux-arm64-v8'
+func platformImageURL(imageURL, platform string) string {
+	return imageURL + "-" + strings.Replace(platform, "/", "-", -1)
+}
+
+// BuildArgs returns the build arguments of the stage. The ones of the Build
+// Configuration override the directives of the Dockerfile.
+func (b *buildStage) BuildArgs() map[string]string {
+	args := b.dockerfile.GetBuildArgs()
+	for name, value := range b.buildArgs {
+		args[name] = value
+	}
+	return args
 }
 
 func (b *buildStage) ContextFiles() ([]string, error) {
-	contextFiles, err := fileutils.ListMatchingFiles(b.dockerfile.GetBuildContext(), append(b.extraIncludePatterns, b.dockerfile.GetContextIncludes()...))
+	filter := fileutils.ContextFilter{
+		IncludePatterns:  append(append([]string{}, b.contextFilter.IncludePatterns...), b.dockerfile.GetContextIncludes()...),
+		ExcludePatterns:  append(append([]string{}, b.contextFilter.ExcludePatterns...), b.dockerfile.GetContextExcludes()...),
+		HonorIgnoreFiles: b.contextFilter.HonorIgnoreFiles,
+	}
+	contextFiles, err := fileutils.ListContextFiles(b.dockerfile.GetBuildContext(), filter)
 	if err != nil {
 		return contextFiles, fmt.Errorf("error listing files in context: %w", err)
 	}
@@ -131,7 +234,12 @@ func (b *buildStage) ComputeContentHash() error {
 		return err
 	}
 
-	contentHash, err := fileutils.ContentHashing(b.dockerfile.GetBuildContext(), files, b.dockerfile.GetContentWithoutIgnoredLines())
+	platforms, err := b.platformsHashInput()
+	if err != nil {
+		return err
+	}
+
+	contentHash, err := fileutils.ContentHashing(b.hashScheme, b.dockerfile.GetBuildContext(), files, b.dockerfile.GetContentWithoutIgnoredLines()+partialsHashInput(b.dockerfile.GetPartials())+buildArgsHashInput(b.BuildArgs())+platforms)
 	if err != nil {
 		return fmt.Errorf("error computing ContentHash: %w", err)
 	}
@@ -146,10 +254,148 @@ func (b *buildStage) ContentHash() string {
 	return b.contentHash
 }
 
+// HashManifest returns the inputs of the Content Hash of the stage, without
+// the hashes of the stages it depends on
+func (b *buildStage) HashManifest() (*HashManifest, error) {
+	files, err := b.ContextFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	digests, err := fileutils.FileDigests(b.dockerfile.GetBuildContext(), files)
+	if err != nil {
+		return nil, fmt.Errorf("error computing file digests: %w", err)
+	}
+
+	if len(b.contentHash) == 0 {
+		if err := b.ComputeContentHash(); err != nil {
+			return nil, err
+		}
+	}
+
+	hashScheme := b.hashScheme
+	if len(hashScheme) == 0 {
+		hashScheme = fileutils.DefaultHashScheme
+	}
+
+	externalImages := map[string]string{}
+	for k, v := range b.dockerfile.GetExternalImages() {
+		externalImages[k] = v
+	}
+
+	var platforms map[string]string
+	for _, platform := range b.Platforms() {
+		dockerfile, err := b.platformDockerfile(platform)
+		if err != nil {
+			return nil, err
+		}
+		if platforms == nil {
+			platforms = map[string]string{}
+		}
+		platforms[platform] = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(dockerfile.GetContentWithoutIgnoredLines())))
+	}
+
+	return &HashManifest{
+		Stage:          b.name,
+		ContentHash:    b.contentHash,
+		HashScheme:     hashScheme,
+		BuildContext:   b.dockerfile.GetBuildContext(),
+		Files:          digests,
+		Dockerfile:     b.dockerfile.GetContentWithoutIgnoredLines(),
+		ExternalImages: externalImages,
+		BuilderStages:  map[string]string{},
+		Partials:       partialDigests(b.dockerfile.GetPartials()),
+		BuildArgs:      nonEmptyMap(b.BuildArgs()),
+		Platforms:      platforms,
+	}, nil
+}
+
+// platformsHashInput returns the platforms of a stage along with the
+// Dockerfile rendered for each of them, for them to be part of its Content
+// Hash. Like partials, it's empty for stages without platforms.
+func (b *buildStage) platformsHashInput() (string, error) {
+	input := ""
+	for _, platform := range b.Platforms() {
+		dockerfile, err := b.platformDockerfile(platform)
+		if err != nil {
+			return "", err
+		}
+		content := dockerfile.GetContentWithoutIgnoredLines()
+		input += fmt.Sprintf("\x00platform\x00%s\x00%d\x00%s", platform, len(content), content)
+	}
+	return input, nil
+}
+
+// partialsHashInput returns the content of the partials a Dockerfile uses,
+// for them to be part of its Content Hash. It's empty when no partial is
+// used, for the Content Hash of those Dockerfiles to remain the same.
+func partialsHashInput(partials map[string]string) string {
+	names := []string{}
+	for name := range partials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	input := ""
+	for _, name := range names {
+		input += fmt.Sprintf("\x00partial\x00%s\x00%d\x00%s", name, len(partials[name]), partials[name])
+	}
+	return input
+}
+
+// buildArgsHashInput returns the build arguments of a stage, for them to be
+// part of its Content Hash. Like partials, it's empty when there is none.
+func buildArgsHashInput(args map[string]string) string {
+	names := []string{}
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	input := ""
+	for _, name := range names {
+		input += fmt.Sprintf("\x00buildArg\x00%s\x00%d\x00%s", name, len(args[name]), args[name])
+	}
+	return input
+}
+
+func nonEmptyMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// partialDigests returns the digest of each partial a Dockerfile uses
+func partialDigests(partials map[string]string) map[string]string {
+	if len(partials) == 0 {
+		return nil
+	}
+	digests := map[string]string{}
+	for name, content := range partials {
+		digests[name] = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+	}
+	return digests
+}
+
+func (b *buildStage) Digest() string {
+	return b.digest
+}
+
 func (b *buildStage) Dockerfile() string {
 	return b.dockerfile.GetContent()
 }
 
+// ExternalImages returns the external images the stage references, along
+// with the digest they were replaced with
+func (b *buildStage) ExternalImages() map[string]string {
+	images := map[string]string{}
+	for k, v := range b.dockerfile.GetExternalImages() {
+		images[k] = v
+	}
+	return images
+}
+
 func (b *buildStage) GetRequiredStages() []string {
 	return b.dockerfile.GetRequiredStages()
 }
@@ -162,13 +408,31 @@ func (b *buildStage) ImageURL() string {
 	return b.imageURL
 }
 
+// Render renders the Dockerfile of the stage, and the one of each platform.
+// The Dockerfiles of the platforms are only rendered once, for the external
+// images they reference to keep the digests they were hashed with.
 func (b *buildStage) Render() error {
-	return b.dockerfile.Render()
+	if err := b.dockerfile.Render(); err != nil {
+		return err
+	}
+	for _, platform := range b.Platforms() {
+		if _, ok := b.variants[platform]; ok {
+			continue
+		}
+		d, err := b.dockerfile.ForPlatform(platform)
+		if err != nil {
+			return err
+		}
+		b.variants[platform] = d
+	}
+	return nil
 }
 
 func (b *buildStage) ImageTag() (string, error) {
 	if len(b.contentHash) == 0 {
-		b.ComputeContentHash()
+		if err := b.ComputeContentHash(); err != nil {
+			return "", err
+		}
 	}
 	if len(b.dockerfile.GetFriendlyTag()) > 0 {
 		return fmt.Sprintf("%s-%s", b.dockerfile.GetFriendlyTag(), b.contentHash), nil
@@ -198,11 +462,3 @@ func writeDockerfile(content string) (string, error) {
 	_, err = f.WriteString(content)
 	return f.Name(), err
 }
-
-func writeExplicitDockerIgnore(path string, filesToInclude []string) error {
-	content := "*\n"
-	if len(filesToInclude) > 0 {
-		content = content + "!" + strings.Join(filesToInclude, "\n!") + "\n"
-	}
-	return ioutil.WriteFile(path, []byte(content), 0644)
-}
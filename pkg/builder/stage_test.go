@@ -1,11 +1,14 @@
 package builder
 
 import (
+	"context"
 	"testing"
 
 	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/maxlaverse/image-builder/pkg/engine"
 	enginetest "github.com/maxlaverse/image-builder/pkg/engine/test"
 	executortest "github.com/maxlaverse/image-builder/pkg/executor/test"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
 	"github.com/maxlaverse/image-builder/pkg/template"
 	"github.com/stretchr/testify/assert"
 )
@@ -14,9 +17,9 @@ func TestEmptyBuildStageWithEmptyDockerfile(t *testing.T) {
 	fakeExecutor := executortest.New()
 	buildConf := config.BuildConfiguration{}
 	resolver := func(string) (string, error) { return "none", nil }
-	dockerfile := template.NewDockerfile([]byte{}, "empty", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
+	dockerfile := template.NewDockerfile([]byte{}, nil, "empty", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
 
-	stage := NewBuildStage("empty", dockerfile, []string{})
+	stage := NewBuildStage("empty", dockerfile, fileutils.ContextFilter{}, nil, nil, fileutils.HashSchemeCRC32)
 
 	err := stage.ComputeContentHash()
 
@@ -28,9 +31,9 @@ func TestEmptyBuildStageWithDockerfile(t *testing.T) {
 	fakeExecutor := executortest.New()
 	buildConf := config.BuildConfiguration{}
 	resolver := func(string) (string, error) { return "none", nil }
-	dockerfile := template.NewDockerfile([]byte("something"), "empty", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
+	dockerfile := template.NewDockerfile([]byte("something"), nil, "empty", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
 
-	stage := NewBuildStage("empty", dockerfile, []string{})
+	stage := NewBuildStage("empty", dockerfile, fileutils.ContextFilter{}, nil, nil, fileutils.HashSchemeCRC32)
 
 	err := stage.ComputeContentHash()
 
@@ -42,13 +45,51 @@ func TestBuildStage(t *testing.T) {
 	fakeExecutor := executortest.New()
 	buildConf := config.BuildConfiguration{}
 	resolver := func(string) (string, error) { return "none", nil }
-	dockerfile := template.NewDockerfile([]byte{}, "empty", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
+	dockerfile := template.NewDockerfile([]byte{}, nil, "empty", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
 
-	stage := NewBuildStage("empty", dockerfile, []string{})
+	stage := NewBuildStage("empty", dockerfile, fileutils.ContextFilter{}, nil, nil, fileutils.DefaultHashScheme)
 	stage.SetImageURL("final-image")
 	fakeEngine := enginetest.New()
-	err := stage.Build(fakeEngine)
+	err := stage.Build(context.Background(), fakeEngine, engine.BuildOptions{})
 
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"Build(final-image)"}, fakeEngine.MethodCalls)
 }
+
+func TestBuildStageHashWithPartials(t *testing.T) {
+	contentHash := func(partials map[string]string) string {
+		resolver := func(string) (string, error) { return "none", nil }
+		dockerfile := template.NewDockerfile([]byte(`FROM debian
+{{ template "greeting" }}`), partials, "empty", config.BuildConfiguration{}, "../../fixtures/empty", "../../fixtures/empty", resolver, executortest.New())
+		stage := NewBuildStage("empty", dockerfile, fileutils.ContextFilter{}, nil, nil, fileutils.HashSchemeCRC32)
+		assert.NoError(t, stage.Render())
+		assert.NoError(t, stage.ComputeContentHash())
+		return stage.ContentHash()
+	}
+
+	hash := contentHash(map[string]string{"greeting": `RUN echo hello`})
+	assert.Equal(t, hash, contentHash(map[string]string{"greeting": `RUN echo hello`, "unused": `RUN echo bye`}))
+	assert.NotEqual(t, hash, contentHash(map[string]string{"greeting": `RUN echo bonjour`}))
+}
+
+func TestBuildStageKeepsPlatformDockerfiles(t *testing.T) {
+	fakeExecutor := executortest.New()
+	buildConf := config.BuildConfiguration{}
+	builderImage := "builder:v1"
+	resolver := func(string) (string, error) { return builderImage, nil }
+	dockerfile := template.NewDockerfile([]byte("# Platform linux/amd64\nFROM {{ BuilderStage \"base\" }}\n"), nil, "release", buildConf, "../../fixtures/empty", "../../fixtures/empty", resolver, fakeExecutor)
+
+	stage := NewBuildStage("release", dockerfile, fileutils.ContextFilter{}, nil, nil, fileutils.DefaultHashScheme)
+	assert.NoError(t, stage.Render())
+
+	// Rendering again doesn't replace the Dockerfiles of the platforms
+	builderImage = "builder:v2"
+	assert.NoError(t, stage.Render())
+
+	d, err := stage.(*buildStage).platformDockerfile("linux/amd64")
+	if assert.NoError(t, err) {
+		assert.Contains(t, d.GetContent(), "FROM builder:v1")
+	}
+	_, err = stage.(*buildStage).platformDockerfile("linux/arm64")
+	assert.EqualError(t, err, "stage 'release' was not rendered for platform 'linux/arm64'")
+}
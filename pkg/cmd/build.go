@@ -1,16 +1,22 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/maxlaverse/image-builder/pkg/builder"
+	"github.com/maxlaverse/image-builder/pkg/builder/source"
 	"github.com/maxlaverse/image-builder/pkg/config"
 	"github.com/maxlaverse/image-builder/pkg/engine"
 	"github.com/maxlaverse/image-builder/pkg/executor"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
 	"github.com/maxlaverse/image-builder/pkg/registry"
 	"github.com/maxlaverse/image-builder/pkg/utils"
 	log "github.com/sirupsen/logrus"
@@ -19,20 +25,33 @@ import (
 
 type buildCommandOptions struct {
 	buildConfiguration string
+	buildConcurrency   int64
 	pullConcurrency    int64
 	cacheImagePush     bool
 	cacheImagePull     bool
 	dryRun             bool
 	engine             string
+	buildkitAddress    string
+	daemonless         bool
+	hashScheme         string
+	noHashCache        bool
+	cacheLookupErrors  string
+	localTargetImage   bool
+	reportFile         string
+	offline            bool
+	cacheFrom          []string
+	cacheTo            []string
 	targetImage        string
 	targetStages       []string
 	extraTags          map[string][]string
+	secrets            []engine.Secret
+	ssh                []engine.SSH
 }
 
 // NewBuildCmd returns a Cobra command to build images
 func NewBuildCmd(conf *config.CliConfiguration) *cobra.Command {
 	var opts buildCommandOptions
-	var extraTagArray []string
+	var extraTagArray, secretArray, sshArray []string
 	cmd := &cobra.Command{
 		Use:              "build [options] <directory>",
 		Short:            "Builds an image from a Build Definition file",
@@ -47,7 +66,27 @@ func NewBuildCmd(conf *config.CliConfiguration) *cobra.Command {
 				return err
 			}
 			opts.extraTags = extraTags
-			return nil
+			for _, s := range secretArray {
+				secret, err := engine.ParseSecret(s)
+				if err != nil {
+					return err
+				}
+				opts.secrets = append(opts.secrets, secret)
+			}
+			for _, s := range sshArray {
+				ssh, err := engine.ParseSSH(s)
+				if err != nil {
+					return err
+				}
+				opts.ssh = append(opts.ssh, ssh)
+			}
+			if opts.buildConcurrency < 1 {
+				return fmt.Errorf("the build concurrency must be at least 1")
+			}
+			if err := validateCacheLookupErrors(opts.cacheLookupErrors); err != nil {
+				return err
+			}
+			return validateHashScheme(opts.hashScheme)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return buildStageApp(opts, args[0])
@@ -57,12 +96,24 @@ func NewBuildCmd(conf *config.CliConfiguration) *cobra.Command {
 	cmd.Flags().StringVarP(&opts.buildConfiguration, "build-config", "c", "build.yaml", "Configuration file of the application")
 	cmd.Flags().BoolVarP(&opts.cacheImagePull, "cache-image-pull", "", conf.DefaultCacheImagePull, "Pull cache images from the registry")
 	cmd.Flags().BoolVarP(&opts.cacheImagePush, "cache-image-push", "", conf.DefaultCacheImagePush, "Push cache images to the registry")
+	cmd.Flags().Int64VarP(&opts.buildConcurrency, "build-concurrency", "", conf.DefaultBuildConcurrency, "Maximum number of concurrent image builds")
 	cmd.Flags().Int64VarP(&opts.pullConcurrency, "pull-concurrency", "", conf.DefaultPullConcurrency, "Maximumm number of concurrent image pulls")
 	cmd.Flags().BoolVarP(&opts.dryRun, "dry-run", "", false, "Only display the generated Dockerfiles")
 	cmd.Flags().StringVarP(&opts.engine, "engine", "", conf.DefaultEngine, "Engine to use for building images")
+	cmd.Flags().StringVarP(&opts.buildkitAddress, "buildkit-addr", "", conf.DefaultBuildkitAddress, "Address of the buildkitd daemon (buildkit engine only)")
+	cmd.Flags().BoolVarP(&opts.daemonless, "daemonless", "", conf.DefaultDaemonless, "Assemble images in-process when a stage only copies files, and use the engine otherwise")
+	cmd.Flags().StringVarP(&opts.hashScheme, "hash-scheme", "", conf.DefaultHashScheme, "Algorithm used to compute the Content Hash of stages ('v1' or 'v2')")
+	cmd.Flags().BoolVarP(&opts.noHashCache, "no-hash-cache", "", false, "Read every file of the build contexts instead of reusing the digests of unchanged files")
+	cmd.Flags().BoolVarP(&opts.offline, "offline", "", conf.DefaultOffline, "Build from cached builder definitions and local images only, without reaching any registry")
+	cmd.Flags().StringVarP(&opts.cacheLookupErrors, "cache-lookup-errors", "", conf.DefaultCacheLookupErrors, "What to do when a registry fails to tell if a cached image exists ('fail' or 'warn')")
+	cmd.Flags().StringArrayVarP(&opts.cacheFrom, "cache-from", "", []string{}, "External build cache to import from, e.g 'type=registry,ref=<image>' (buildkit engine only)")
+	cmd.Flags().StringArrayVarP(&opts.cacheTo, "cache-to", "", []string{}, "External build cache to export to, e.g 'type=registry,ref=<image>,mode=max' (buildkit engine only)")
 	cmd.Flags().StringVarP(&opts.targetImage, "target-image", "t", "", "Specifies the name which will be assigned to the resulting image if the build process completes successfully")
 	cmd.Flags().StringArrayVarP(&extraTagArray, "extra-tag", "", []string{}, "Extra tag if the stage was built (format: <stage>=<tag>)")
 	cmd.Flags().StringArrayVarP(&opts.targetStages, "target-stages", "s", []string{"release"}, "Specifies the stages to build")
+	cmd.Flags().StringArrayVarP(&secretArray, "secret", "", []string{}, "Secret made available to 'RUN --mount=type=secret' instructions (format: id=<id>,src=<file> or id=<id>,env=<variable>)")
+	cmd.Flags().StringArrayVarP(&sshArray, "ssh", "", []string{}, "SSH agent or keys forwarded to 'RUN --mount=type=ssh' instructions (format: default or <id>=<socket>|<key>[,<key>])")
+	cmd.Flags().StringVarP(&opts.reportFile, "report-file", "", "", "Write a JSON report of the build with the status, digest and timings of every stage")
 
 	return cmd
 }
@@ -74,32 +125,59 @@ func buildStageApp(opts buildCommandOptions, buildContext string) error {
 	}
 
 	if len(opts.targetImage) == 0 {
+		if opts.engine == "buildkit" {
+			return fmt.Errorf("the buildkit engine pushes every image it builds and requires a target image")
+		}
 		opts.cacheImagePush = false
+		opts.localTargetImage = true
 		opts.targetImage = generatedTargetName()
 		log.Infof("No target image name has been provided. Using '%s'", opts.targetImage)
 	}
 
-	if !strings.HasSuffix(buildContext, "/") {
-		buildContext = buildContext + "/"
-	}
-	buildContext, err = filepath.Abs(path.Dir(buildContext))
+	buildContext, err = absoluteBuildContext(buildContext)
 	if err != nil {
 		return err
 	}
+
+	if opts.offline {
+		log.Infof("Offline mode: no image will be looked up in, pulled from or pushed to a registry")
+		opts.cacheImagePull = false
+		opts.cacheImagePush = false
+		opts.daemonless = false
+	}
+	if opts.daemonless && !opts.cacheImagePush {
+		log.Infof("Images assembled in-process are pushed to the registry, which requires --cache-image-push and a target image: using %s for every stage", opts.engine)
+		opts.daemonless = false
+	}
+
+	defer useHashCache(opts.noHashCache)()
+	defer useDigestCache()()
 	return buildStageGeneric(opts, opts.targetStages, buildConf, buildContext)
 }
 
 func buildStageGeneric(opts buildCommandOptions, stages []string, buildConf config.BuildConfiguration, buildContext string) error {
-	builderDef, err := builder.NewDefinitionFromLocation(buildConf.BuilderName(), buildConf.BuilderLocation())
+	builderDef, err := loadBuilderDefinition(opts.buildConfiguration, &buildConf, false, opts.offline)
 	if err != nil {
 		return err
 	}
 
-	engineCli, err := engine.New(opts.engine, executor.New())
+	engineOpts := engine.Options{
+		BuildkitAddress: opts.buildkitAddress,
+		CacheFrom:       opts.cacheFrom,
+		CacheTo:         opts.cacheTo,
+		Daemonless:      opts.daemonless,
+	}
+	engineCli, err := engine.New(opts.engine, executor.New(), engineOpts)
 	if err != nil {
 		return err
 	}
 
+	useOfflineMode(opts.offline, engineCli)
+
+	if opts.engine != "buildkit" && (len(opts.cacheFrom) > 0 || len(opts.cacheTo) > 0) {
+		log.Warnf("External build caches are only supported by the buildkit engine and will be ignored")
+	}
+
 	engineVersion, err := engineCli.Version()
 	if err != nil {
 		return fmt.Errorf("unable to determine Container Engine version: %v", err)
@@ -107,18 +185,41 @@ func buildStageGeneric(opts buildCommandOptions, stages []string, buildConf conf
 	log.Infof("Container Engine: %s (v%s)\n", engineCli.Name(), engineVersion)
 
 	buildOpts := builder.BuildOptions{
-		// TODO: Fix this. Having two concurrent builds can lead to problems if
-		// they have a different dockerignore file
-		BuildConcurrency: 1,
-		PullConcurrency:  opts.pullConcurrency,
-		CacheImagePull:   opts.cacheImagePull,
-		CacheImagePush:   opts.cacheImagePush,
-		DryRun:           opts.dryRun,
+		BuildConcurrency:  opts.buildConcurrency,
+		PullConcurrency:   opts.pullConcurrency,
+		CacheImagePull:    opts.cacheImagePull,
+		CacheImagePush:    opts.cacheImagePush,
+		LocalTargetImage:  opts.localTargetImage,
+		DryRun:            opts.dryRun,
+		HashScheme:        fileutils.HashScheme(opts.hashScheme),
+		CacheLookupErrors: builder.CacheLookupErrorPolicy(opts.cacheLookupErrors),
+		Secrets:           opts.secrets,
+		SSH:               opts.ssh,
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	b := builder.NewBuild(engineCli, executor.New(), builderDef, buildConf, buildOpts, opts.targetImage, buildContext)
-	buildSummaries, err := b.BuildStages(stages)
+	startedAt := time.Now()
+	appliedExtraTags, err := buildAndTagStages(ctx, b, engineCli, opts, stages)
+	if len(opts.reportFile) > 0 {
+		if reportErr := writeBuildReport(b, opts.reportFile, startedAt, appliedExtraTags, err); reportErr != nil {
+			log.Errorf("Unable to write the build report '%s': %v", opts.reportFile, reportErr)
+			if err == nil {
+				err = reportErr
+			}
+		}
+	}
+	return err
+}
+
+// buildAndTagStages builds the stages and adds their extra tags. It returns
+// the extra tags that were added to each stage.
+func buildAndTagStages(ctx context.Context, b *builder.Build, engineCli engine.BuildEngine, opts buildCommandOptions, stages []string) (map[string][]string, error) {
+	appliedExtraTags := map[string][]string{}
+	buildSummaries, err := b.BuildStages(ctx, stages)
 	if err != nil {
-		return err
+		return appliedExtraTags, err
 	}
 
 	knownStages := []string{}
@@ -134,17 +235,23 @@ func buildStageGeneric(opts buildCommandOptions, stages []string, buildConf conf
 	imageURLs := []string{}
 	for _, buildSummary := range buildSummaries {
 		for _, j := range opts.extraTags[buildSummary.Name()] {
-			if buildSummary.Status() == builder.ImageBuilt || buildSummary.Status() == builder.ImagePulled {
-				err = engineCli.Tag(buildSummary.ImageURL(), opts.targetImage+":"+j)
-				if err != nil {
-					return err
-				}
-			} else if buildSummary.Status() == builder.ImageCached {
-				err = registry.TagImage(buildSummary.ImageURL(), j)
-				if err != nil {
-					return err
+			switch buildSummary.Status() {
+			case builder.ImageBuilt, builder.ImagePulled:
+				if len(buildSummary.Platforms()) > 0 {
+					// The engine only holds the images of each platform
+					err = registry.TagImage(ctx, buildSummary.ImageURL(), j)
+					break
 				}
+				err = engineCli.Tag(ctx, buildSummary.ImageURL(), opts.targetImage+":"+j)
+			case builder.ImageCached:
+				err = registry.TagImage(ctx, buildSummary.ImageURL(), j)
+			default:
+				continue
+			}
+			if err != nil {
+				return appliedExtraTags, err
 			}
+			appliedExtraTags[buildSummary.Name()] = append(appliedExtraTags[buildSummary.Name()], j)
 		}
 
 		// Compute image URLs to display in the summary
@@ -160,7 +267,151 @@ func buildStageGeneric(opts buildCommandOptions, stages []string, buildConf conf
 		log.Infof("* %s\n", image)
 	}
 
-	return nil
+	return appliedExtraTags, nil
+}
+
+// writeBuildReport writes the JSON report of a build, whether it succeeded
+// or not
+func writeBuildReport(b *builder.Build, reportFile string, startedAt time.Time, extraTags map[string][]string, buildErr error) error {
+	report := b.Report()
+	report.StartedAt = startedAt
+	report.FinishedAt = time.Now()
+	report.Succeeded = buildErr == nil
+	if buildErr != nil {
+		report.Error = buildErr.Error()
+	}
+	for i, stage := range report.Stages {
+		report.Stages[i].ExtraTags = append(report.Stages[i].ExtraTags, extraTags[stage.Name]...)
+	}
+	return report.Save(reportFile)
+}
+
+// validateHashScheme verifies a hash scheme given on the command line exists
+func validateHashScheme(hashScheme string) error {
+	switch fileutils.HashScheme(hashScheme) {
+	case fileutils.HashSchemeCRC32, fileutils.HashSchemeSHA256:
+		return nil
+	}
+	return fmt.Errorf("unknown hash scheme '%s'", hashScheme)
+}
+
+// loadBuilderDefinition returns the builder of a Build Configuration. Git
+// locations are pinned with the lockfile of the Build Configuration,
+// unless updating the lockfile. The Build Configuration is validated against
+// the manifest of the builder, and receives the default value of its
+// parameters.
+func loadBuilderDefinition(buildConfPath string, buildConf *config.BuildConfiguration, update, offline bool) (builder.Definition, error) {
+	lock, err := source.ReadLockfile(source.LockfilePath(buildConfPath))
+	if err != nil {
+		return nil, err
+	}
+	if update {
+		// Unlock the builder and the ones it extends
+		lock.Retain()
+	}
+	lockedCommits := lock.Commits()
+
+	def, err := builder.NewDefinitionFromLocation(buildConf.BuilderName(), buildConf.BuilderLocation(), lock, offline)
+	if err != nil {
+		return nil, err
+	}
+
+	lock.Retain(def.Locations()...)
+	if lock.Changed() {
+		for _, location := range def.Locations() {
+			if commit := lock.Commit(location); len(commit) > 0 && commit != lockedCommits[location] {
+				log.Infof("Locking builder location '%s' at commit '%s'", location, commit)
+			}
+		}
+		if err := lock.Save(); err != nil {
+			return nil, fmt.Errorf("error writing lockfile: %w", err)
+		}
+	}
+
+	if err := def.CheckValidity(buildConf); err != nil {
+		return nil, err
+	}
+	manifest, err := def.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		buildConf.SetDefaults(manifest.Defaults())
+	}
+	return def, nil
+}
+
+func validateCacheLookupErrors(policy string) error {
+	switch builder.CacheLookupErrorPolicy(policy) {
+	case builder.CacheLookupErrorsFail, builder.CacheLookupErrorsWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown cache lookup error policy '%s'", policy)
+}
+
+// useHashCache loads the cache of file digests, unless disabled, and returns a
+// function saving it
+func useHashCache(disabled bool) func() {
+	if disabled {
+		return func() {}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Warnf("Not using the hash cache: %v", err)
+		return func() {}
+	}
+
+	cache := fileutils.LoadHashCache(path.Join(home, ".image-builder", "hash-cache.json"))
+	fileutils.UseHashCache(cache)
+	return func() {
+		fileutils.UseHashCache(nil)
+		if err := cache.Save(); err != nil {
+			log.Warnf("Failed to save the hash cache: %v", err)
+		}
+	}
+}
+
+// useDigestCache loads the cache of the digests external images resolved to,
+// and returns a function saving it
+func useDigestCache() func() {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Warnf("Not using the digest cache: %v", err)
+		return func() {}
+	}
+
+	cache := registry.LoadDigestCache(path.Join(home, ".image-builder", "digest-cache.json"))
+	registry.UseDigestCache(cache)
+	return func() {
+		registry.UseDigestCache(nil)
+		if err := cache.Save(); err != nil {
+			log.Warnf("Failed to save the digest cache: %v", err)
+		}
+	}
+}
+
+// useOfflineMode makes the registry package resolve images from the digest
+// cache and the local image store of the engine, if it has one
+func useOfflineMode(offline bool, engineCli engine.BuildEngine) {
+	if !offline {
+		return
+	}
+	var store registry.LocalImageStore
+	if s, ok := engineCli.(engine.LocalImageStore); ok {
+		store = func(ref string) ([]string, error) {
+			return s.RepoDigests(context.Background(), ref)
+		}
+	}
+	registry.SetOffline(true, store)
+}
+
+// absoluteBuildContext returns the absolute path of a build context directory
+func absoluteBuildContext(buildContext string) (string, error) {
+	if !strings.HasSuffix(buildContext, "/") {
+		buildContext = buildContext + "/"
+	}
+	return filepath.Abs(path.Dir(buildContext))
 }
 
 func generatedTargetName() string {
@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// NewBuilderCmd returns a Cobra command to manage the builder of an
+// application
+func NewBuilderCmd(conf *config.CliConfiguration) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "builder",
+		Short: "Manages the builder of an application",
+	}
+
+	cmd.AddCommand(NewBuilderPushCmd(conf))
+	cmd.AddCommand(NewBuilderUpdateCmd(conf))
+
+	return cmd
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/maxlaverse/image-builder/pkg/builder"
+	"github.com/maxlaverse/image-builder/pkg/builder/source"
+	"github.com/maxlaverse/image-builder/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type builderPushCommandOptions struct {
+	builderPath string
+	reference   string
+}
+
+// NewBuilderPushCmd returns a Cobra command to publish a builder definition
+// to an image registry
+func NewBuilderPushCmd(conf *config.CliConfiguration) *cobra.Command {
+	var opts builderPushCommandOptions
+	cmd := &cobra.Command{
+		Use:          "push <builder-directory> <reference>",
+		Short:        "Packages a builder definition as an OCI artifact and pushes it to an image registry",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("Wrong number of argument")
+			}
+			opts.builderPath = args[0]
+			opts.reference = args[1]
+			return pushBuilder(opts)
+		},
+	}
+
+	return cmd
+}
+
+func pushBuilder(opts builderPushCommandOptions) error {
+	builderPath, err := filepath.Abs(opts.builderPath)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(builderPath)
+	if err := builder.NewDefinitionFromPath(name, builderPath).CheckValidity(nil); err != nil {
+		return err
+	}
+
+	digest, err := source.PushOCI(name, builderPath, opts.reference)
+	if err != nil {
+		return err
+	}
+	log.Infof("Builder '%s' was pushed to '%s' with digest '%s'", name, opts.reference, digest)
+	return nil
+}
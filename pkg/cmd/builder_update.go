@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/maxlaverse/image-builder/pkg/builder/source"
+	"github.com/maxlaverse/image-builder/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type builderUpdateCommandOptions struct {
+	buildConfiguration string
+}
+
+// NewBuilderUpdateCmd returns a Cobra command to update the commit a builder
+// is locked at
+func NewBuilderUpdateCmd(conf *config.CliConfiguration) *cobra.Command {
+	var opts builderUpdateCommandOptions
+	cmd := &cobra.Command{
+		Use:          "update [options]",
+		Short:        "Resolves the builder location again and updates the lockfile",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("Wrong number of argument")
+			}
+			return updateBuilder(opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.buildConfiguration, "build-config", "c", "build.yaml", "Configuration file of the application")
+
+	return cmd
+}
+
+func updateBuilder(opts builderUpdateCommandOptions) error {
+	buildConf, err := config.ReadBuildConfiguration(opts.buildConfiguration)
+	if err != nil {
+		return err
+	}
+
+	location, err := source.ParseBuilderLocation(buildConf.BuilderLocation())
+	if err != nil {
+		return err
+	}
+	if location.Kind != source.LocationGit {
+		log.Infof("Builder location '%s' is not a Git repository and can't be locked", buildConf.BuilderLocation())
+		return nil
+	}
+
+	if _, err := loadBuilderDefinition(opts.buildConfiguration, &buildConf, true, false); err != nil {
+		return err
+	}
+	log.Infof("Builder '%s' is up to date", buildConf.BuilderName())
+	return nil
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/maxlaverse/image-builder/pkg/builder"
+	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/maxlaverse/image-builder/pkg/executor"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type explainHashCommandOptions struct {
+	buildConfiguration string
+	hashScheme         string
+	targetImage        string
+	targetStage        string
+	saveFile           string
+	compareFile        string
+	noHashCache        bool
+	offline            bool
+}
+
+// NewExplainHashCmd returns a Cobra command to display what the Content Hash
+// of a stage is made of
+func NewExplainHashCmd(conf *config.CliConfiguration) *cobra.Command {
+	var opts explainHashCommandOptions
+	cmd := &cobra.Command{
+		Use:              "explain-hash [options] <directory>",
+		Short:            "Displays the inputs of the Content Hash of a stage",
+		TraverseChildren: true,
+		SilenceUsage:     true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("Wrong number of argument")
+			}
+			return validateHashScheme(opts.hashScheme)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return explainHash(opts, args[0])
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.buildConfiguration, "build-config", "c", "build.yaml", "Configuration file of the application")
+	cmd.Flags().StringVarP(&opts.hashScheme, "hash-scheme", "", conf.DefaultHashScheme, "Algorithm used to compute the Content Hash of stages ('v1' or 'v2')")
+	cmd.Flags().StringVarP(&opts.targetImage, "target-image", "t", "", "Name of the image the stage would be built for, as it's part of the Dockerfile of dependent stages")
+	cmd.Flags().StringVarP(&opts.targetStage, "target-stage", "s", "release", "Stage to explain the Content Hash of")
+	cmd.Flags().BoolVarP(&opts.noHashCache, "no-hash-cache", "", false, "Read every file of the build context instead of reusing the digests of unchanged files")
+	cmd.Flags().BoolVarP(&opts.offline, "offline", "", conf.DefaultOffline, "Use cached builder definitions and image digests only, without reaching any registry")
+	cmd.Flags().StringVarP(&opts.saveFile, "save", "", "", "Save the manifest of the Content Hash into a JSON file")
+	cmd.Flags().StringVarP(&opts.compareFile, "compare", "", "", "Compare the manifest of the Content Hash with one previously saved")
+
+	return cmd
+}
+
+func explainHash(opts explainHashCommandOptions, buildContext string) error {
+	buildConf, err := config.ReadBuildConfiguration(opts.buildConfiguration)
+	if err != nil {
+		return err
+	}
+
+	buildContext, err = absoluteBuildContext(buildContext)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.targetImage) == 0 {
+		opts.targetImage = generatedTargetName()
+		log.Infof("No target image name has been provided. Using '%s'", opts.targetImage)
+	}
+
+	builderDef, err := loadBuilderDefinition(opts.buildConfiguration, &buildConf, false, opts.offline)
+	if err != nil {
+		return err
+	}
+
+	defer useHashCache(opts.noHashCache)()
+	defer useDigestCache()()
+	useOfflineMode(opts.offline, nil)
+	buildOpts := builder.BuildOptions{
+		BuildConcurrency: 1,
+		PullConcurrency:  1,
+		DryRun:           true,
+		HashScheme:       fileutils.HashScheme(opts.hashScheme),
+	}
+	b := builder.NewBuild(nil, executor.New(), builderDef, buildConf, buildOpts, opts.targetImage, buildContext)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	manifest, err := b.HashManifest(ctx, opts.targetStage)
+	if err != nil {
+		return err
+	}
+	printHashManifest(manifest)
+
+	if len(opts.compareFile) > 0 {
+		previous, err := builder.ReadHashManifest(opts.compareFile)
+		if err != nil {
+			return err
+		}
+
+		diff := builder.DiffHashManifests(previous, manifest)
+		if len(diff) == 0 {
+			fmt.Printf("\nNo difference with '%s'\n", opts.compareFile)
+		} else {
+			fmt.Printf("\nDifferences with '%s':\n", opts.compareFile)
+			for _, line := range diff {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+	}
+
+	if len(opts.saveFile) > 0 {
+		if err := manifest.Save(opts.saveFile); err != nil {
+			return fmt.Errorf("error saving hash manifest: %w", err)
+		}
+		log.Infof("Hash manifest saved to '%s'", opts.saveFile)
+	}
+	return nil
+}
+
+func printHashManifest(m *builder.HashManifest) {
+	fmt.Printf("Stage:         %s\n", m.Stage)
+	fmt.Printf("Content Hash:  %s\n", m.ContentHash)
+	fmt.Printf("Hash scheme:   %s\n", m.HashScheme)
+	fmt.Printf("Build context: %s\n", m.BuildContext)
+
+	fmt.Printf("\nFiles (%d):\n", len(m.Files))
+	for _, f := range m.Files {
+		if len(f.Link) > 0 {
+			fmt.Printf("  %s %s %s -> %s\n", f.Digest, f.Mode, f.Path, f.Link)
+		} else {
+			fmt.Printf("  %s %s %s (%d bytes)\n", f.Digest, f.Mode, f.Path, f.Size)
+		}
+	}
+
+	fmt.Printf("\nExternal images (%d):\n", len(m.ExternalImages))
+	printSortedMap(m.ExternalImages)
+
+	fmt.Printf("\nBuilder stages (%d):\n", len(m.BuilderStages))
+	printSortedMap(m.BuilderStages)
+
+	fmt.Printf("\nPartials (%d):\n", len(m.Partials))
+	printSortedMap(m.Partials)
+
+	fmt.Printf("\nBuild arguments (%d):\n", len(m.BuildArgs))
+	printSortedMap(m.BuildArgs)
+
+	fmt.Printf("\nPlatforms (%d):\n", len(m.Platforms))
+	printSortedMap(m.Platforms)
+
+	fmt.Printf("\nDockerfile:\n%s\n", m.Dockerfile)
+}
+
+func printSortedMap(m map[string]string) {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s => %s\n", k, m[k])
+	}
+}
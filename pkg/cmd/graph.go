@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/maxlaverse/image-builder/pkg/builder"
+	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/maxlaverse/image-builder/pkg/executor"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
+	"github.com/maxlaverse/image-builder/pkg/template"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type graphCommandOptions struct {
+	buildConfiguration string
+	cacheImagePull     bool
+	cacheLookupErrors  string
+	hashScheme         string
+	targetImage        string
+	targetStages       []string
+	format             string
+	noResolve          bool
+	noHashCache        bool
+	offline            bool
+	localTargetImage   bool
+}
+
+// NewGraphCmd returns a Cobra command to display the dependencies between
+// the stages of a builder
+func NewGraphCmd(conf *config.CliConfiguration) *cobra.Command {
+	var opts graphCommandOptions
+	cmd := &cobra.Command{
+		Use:              "graph [options] <directory>",
+		Short:            "Displays the dependency graph of the stages of a builder",
+		TraverseChildren: true,
+		SilenceUsage:     true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("Wrong number of argument")
+			}
+			switch opts.format {
+			case "dot", "mermaid", "json":
+			default:
+				return fmt.Errorf("unknown format '%s'", opts.format)
+			}
+			if err := validateCacheLookupErrors(opts.cacheLookupErrors); err != nil {
+				return err
+			}
+			return validateHashScheme(opts.hashScheme)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return graph(opts, args[0])
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.buildConfiguration, "build-config", "c", "build.yaml", "Configuration file of the application")
+	cmd.Flags().BoolVarP(&opts.cacheImagePull, "cache-image-pull", "", conf.DefaultCacheImagePull, "Look up the registry for cached images to show the status of stages")
+	cmd.Flags().StringVarP(&opts.cacheLookupErrors, "cache-lookup-errors", "", conf.DefaultCacheLookupErrors, "What to do when a registry fails to tell if a cached image exists ('fail' or 'warn')")
+	cmd.Flags().StringVarP(&opts.hashScheme, "hash-scheme", "", conf.DefaultHashScheme, "Algorithm used to compute the Content Hash of stages ('v1' or 'v2')")
+	cmd.Flags().StringVarP(&opts.targetImage, "target-image", "t", "", "Name of the image the stages would be built for, as it's part of the Dockerfile of dependent stages")
+	cmd.Flags().StringArrayVarP(&opts.targetStages, "target-stages", "s", []string{}, "Only show these stages and the ones they depend on, instead of all the stages of the builder")
+	cmd.Flags().StringVarP(&opts.format, "format", "", "dot", "Format of the graph ('dot', 'mermaid' or 'json')")
+	cmd.Flags().BoolVarP(&opts.noResolve, "no-resolve", "", false, "Use placeholders for ExternalImage and ImageAgeGeneration instead of contacting any registry")
+	cmd.Flags().BoolVarP(&opts.noHashCache, "no-hash-cache", "", false, "Read every file of the build contexts instead of reusing the digests of unchanged files")
+	cmd.Flags().BoolVarP(&opts.offline, "offline", "", conf.DefaultOffline, "Use cached builder definitions and image digests only, without reaching any registry")
+
+	return cmd
+}
+
+func graph(opts graphCommandOptions, buildContext string) error {
+	buildConf, err := config.ReadBuildConfiguration(opts.buildConfiguration)
+	if err != nil {
+		return err
+	}
+
+	buildContext, err = absoluteBuildContext(buildContext)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.targetImage) == 0 {
+		opts.localTargetImage = true
+		opts.targetImage = generatedTargetName()
+		log.Infof("No target image name has been provided. Using '%s'", opts.targetImage)
+	}
+
+	builderDef, err := loadBuilderDefinition(opts.buildConfiguration, &buildConf, false, opts.offline)
+	if err != nil {
+		return err
+	}
+
+	stageNames := opts.targetStages
+	if len(stageNames) == 0 {
+		stageNames, err = builderDef.GetStages()
+		if err != nil {
+			return fmt.Errorf("unable to list the stages of the builder: %w", err)
+		}
+	}
+
+	defer useHashCache(opts.noHashCache)()
+	if opts.noResolve {
+		opts.cacheImagePull = false
+		template.SetPlaceholders(true)
+		defer template.SetPlaceholders(false)
+	} else {
+		if opts.offline {
+			opts.cacheImagePull = false
+		}
+		defer useDigestCache()()
+		useOfflineMode(opts.offline, nil)
+	}
+
+	buildOpts := builder.BuildOptions{
+		BuildConcurrency:  1,
+		PullConcurrency:   1,
+		CacheImagePull:    opts.cacheImagePull,
+		CacheLookupErrors: builder.CacheLookupErrorPolicy(opts.cacheLookupErrors),
+		LocalTargetImage:  opts.localTargetImage,
+		DryRun:            true,
+		HashScheme:        fileutils.HashScheme(opts.hashScheme),
+	}
+	b := builder.NewBuild(nil, executor.New(), builderDef, buildConf, buildOpts, opts.targetImage, buildContext)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	g, err := b.DependencyGraph(ctx, stageNames)
+	if err != nil {
+		return err
+	}
+
+	switch opts.format {
+	case "mermaid":
+		fmt.Print(g.Mermaid())
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(g)
+	default:
+		fmt.Print(g.Dot())
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/maxlaverse/image-builder/pkg/builder"
+	"github.com/maxlaverse/image-builder/pkg/config"
+	"github.com/maxlaverse/image-builder/pkg/executor"
+	"github.com/maxlaverse/image-builder/pkg/fileutils"
+	"github.com/maxlaverse/image-builder/pkg/template"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+type renderCommandOptions struct {
+	buildConfiguration string
+	hashScheme         string
+	targetImage        string
+	targetStages       []string
+	outputDir          string
+	format             string
+	noResolve          bool
+	offline            bool
+	noHashCache        bool
+}
+
+// NewRenderCmd returns a Cobra command to render the Dockerfiles and the build
+// contexts of stages without building them
+func NewRenderCmd(conf *config.CliConfiguration) *cobra.Command {
+	var opts renderCommandOptions
+	cmd := &cobra.Command{
+		Use:              "render [options] <directory>",
+		Short:            "Renders the Dockerfiles and the build contexts of stages",
+		TraverseChildren: true,
+		SilenceUsage:     true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("Wrong number of argument")
+			}
+			if opts.format != "yaml" && opts.format != "json" {
+				return fmt.Errorf("unknown format '%s'", opts.format)
+			}
+			return validateHashScheme(opts.hashScheme)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return render(opts, args[0])
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.buildConfiguration, "build-config", "c", "build.yaml", "Configuration file of the application")
+	cmd.Flags().StringVarP(&opts.hashScheme, "hash-scheme", "", conf.DefaultHashScheme, "Algorithm used to compute the Content Hash of stages ('v1' or 'v2')")
+	cmd.Flags().StringVarP(&opts.targetImage, "target-image", "t", "", "Name of the image the stages would be built for, as it's part of the Dockerfile of dependent stages")
+	cmd.Flags().StringArrayVarP(&opts.targetStages, "target-stages", "s", []string{"release"}, "Stages to render, along with the ones they depend on")
+	cmd.Flags().StringVarP(&opts.outputDir, "output-dir", "o", "", "Write the files of each stage into a folder of this directory, instead of printing them")
+	cmd.Flags().StringVarP(&opts.format, "format", "", "yaml", "Format the stages are printed in ('yaml' or 'json')")
+	cmd.Flags().BoolVarP(&opts.noResolve, "no-resolve", "", false, "Use placeholders for ExternalImage and ImageAgeGeneration instead of contacting any registry")
+	cmd.Flags().BoolVarP(&opts.offline, "offline", "", conf.DefaultOffline, "Use cached builder definitions and image digests only, without reaching any registry")
+	cmd.Flags().BoolVarP(&opts.noHashCache, "no-hash-cache", "", false, "Read every file of the build contexts instead of reusing the digests of unchanged files")
+
+	return cmd
+}
+
+func render(opts renderCommandOptions, buildContext string) error {
+	buildConf, err := config.ReadBuildConfiguration(opts.buildConfiguration)
+	if err != nil {
+		return err
+	}
+
+	buildContext, err = absoluteBuildContext(buildContext)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.targetImage) == 0 {
+		opts.targetImage = generatedTargetName()
+		log.Infof("No target image name has been provided. Using '%s'", opts.targetImage)
+	}
+
+	builderDef, err := loadBuilderDefinition(opts.buildConfiguration, &buildConf, false, opts.offline)
+	if err != nil {
+		return err
+	}
+
+	defer useHashCache(opts.noHashCache)()
+	if opts.noResolve {
+		template.SetPlaceholders(true)
+		defer template.SetPlaceholders(false)
+	} else {
+		defer useDigestCache()()
+		useOfflineMode(opts.offline, nil)
+	}
+
+	buildOpts := builder.BuildOptions{
+		BuildConcurrency: 1,
+		PullConcurrency:  1,
+		DryRun:           true,
+		HashScheme:       fileutils.HashScheme(opts.hashScheme),
+	}
+	b := builder.NewBuild(nil, executor.New(), builderDef, buildConf, buildOpts, opts.targetImage, buildContext)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stages, err := b.RenderStages(ctx, opts.targetStages)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.outputDir) > 0 {
+		for _, stage := range stages {
+			if err := stage.Save(opts.outputDir); err != nil {
+				return fmt.Errorf("error writing the files of stage '%s': %w", stage.Name, err)
+			}
+		}
+		log.Infof("Rendered %d stages into '%s'", len(stages), opts.outputDir)
+		return nil
+	}
+
+	if opts.format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stages)
+	}
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(stages)
+}
@@ -11,8 +11,10 @@ import (
 
 // BuildConfiguration represents the build configuration of an application
 type BuildConfiguration struct {
-	data map[string]interface{}
-	path string
+	data     map[string]interface{}
+	defaults map[string]interface{}
+	node     yaml.Node
+	path     string
 }
 
 // ReadBuildConfiguration unserialize the build configuration
@@ -24,7 +26,11 @@ func ReadBuildConfiguration(filepath string) (BuildConfiguration, error) {
 		return conf, err
 	}
 
-	err = yaml.Unmarshal([]byte(data), &conf.data)
+	err = yaml.Unmarshal([]byte(data), &conf.node)
+	if err != nil {
+		return conf, err
+	}
+	err = conf.node.Decode(&conf.data)
 	if err != nil {
 		return conf, err
 	}
@@ -32,6 +38,11 @@ func ReadBuildConfiguration(filepath string) (BuildConfiguration, error) {
 	return conf, nil
 }
 
+// Path returns the path of the configuration file
+func (c *BuildConfiguration) Path() string {
+	return c.path
+}
+
 // BuilderName returns the builder's name
 func (c *BuildConfiguration) BuilderName() string {
 	return utils.KeyValueOrEmpty(c.data, "builderName")
@@ -57,8 +68,95 @@ func (c *BuildConfiguration) IncludePatterns(stageName string) []string {
 	return c.MergedStringSpecAttribute(stageName, "contextInclude")
 }
 
+// ExcludePatterns returns the files to exclude from the Docker context
+func (c *BuildConfiguration) ExcludePatterns(stageName string) []string {
+	return c.MergedStringSpecAttribute(stageName, "contextExclude")
+}
+
+// HonorIgnoreFiles returns whether the .gitignore and .dockerignore files of
+// the application should be used to exclude files from the Docker context
+func (c *BuildConfiguration) HonorIgnoreFiles(stageName string) bool {
+	v, ok := c.SpecAttribute(stageName, "contextHonorIgnoreFiles")
+	if !ok {
+		return false
+	}
+	honor, _ := v.(bool)
+	return honor
+}
+
+// BuildArgs returns the build arguments of a stage. The ones of the stage
+// override the global ones with the same name.
+func (c *BuildConfiguration) BuildArgs(stageName string) (map[string]string, error) {
+	args := map[string]string{}
+	for _, section := range []string{"globalSpec", fmt.Sprintf("%sSpec", stageName)} {
+		spec, ok := c.data[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		v, ok := spec["buildArgs"]
+		if !ok {
+			continue
+		}
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'buildArgs' in '%s' must be a map of build arguments", section)
+		}
+		for name, value := range values {
+			switch value.(type) {
+			case string, int, float64, bool:
+				args[name] = fmt.Sprint(value)
+			default:
+				return nil, fmt.Errorf("build argument '%s' in '%s' must be a string", name, section)
+			}
+		}
+	}
+	return args, nil
+}
+
+// Platforms returns the platforms a stage is built for, or nil if it's built
+// for the platform of the engine only. The platforms of a stage replace the
+// global ones.
+func (c *BuildConfiguration) Platforms(stageName string) ([]string, error) {
+	v, ok := c.SpecAttribute(stageName, "platforms")
+	if !ok || v == nil {
+		return nil, nil
+	}
+	switch values := v.(type) {
+	case string:
+		return splitPlatforms(values), nil
+	case []interface{}:
+		platforms := []string{}
+		for _, value := range values {
+			platform, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("'platforms' of stage '%s' must be a list of platforms", stageName)
+			}
+			platforms = append(platforms, splitPlatforms(platform)...)
+		}
+		return platforms, nil
+	default:
+		return nil, fmt.Errorf("'platforms' of stage '%s' must be a list of platforms", stageName)
+	}
+}
+
+func splitPlatforms(value string) []string {
+	platforms := []string{}
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			platforms = append(platforms, p)
+		}
+	}
+	return platforms
+}
+
+// SetDefaults sets the values of the attributes that are neither specified
+// for a stage nor globally
+func (c *BuildConfiguration) SetDefaults(defaults map[string]interface{}) {
+	c.defaults = defaults
+}
+
 // SpecAttribute returns the stage attribute of the configuration or
-// a global one if it exists
+// a global one if it exists, or its default value
 func (c *BuildConfiguration) SpecAttribute(stageName, attrName string) (interface{}, bool) {
 	if v, ok := c.data[fmt.Sprintf("%sSpec", stageName)]; ok {
 		if v, ok := v.(map[string]interface{})[attrName]; ok {
@@ -71,9 +169,59 @@ func (c *BuildConfiguration) SpecAttribute(stageName, attrName string) (interfac
 			return v2, true
 		}
 	}
+
+	if v, ok := c.defaults[attrName]; ok {
+		return v, true
+	}
 	return nil, false
 }
 
+// Specs returns the attributes of each section of the configuration holding
+// a spec, e.g 'globalSpec' or 'releaseSpec'
+func (c *BuildConfiguration) Specs() map[string]map[string]interface{} {
+	specs := map[string]map[string]interface{}{}
+	for key, v := range c.data {
+		if !strings.HasSuffix(key, "Spec") {
+			continue
+		}
+		if attrs, ok := v.(map[string]interface{}); ok {
+			specs[key] = attrs
+		} else {
+			specs[key] = map[string]interface{}{}
+		}
+	}
+	return specs
+}
+
+// Line returns the line of a key in the configuration file, given the keys
+// of its parents. The line of the closest parent is returned if the key is
+// missing, and 0 if none of them exists.
+func (c *BuildConfiguration) Line(keys ...string) int {
+	node := &c.node
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, key := range keys {
+		if node.Kind != yaml.MappingNode {
+			return line
+		}
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line = node.Content[i].Line
+				value = node.Content[i+1]
+				break
+			}
+		}
+		if value == nil {
+			return line
+		}
+		node = value
+	}
+	return line
+}
+
 // MergedStringSpecAttribute returns an array of merge attributes from the stage
 // and the globalSpec
 func (c *BuildConfiguration) MergedStringSpecAttribute(stageName, attrName string) []string {
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"io/ioutil"
+	"path"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestReadingEmptyConfigurationDoesntCrash(t *testing.T) {
@@ -14,7 +18,113 @@ func TestReadingEmptyConfigurationDoesntCrash(t *testing.T) {
 	conf.BuilderLocation()
 	conf.BuilderName()
 	conf.IncludePatterns("")
+	conf.ExcludePatterns("")
+	conf.HonorIgnoreFiles("")
 	conf.IsBuilderCacheSet()
 	conf.SpecAttribute("", "")
 	conf.SpecAttributeNames("")
 }
+
+func TestContextExclusions(t *testing.T) {
+	conf := BuildConfiguration{
+		data: map[string]interface{}{
+			"globalSpec": map[string]interface{}{
+				"contextExclude":          []interface{}{"log/**"},
+				"contextHonorIgnoreFiles": true,
+			},
+			"releaseSpec": map[string]interface{}{
+				"contextExclude":          []interface{}{"spec/**"},
+				"contextHonorIgnoreFiles": false,
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"log/**", "spec/**"}, conf.ExcludePatterns("release"))
+	assert.Equal(t, []string{"log/**"}, conf.ExcludePatterns("test"))
+	assert.False(t, conf.HonorIgnoreFiles("release"))
+	assert.True(t, conf.HonorIgnoreFiles("test"))
+}
+
+func TestBuildArgs(t *testing.T) {
+	conf := BuildConfiguration{
+		data: map[string]interface{}{
+			"globalSpec": map[string]interface{}{
+				"buildArgs": map[string]interface{}{"RUBY_VERSION": "3.1", "BUNDLE_JOBS": 4},
+			},
+			"releaseSpec": map[string]interface{}{
+				"buildArgs": map[string]interface{}{"BUNDLE_JOBS": 8},
+			},
+			"testSpec": map[string]interface{}{
+				"buildArgs": []interface{}{"RAILS_ENV=test"},
+			},
+		},
+	}
+
+	args, err := conf.BuildArgs("release")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"RUBY_VERSION": "3.1", "BUNDLE_JOBS": "8"}, args)
+
+	_, err = conf.BuildArgs("test")
+	assert.EqualError(t, err, "'buildArgs' in 'testSpec' must be a map of build arguments")
+}
+
+func TestPlatforms(t *testing.T) {
+	conf := BuildConfiguration{
+		data: map[string]interface{}{
+			"globalSpec": map[string]interface{}{
+				"platforms": []interface{}{"linux/amd64", "linux/arm64"},
+			},
+			"baseSpec": map[string]interface{}{
+				"platforms": "linux/amd64, linux/arm/v7",
+			},
+			"testSpec": map[string]interface{}{
+				"platforms": 64,
+			},
+		},
+	}
+
+	platforms, err := conf.Platforms("release")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, platforms)
+
+	platforms, err = conf.Platforms("base")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm/v7"}, platforms)
+
+	_, err = conf.Platforms("test")
+	assert.EqualError(t, err, "'platforms' of stage 'test' must be a list of platforms")
+
+	platforms, err = (&BuildConfiguration{}).Platforms("release")
+	assert.NoError(t, err)
+	assert.Nil(t, platforms)
+}
+
+func TestSpecAttributeDefaults(t *testing.T) {
+	conf := BuildConfiguration{
+		data: map[string]interface{}{
+			"globalSpec": map[string]interface{}{
+				"osRelease": "buster",
+			},
+		},
+	}
+	conf.SetDefaults(map[string]interface{}{"osRelease": "bullseye", "debug": false})
+
+	osRelease, _ := conf.SpecAttribute("release", "osRelease")
+	assert.Equal(t, "buster", osRelease)
+	debug, ok := conf.SpecAttribute("release", "debug")
+	assert.True(t, ok)
+	assert.Equal(t, false, debug)
+}
+
+func TestLine(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "build.yaml")
+	assert.NoError(t, ioutil.WriteFile(filepath, []byte("builderName: go\nglobalSpec:\n  osRelease: buster\n"), 0644))
+	conf, err := ReadBuildConfiguration(filepath)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, conf.Line("globalSpec"))
+	assert.Equal(t, 3, conf.Line("globalSpec", "osRelease"))
+	assert.Equal(t, 2, conf.Line("globalSpec", "missing"))
+	assert.Equal(t, 0, conf.Line("releaseSpec", "osRelease"))
+	assert.Equal(t, map[string]map[string]interface{}{"globalSpec": {"osRelease": "buster"}}, conf.Specs())
+}
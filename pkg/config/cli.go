@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 
+	"github.com/maxlaverse/image-builder/pkg/engine"
 	"gopkg.in/yaml.v3"
 )
 
@@ -16,6 +17,11 @@ type CliConfiguration struct {
 	DefaultCacheImagePush    bool   `yaml:"default-cache-image-push"`
 	DefaultCacheImagePull    bool   `yaml:"default-cache-image-pull"`
 	DefaultEngine            string `yaml:"default-engine"`
+	DefaultBuildkitAddress   string `yaml:"default-buildkit-address"`
+	DefaultDaemonless        bool   `yaml:"default-daemonless"`
+	DefaultHashScheme        string `yaml:"default-hash-scheme"`
+	DefaultCacheLookupErrors string `yaml:"default-cache-lookup-errors"`
+	DefaultOffline           bool   `yaml:"default-offline"`
 	filepath                 string
 }
 
@@ -53,10 +59,13 @@ func (c *CliConfiguration) Save() error {
 
 func NewDefaultConfiguration() *CliConfiguration {
 	return &CliConfiguration{
-		DefaultCacheImagePull:   true,
-		DefaultCacheImagePush:   true,
-		DefaultEngine:           "docker",
-		DefaultBuildConcurrency: 1,
-		DefaultPullConcurrency:  1,
+		DefaultCacheImagePull:    true,
+		DefaultCacheImagePush:    true,
+		DefaultEngine:            "docker",
+		DefaultBuildkitAddress:   engine.DefaultBuildkitAddress,
+		DefaultBuildConcurrency:  1,
+		DefaultPullConcurrency:   1,
+		DefaultHashScheme:        "v2",
+		DefaultCacheLookupErrors: "fail",
 	}
 }
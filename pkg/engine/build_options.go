@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// BuildOptions holds the settings of a single image build
+type BuildOptions struct {
+	// BuildArgs are the values of the ARG instructions of the Dockerfile
+	BuildArgs map[string]string
+
+	// Secrets are mounted by 'RUN --mount=type=secret' instructions, without
+	// being stored in the image
+	Secrets []Secret
+
+	// SSH are the SSH agents or keys forwarded to 'RUN --mount=type=ssh'
+	// instructions
+	SSH []SSH
+
+	// Platform is the platform to build the image for, as in 'linux/arm64'.
+	// The platform of the engine is used if empty.
+	Platform string
+
+	// Labels are added to the image on top of the ones of its Dockerfile
+	Labels map[string]string
+}
+
+// Secret is a value read from a file or an environment variable. Only its
+// source is known to image-builder, never its value.
+type Secret struct {
+	ID   string
+	File string
+	Env  string
+}
+
+// SSH is an SSH agent socket, or a list of keys, forwarded to a build. No path
+// means the agent of SSH_AUTH_SOCK.
+type SSH struct {
+	ID    string
+	Paths []string
+}
+
+// ParseSecret parses a secret in the format of 'docker build --secret', i.e
+// 'id=<id>,src=<file>' or 'id=<id>,env=<variable>'. The ID is used as
+// environment variable if no source is given.
+func ParseSecret(value string) (Secret, error) {
+	s := Secret{}
+	for _, field := range strings.Split(value, ",") {
+		key, val, ok := cut(field, "=")
+		if !ok || len(val) == 0 {
+			return s, fmt.Errorf("invalid secret '%s': expected 'id=<id>,src=<file>' or 'id=<id>,env=<variable>'", value)
+		}
+		switch key {
+		case "id":
+			s.ID = val
+		case "src", "source":
+			s.File = val
+		case "env":
+			s.Env = val
+		default:
+			return s, fmt.Errorf("invalid secret '%s': unknown key '%s'", value, key)
+		}
+	}
+	if len(s.ID) == 0 {
+		return s, fmt.Errorf("invalid secret '%s': missing id", value)
+	}
+	if len(s.File) > 0 && len(s.Env) > 0 {
+		return s, fmt.Errorf("invalid secret '%s': only one of src and env can be set", value)
+	}
+	if len(s.File) == 0 && len(s.Env) == 0 {
+		s.Env = s.ID
+	}
+	return s, nil
+}
+
+// ParseSSH parses an SSH agent or keys in the format of 'docker build --ssh',
+// i.e 'default' or '<id>=<socket>|<key>[,<key>]'
+func ParseSSH(value string) (SSH, error) {
+	id, paths, _ := cut(value, "=")
+	if len(id) == 0 {
+		return SSH{}, fmt.Errorf("invalid ssh '%s': expected 'default' or '<id>=<socket>|<key>[,<key>]'", value)
+	}
+	s := SSH{ID: id}
+	if len(paths) > 0 {
+		s.Paths = strings.Split(paths, ",")
+	}
+	return s, nil
+}
+
+// String returns the secret in the format of 'docker build --secret'
+func (s Secret) String() string {
+	if len(s.File) > 0 {
+		return fmt.Sprintf("id=%s,src=%s", s.ID, s.File)
+	}
+	return fmt.Sprintf("id=%s,env=%s", s.ID, s.Env)
+}
+
+// String returns the SSH agent in the format of 'docker build --ssh'
+func (s SSH) String() string {
+	if len(s.Paths) == 0 {
+		return s.ID
+	}
+	return s.ID + "=" + strings.Join(s.Paths, ",")
+}
+
+// cliArgs returns the flags passing the options to the command line of an
+// engine. The values of secrets are never part of them, only their source.
+// Engines that can't read a secret from an environment variable get it with
+// 'type=env'.
+func (o BuildOptions) cliArgs(envSecretType bool) ([]string, error) {
+	args := []string{}
+	if len(o.Platform) > 0 {
+		args = append(args, "--platform", o.Platform)
+	}
+
+	for _, name := range sortedKeys(o.BuildArgs) {
+		args = append(args, "--build-arg", name+"="+o.BuildArgs[name])
+	}
+	for _, name := range sortedKeys(o.Labels) {
+		args = append(args, "--label", name+"="+o.Labels[name])
+	}
+
+	for _, s := range o.Secrets {
+		if len(s.File) > 0 {
+			if _, err := os.Stat(s.File); err != nil {
+				return nil, fmt.Errorf("invalid secret '%s': %w", s.ID, err)
+			}
+			args = append(args, "--secret", s.String())
+		} else if _, ok := os.LookupEnv(s.Env); !ok {
+			return nil, fmt.Errorf("invalid secret '%s': environment variable '%s' is not set", s.ID, s.Env)
+		} else if envSecretType {
+			args = append(args, "--secret", fmt.Sprintf("id=%s,src=%s,type=env", s.ID, s.Env))
+		} else {
+			args = append(args, "--secret", s.String())
+		}
+	}
+
+	for _, s := range o.SSH {
+		args = append(args, "--ssh", s.String())
+	}
+	return args, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecret(t *testing.T) {
+	for value, expected := range map[string]Secret{
+		"id=gem_token,src=/run/token": {ID: "gem_token", File: "/run/token"},
+		"id=gem_token,env=GEM_TOKEN":  {ID: "gem_token", Env: "GEM_TOKEN"},
+		"id=GEM_TOKEN":                {ID: "GEM_TOKEN", Env: "GEM_TOKEN"},
+	} {
+		secret, err := ParseSecret(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, secret, value)
+	}
+
+	for value, expected := range map[string]string{
+		"src=/run/token":                    "invalid secret 'src=/run/token': missing id",
+		"id=token,src=/run/token,env=TOKEN": "invalid secret 'id=token,src=/run/token,env=TOKEN': only one of src and env can be set",
+		"id=token,type=file":                "invalid secret 'id=token,type=file': unknown key 'type'",
+		"gem_token":                         "invalid secret 'gem_token': expected 'id=<id>,src=<file>' or 'id=<id>,env=<variable>'",
+	} {
+		_, err := ParseSecret(value)
+		assert.EqualError(t, err, expected, value)
+	}
+}
+
+func TestParseSSH(t *testing.T) {
+	ssh, err := ParseSSH("default")
+	assert.NoError(t, err)
+	assert.Equal(t, SSH{ID: "default"}, ssh)
+
+	ssh, err = ParseSSH("github=/home/app/.ssh/id_rsa,/home/app/.ssh/id_ed25519")
+	assert.NoError(t, err)
+	assert.Equal(t, SSH{ID: "github", Paths: []string{"/home/app/.ssh/id_rsa", "/home/app/.ssh/id_ed25519"}}, ssh)
+
+	_, err = ParseSSH("=/tmp/agent.sock")
+	assert.Error(t, err)
+}
+
+func TestBuildOptionsCliArgs(t *testing.T) {
+	t.Setenv("GEM_TOKEN", "very-secret-value")
+	opts := BuildOptions{
+		BuildArgs: map[string]string{"RUBY_VERSION": "3.1", "BUNDLE_JOBS": "4"},
+		Secrets:   []Secret{{ID: "gem_token", Env: "GEM_TOKEN"}},
+		SSH:       []SSH{{ID: "default"}},
+		Platform:  "linux/arm64",
+		Labels:    map[string]string{"org.opencontainers.image.title": "release"},
+	}
+
+	args, err := opts.cliArgs(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--platform", "linux/arm64", "--build-arg", "BUNDLE_JOBS=4", "--build-arg", "RUBY_VERSION=3.1", "--label", "org.opencontainers.image.title=release", "--secret", "id=gem_token,env=GEM_TOKEN", "--ssh", "default"}, args)
+
+	args, err = opts.cliArgs(true)
+	assert.NoError(t, err)
+	assert.Contains(t, args, "id=gem_token,src=GEM_TOKEN,type=env")
+
+	_, err = BuildOptions{Secrets: []Secret{{ID: "token", Env: "MISSING_TOKEN"}}}.cliArgs(false)
+	assert.EqualError(t, err, "invalid secret 'token': environment variable 'MISSING_TOKEN' is not set")
+
+	_, err = BuildOptions{Secrets: []Secret{{ID: "token", File: "/does/not/exist"}}}.cliArgs(false)
+	assert.EqualError(t, err, "invalid secret 'token': stat /does/not/exist: no such file or directory")
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 
@@ -18,8 +19,8 @@ func newbuildahCli(exec executor.Executor) BuildEngine {
 	return &buildahCli{exec: exec}
 }
 
-func (cli *buildahCli) cmd(args ...string) error {
-	cmd := cli.exec.NewCommand("buildah", args...)
+func (cli *buildahCli) cmd(ctx context.Context, args ...string) error {
+	cmd := cli.exec.NewCommandContext(ctx, "buildah", args...)
 	var out bytes.Buffer
 
 	if log.GetLevel() >= log.InfoLevel {
@@ -34,24 +35,28 @@ func (cli *buildahCli) cmd(args ...string) error {
 	return err
 }
 
-func (cli *buildahCli) Build(dockerfile, image, context string) error {
-	return cli.cmd("build-using-dockerfile", "-f", dockerfile, "-t", image, context)
+func (cli *buildahCli) Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	args, err := opts.cliArgs(true)
+	if err != nil {
+		return err
+	}
+	return cli.cmd(ctx, append(append([]string{"build-using-dockerfile", "-f", dockerfile, "-t", image}, args...), dir)...)
 }
 
 func (cli *buildahCli) Name() string {
 	return "buildah"
 }
 
-func (cli *buildahCli) Push(image string) error {
-	return cli.cmd("push", image)
+func (cli *buildahCli) Push(ctx context.Context, image string) error {
+	return cli.cmd(ctx, "push", image)
 }
 
-func (cli *buildahCli) Pull(image string) error {
-	return cli.cmd("pull", image)
+func (cli *buildahCli) Pull(ctx context.Context, image string) error {
+	return cli.cmd(ctx, "pull", image)
 }
 
-func (cli *buildahCli) Tag(src, dst string) error {
-	return cli.cmd("tag", src, dst)
+func (cli *buildahCli) Tag(ctx context.Context, src, dst string) error {
+	return cli.cmd(ctx, "tag", src, dst)
 }
 
 func (cli *buildahCli) Version() (string, error) {
@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxlaverse/image-builder/pkg/registry"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	fstypes "github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultBuildkitAddress is the address buildkitd listens on by default
+	DefaultBuildkitAddress = "unix:///run/buildkit/buildkitd.sock"
+
+	buildkitFrontend        = "dockerfile.v0"
+	buildkitLocalContext    = "context"
+	buildkitLocalDockerfile = "dockerfile"
+	buildkitWorkerLabel     = "org.mobyproject.buildkit.worker.executor"
+)
+
+// buildkit is an engine talking directly to a buildkitd daemon over its gRPC
+// API. Buildkitd has no local image store that subsequent builds could use,
+// which is why images are pushed to the registry as soon as they are built.
+type buildkit struct {
+	address   string
+	cacheFrom []client.CacheOptionsEntry
+	cacheTo   []client.CacheOptionsEntry
+	pushed    sync.Map
+}
+
+// newBuildkit returns a new engine based on buildkitd
+func newBuildkit(opts Options) (BuildEngine, error) {
+	cacheFrom, err := parseCacheOptions(opts.CacheFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache import: %w", err)
+	}
+	cacheTo, err := parseCacheOptions(opts.CacheTo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache export: %w", err)
+	}
+
+	address := opts.BuildkitAddress
+	if len(address) == 0 {
+		address = DefaultBuildkitAddress
+	}
+	return &buildkit{
+		address:   address,
+		cacheFrom: cacheFrom,
+		cacheTo:   cacheTo,
+	}, nil
+}
+
+func (cli *buildkit) client(ctx context.Context) (*client.Client, error) {
+	c, err := client.New(ctx, cli.address, client.WithFailFast())
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to buildkitd at '%s': %w", cli.address, err)
+	}
+	return c, nil
+}
+
+func (cli *buildkit) Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	return cli.BuildWithFileList(ctx, dockerfile, image, dir, nil, opts)
+}
+
+// BuildWithFileList sends only the given files of the context directory to
+// buildkitd. A nil list sends the whole directory.
+func (cli *buildkit) BuildWithFileList(ctx context.Context, dockerfile, image, dir string, files []string, opts BuildOptions) error {
+	attachables, err := sessionAttachables(opts)
+	if err != nil {
+		return err
+	}
+
+	c, err := cli.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	dirs := []filesync.SyncedDir{
+		{Name: buildkitLocalContext, Dir: dir, Excludes: contextExcludes(files), Map: resetUIDAndGID},
+		{Name: buildkitLocalDockerfile, Dir: filepath.Dir(dockerfile), Map: resetUIDAndGID},
+	}
+	frontendAttrs := map[string]string{
+		"filename": filepath.Base(dockerfile),
+	}
+	for name, value := range opts.BuildArgs {
+		frontendAttrs["build-arg:"+name] = value
+	}
+	for name, value := range opts.Labels {
+		frontendAttrs["label:"+name] = value
+	}
+	if len(opts.Platform) > 0 {
+		frontendAttrs["platform"] = opts.Platform
+	}
+	solveOpt := client.SolveOpt{
+		Frontend:      buildkitFrontend,
+		FrontendAttrs: frontendAttrs,
+		Exports: []client.ExportEntry{
+			{
+				Type: client.ExporterImage,
+				Attrs: map[string]string{
+					"name": image,
+					"push": "true",
+				},
+			},
+		},
+		CacheImports: cli.cacheFrom,
+		CacheExports: cli.cacheTo,
+		Session: append([]session.Attachable{
+			filesync.NewFSSyncProvider(dirs),
+			authprovider.NewDockerAuthProvider(nil),
+		}, attachables...),
+	}
+
+	statusCh := make(chan *client.SolveStatus)
+	g, ctx := errgroup.WithContext(ctx)
+	var resp *client.SolveResponse
+	g.Go(func() error {
+		var err error
+		resp, err = c.Solve(ctx, nil, solveOpt, statusCh)
+		return err
+	})
+	g.Go(func() error {
+		logProgress(image, statusCh)
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("error while building '%s' with buildkit: %w", image, err)
+	}
+
+	cli.pushed.Store(image, struct{}{})
+	log.WithField("image", image).Debugf("Pushed with digest %s", resp.ExporterResponse["containerimage.digest"])
+	return nil
+}
+
+// sessionAttachables returns the providers of the secrets and SSH agents of a
+// build. Buildkitd reads the secrets through them when a RUN instruction
+// mounts them.
+func sessionAttachables(opts BuildOptions) ([]session.Attachable, error) {
+	attachables := []session.Attachable{}
+	if len(opts.Secrets) > 0 {
+		sources := []secretsprovider.Source{}
+		for _, s := range opts.Secrets {
+			if len(s.Env) > 0 {
+				if _, ok := os.LookupEnv(s.Env); !ok {
+					return nil, fmt.Errorf("invalid secret '%s': environment variable '%s' is not set", s.ID, s.Env)
+				}
+			}
+			sources = append(sources, secretsprovider.Source{ID: s.ID, FilePath: s.File, Env: s.Env})
+		}
+		store, err := secretsprovider.NewStore(sources)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secrets: %w", err)
+		}
+		attachables = append(attachables, secretsprovider.NewSecretProvider(store))
+	}
+
+	if len(opts.SSH) > 0 {
+		configs := []sshprovider.AgentConfig{}
+		for _, s := range opts.SSH {
+			configs = append(configs, sshprovider.AgentConfig{ID: s.ID, Paths: s.Paths})
+		}
+		provider, err := sshprovider.NewSSHAgentProvider(configs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh: %w", err)
+		}
+		attachables = append(attachables, provider)
+	}
+	return attachables, nil
+}
+
+func (cli *buildkit) Name() string {
+	return "buildkit"
+}
+
+// Push verifies that the image was pushed when it was built
+func (cli *buildkit) Push(ctx context.Context, image string) error {
+	if _, ok := cli.pushed.Load(image); !ok {
+		return fmt.Errorf("image '%s' was not built by buildkit and can't be pushed", image)
+	}
+	log.Debugf("Image '%s' has already been pushed by buildkit", image)
+	return nil
+}
+
+// Pull is a noop since buildkitd pulls base images from the registry on its own
+func (cli *buildkit) Pull(ctx context.Context, image string) error {
+	log.Debugf("Not pulling '%s', buildkitd will fetch it from the registry if needed", image)
+	return nil
+}
+
+// Tag copies an image within the registry, as there is no local image store
+func (cli *buildkit) Tag(ctx context.Context, src, dst string) error {
+	return registry.CopyImage(ctx, src, dst)
+}
+
+func (cli *buildkit) Version() (string, error) {
+	ctx := context.Background()
+	c, err := cli.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	workers, err := c.ListWorkers(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to list buildkitd workers: %w", err)
+	}
+	if len(workers) == 0 {
+		return "", fmt.Errorf("buildkitd at '%s' has no workers", cli.address)
+	}
+	if executor, ok := workers[0].Labels[buildkitWorkerLabel]; ok {
+		return executor, nil
+	}
+	return "unknown", nil
+}
+
+// logProgress logs the progress of every step of a build as they complete
+func logProgress(image string, statusCh chan *client.SolveStatus) {
+	logger := log.WithField("image", image)
+	completed := map[digest.Digest]struct{}{}
+	for status := range statusCh {
+		for _, v := range status.Vertexes {
+			if _, ok := completed[v.Digest]; ok {
+				continue
+			}
+			stepLogger := logger.WithField("step", v.Name)
+			if len(v.Error) > 0 {
+				completed[v.Digest] = struct{}{}
+				stepLogger.Errorf("Step failed: %s", v.Error)
+			} else if v.Cached {
+				completed[v.Digest] = struct{}{}
+				stepLogger.Info("Step cached")
+			} else if v.Completed != nil {
+				completed[v.Digest] = struct{}{}
+				var duration time.Duration
+				if v.Started != nil {
+					duration = v.Completed.Sub(*v.Started).Round(time.Millisecond)
+				}
+				stepLogger.WithField("duration", duration).Info("Step done")
+			} else if v.Started != nil {
+				stepLogger.Debug("Step started")
+			}
+		}
+		for _, l := range status.Logs {
+			logger.WithField("vertex", l.Vertex).Trace(strings.TrimSuffix(string(l.Data), "\n"))
+		}
+	}
+}
+
+// contextExcludes converts a list of files to include into exclude patterns
+// understood by buildkit, like a .dockerignore would
+func contextExcludes(files []string) []string {
+	if files == nil {
+		return nil
+	}
+	excludes := []string{"*"}
+	for _, f := range files {
+		excludes = append(excludes, "!"+f)
+	}
+	return excludes
+}
+
+// parseCacheOptions parses cache options in the format used by buildx, e.g
+// 'type=registry,ref=registry.local/app:cache,mode=max'. A value without any
+// '=' is considered as being the reference of a registry cache.
+func parseCacheOptions(values []string) ([]client.CacheOptionsEntry, error) {
+	entries := []client.CacheOptionsEntry{}
+	for _, value := range values {
+		if !strings.Contains(value, "=") {
+			entries = append(entries, client.CacheOptionsEntry{Type: "registry", Attrs: map[string]string{"ref": value}})
+			continue
+		}
+
+		entry := client.CacheOptionsEntry{Attrs: map[string]string{}}
+		for _, field := range strings.Split(value, ",") {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid field '%s' in '%s'", field, value)
+			}
+			if parts[0] == "type" {
+				entry.Type = parts[1]
+			} else {
+				entry.Attrs[parts[0]] = parts[1]
+			}
+		}
+		if len(entry.Type) == 0 {
+			return nil, fmt.Errorf("missing type in '%s'", value)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func resetUIDAndGID(_ string, st *fstypes.Stat) bool {
+	st.Uid = 0
+	st.Gid = 0
+	return true
+}
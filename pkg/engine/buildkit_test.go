@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	apitypes "github.com/moby/buildkit/api/types"
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+type fakeBuildkitd struct {
+	controlapi.UnimplementedControlServer
+	requests []*controlapi.SolveRequest
+	mux      sync.Mutex
+}
+
+func (f *fakeBuildkitd) Solve(ctx context.Context, req *controlapi.SolveRequest) (*controlapi.SolveResponse, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.requests = append(f.requests, req)
+	return &controlapi.SolveResponse{ExporterResponse: map[string]string{"containerimage.digest": "sha256:fake"}}, nil
+}
+
+func (f *fakeBuildkitd) Status(req *controlapi.StatusRequest, stream controlapi.Control_StatusServer) error {
+	now := time.Now()
+	return stream.Send(&controlapi.StatusResponse{
+		Vertexes: []*controlapi.Vertex{
+			{Digest: "sha256:step", Name: "[1/1] FROM scratch", Started: &now, Completed: &now},
+		},
+	})
+}
+
+func (f *fakeBuildkitd) Session(stream controlapi.Control_SessionServer) error {
+	return nil
+}
+
+func (f *fakeBuildkitd) ListWorkers(ctx context.Context, req *controlapi.ListWorkersRequest) (*controlapi.ListWorkersResponse, error) {
+	return &controlapi.ListWorkersResponse{
+		Record: []*apitypes.WorkerRecord{{ID: "fake", Labels: map[string]string{buildkitWorkerLabel: "oci"}}},
+	}, nil
+}
+
+func startFakeBuildkitd(t *testing.T) (*fakeBuildkitd, string) {
+	dir, err := ioutil.TempDir("", "buildkitd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := path.Join(dir, "buildkitd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeBuildkitd{}
+	server := grpc.NewServer()
+	controlapi.RegisterControlServer(server, fake)
+	go server.Serve(l)
+	t.Cleanup(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+	return fake, "unix://" + socket
+}
+
+func TestBuildkitVersion(t *testing.T) {
+	_, address := startFakeBuildkitd(t)
+	e, err := New("buildkit", nil, Options{BuildkitAddress: address})
+	assert.NoError(t, err)
+
+	version, err := e.Version()
+	assert.NoError(t, err)
+	assert.Equal(t, "oci", version)
+}
+
+func TestBuildkitBuild(t *testing.T) {
+	fake, address := startFakeBuildkitd(t)
+	e, err := New("buildkit", nil, Options{
+		BuildkitAddress: address,
+		CacheFrom:       []string{"registry.local/app:cache"},
+		CacheTo:         []string{"type=registry,ref=registry.local/app:cache,mode=max"},
+	})
+	assert.NoError(t, err)
+
+	err = e.(FileListBuilder).BuildWithFileList(context.Background(), "../../fixtures/concurrency/final/Dockerfile", "registry.local/app:final", "../../fixtures/folder-listing", []string{"some-file"}, BuildOptions{})
+	assert.NoError(t, err)
+	if !assert.Len(t, fake.requests, 1) {
+		return
+	}
+
+	req := fake.requests[0]
+	assert.Equal(t, "dockerfile.v0", req.Frontend)
+	assert.Equal(t, "Dockerfile", req.FrontendAttrs["filename"])
+	assert.Equal(t, client.ExporterImage, req.Exporter)
+	assert.Equal(t, map[string]string{"name": "registry.local/app:final", "push": "true"}, req.ExporterAttrs)
+	assert.Equal(t, []string{"registry.local/app:cache"}, req.Cache.ImportRefsDeprecated)
+	assert.Equal(t, "registry.local/app:cache", req.Cache.ExportRefDeprecated)
+	assert.Equal(t, map[string]string{"mode": "max"}, req.Cache.ExportAttrsDeprecated)
+
+	assert.NoError(t, e.Push(context.Background(), "registry.local/app:final"))
+	assert.Error(t, e.Push(context.Background(), "registry.local/app:other"))
+}
+
+func TestBuildkitUnreachable(t *testing.T) {
+	e, err := New("buildkit", nil, Options{BuildkitAddress: "unix:///nonexistent/buildkitd.sock"})
+	assert.NoError(t, err)
+
+	err = e.Build(context.Background(), "../../fixtures/concurrency/final/Dockerfile", "registry.local/app:final", "../../fixtures/empty", BuildOptions{})
+	assert.Error(t, err)
+}
+
+func TestParseCacheOptions(t *testing.T) {
+	_, err := parseCacheOptions([]string{"ref=registry.local/app:cache"})
+	assert.EqualError(t, err, "missing type in 'ref=registry.local/app:cache'")
+
+	_, err = parseCacheOptions([]string{"type=registry,mode"})
+	assert.EqualError(t, err, "invalid field 'mode' in 'type=registry,mode'")
+}
+
+func TestContextExcludes(t *testing.T) {
+	assert.Nil(t, contextExcludes(nil))
+	assert.Equal(t, []string{"*"}, contextExcludes([]string{}))
+	assert.Equal(t, []string{"*", "!go.mod", "!pkg/main.go"}, contextExcludes([]string{"go.mod", "pkg/main.go"}))
+}
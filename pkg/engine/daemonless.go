@@ -0,0 +1,433 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/maxlaverse/image-builder/pkg/registry"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// errUnsupported is returned for Dockerfiles that can't be assembled in-process
+	errUnsupported = errors.New("unsupported Dockerfile")
+)
+
+// daemonless assembles images in-process for Dockerfiles that only copy files
+// on top of existing images, and falls back to another engine for all the
+// others. Images are tagged in the registry, and pulls and local tags are
+// deferred until the fallback engine needs them, so that no daemon is
+// required if every stage can be assembled in-process. Images that never
+// need the fallback engine are only available in the registry.
+type daemonless struct {
+	fallback BuildEngine
+	built    map[string]struct{}
+	remotes  map[string]string
+	pending  []func(ctx context.Context) error
+	mux      sync.Mutex
+}
+
+// newDaemonless returns a new engine assembling images in-process when possible
+func newDaemonless(fallback BuildEngine) BuildEngine {
+	return &daemonless{
+		fallback: fallback,
+		built:    map[string]struct{}{},
+		remotes:  map[string]string{},
+	}
+}
+
+func (cli *daemonless) Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	err := cli.assemble(ctx, dockerfile, image, dir, opts)
+	if err == nil {
+		cli.mux.Lock()
+		defer cli.mux.Unlock()
+		cli.built[image] = struct{}{}
+		cli.remotes[image] = image
+		cli.pending = append(cli.pending, func(ctx context.Context) error { return cli.fallback.Pull(ctx, image) })
+		return nil
+	}
+
+	if !errors.Is(err, errUnsupported) {
+		return fmt.Errorf("error while assembling image '%s' in-process: %w", image, err)
+	}
+	log.Infof("Image '%s' can't be assembled in-process (%v), using %s", image, err, cli.fallback.Name())
+	if err := cli.flushPending(ctx); err != nil {
+		return err
+	}
+	return cli.fallback.Build(ctx, dockerfile, image, dir, opts)
+}
+
+func (cli *daemonless) Name() string {
+	return cli.fallback.Name() + "+daemonless"
+}
+
+// Push is a noop for images assembled in-process as they're directly written
+// into the registry
+func (cli *daemonless) Push(ctx context.Context, image string) error {
+	cli.mux.Lock()
+	_, ok := cli.built[image]
+	cli.mux.Unlock()
+	if ok {
+		log.Debugf("Image '%s' has already been pushed", image)
+		return nil
+	}
+	return cli.fallback.Push(ctx, image)
+}
+
+// Pull remembers the image can be found in the registry and defers the
+// actual pull until the fallback engine is used
+func (cli *daemonless) Pull(ctx context.Context, image string) error {
+	cli.mux.Lock()
+	defer cli.mux.Unlock()
+	cli.remotes[image] = image
+	cli.pending = append(cli.pending, func(ctx context.Context) error { return cli.fallback.Pull(ctx, image) })
+	return nil
+}
+
+// Tag tags an image in the registry, and defers the local tagging until the
+// fallback engine is used, unless the source image only exists in the
+// fallback engine
+func (cli *daemonless) Tag(ctx context.Context, src, dst string) error {
+	cli.mux.Lock()
+	ref, ok := cli.remotes[src]
+	cli.mux.Unlock()
+	if !ok {
+		return cli.fallback.Tag(ctx, src, dst)
+	}
+
+	if err := registry.CopyImage(ctx, ref, dst); err != nil {
+		return fmt.Errorf("error while tagging image '%s' as '%s' in the registry: %w", ref, dst, err)
+	}
+
+	cli.mux.Lock()
+	defer cli.mux.Unlock()
+	cli.remotes[dst] = ref
+	cli.pending = append(cli.pending, func(ctx context.Context) error { return cli.fallback.Tag(ctx, src, dst) })
+	return nil
+}
+
+// RepoDigests returns the digests of an image from the local store of the
+// fallback engine, if it has one
+func (cli *daemonless) RepoDigests(ctx context.Context, image string) ([]string, error) {
+	store, ok := cli.fallback.(LocalImageStore)
+	if !ok {
+		return nil, fmt.Errorf("engine %s has no local image store", cli.fallback.Name())
+	}
+	return store.RepoDigests(ctx, image)
+}
+
+// Version returns the version of the fallback engine. Its absence isn't an
+// error as long as no stage needs it.
+func (cli *daemonless) Version() (string, error) {
+	version, err := cli.fallback.Version()
+	if err != nil {
+		log.Warnf("Engine %s is not available, only images that can be assembled in-process can be built: %v", cli.fallback.Name(), err)
+		return "n/a", nil
+	}
+	return version, nil
+}
+
+// flushPending runs all the deferred operations on the fallback engine
+func (cli *daemonless) flushPending(ctx context.Context) error {
+	cli.mux.Lock()
+	defer cli.mux.Unlock()
+	for _, f := range cli.pending {
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	cli.pending = nil
+	return nil
+}
+
+// remoteImage returns the image a local name corresponds to in the registry.
+// For manifest lists, the image of the platform is returned.
+func (cli *daemonless) remoteImage(ctx context.Context, image, platform string) (v1.Image, error) {
+	opts := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx)}
+	var p *v1.Platform
+	if len(platform) > 0 {
+		var err error
+		if p, err = v1.ParsePlatform(platform); err != nil {
+			return nil, fmt.Errorf("invalid platform '%s': %w", platform, err)
+		}
+		opts = append(opts, remote.WithPlatform(*p))
+	}
+
+	if image == "scratch" {
+		if p == nil {
+			return empty.Image, nil
+		}
+		return mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant})
+	}
+
+	cli.mux.Lock()
+	ref, ok := cli.remotes[image]
+	cli.mux.Unlock()
+	if !ok {
+		ref = image
+	}
+
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference %q: %v", ref, err)
+	}
+	img, err := remote.Image(r, opts...)
+	if registry.ClassifyError(err) == registry.ErrorNotFound {
+		// The image may only exist in the local store of the fallback engine
+		return nil, fmt.Errorf("%w: image '%s' is not in a registry", errUnsupported, ref)
+	}
+	return img, err
+}
+
+// assemble builds an image without any daemon and pushes it
+func (cli *daemonless) assemble(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ast, err := parser.Parse(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnsupported, err)
+	}
+	stages, metaArgs, err := instructions.Parse(ast.AST)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnsupported, err)
+	}
+	if len(metaArgs) > 0 {
+		return fmt.Errorf("%w: ARG before FROM", errUnsupported)
+	}
+
+	// Only the last stage can have instructions. The other ones are just
+	// aliases to existing images.
+	aliases := map[string]string{}
+	for _, stage := range stages[:len(stages)-1] {
+		if len(stage.Commands) > 0 {
+			return fmt.Errorf("%w: intermediate stage '%s' has instructions", errUnsupported, stage.Name)
+		}
+		aliases[stage.Name] = resolveAlias(aliases, stage.BaseName)
+	}
+
+	final := stages[len(stages)-1]
+	if len(final.Platform) > 0 {
+		return fmt.Errorf("%w: FROM --platform", errUnsupported)
+	}
+	if err := checkInstructions(final.Commands); err != nil {
+		return err
+	}
+
+	img, err := cli.remoteImage(ctx, resolveAlias(aliases, final.BaseName), opts.Platform)
+	if err != nil {
+		return err
+	}
+
+	layerFiles := []string{}
+	defer func() {
+		for _, l := range layerFiles {
+			os.Remove(l)
+		}
+	}()
+
+	created := v1.Time{Time: time.Now()}
+	cmdSet := false
+	for _, c := range final.Commands {
+		switch cmd := c.(type) {
+		case *instructions.CopyCommand:
+			cfg, err := img.ConfigFile()
+			if err != nil {
+				return err
+			}
+
+			var src v1.Image
+			if len(cmd.From) > 0 {
+				src, err = cli.remoteImage(ctx, resolveAlias(aliases, cmd.From), opts.Platform)
+				if err != nil {
+					return err
+				}
+			}
+
+			layerFile, err := copyLayer(cmd.SourcePaths, cmd.DestPath, cfg.Config.WorkingDir, src, dir)
+			if len(layerFile) > 0 {
+				layerFiles = append(layerFiles, layerFile)
+			}
+			if err != nil {
+				return fmt.Errorf("error while processing '%s': %w", cmd.String(), err)
+			}
+
+			img, err = appendLayer(img, layerFile, v1.History{CreatedBy: cmd.String(), Created: created})
+			if err != nil {
+				return err
+			}
+			continue
+		case *instructions.CmdCommand:
+			cmdSet = true
+		}
+
+		img, err = mutateConfig(img, v1.History{CreatedBy: commandCode(c), Created: created, EmptyLayer: true}, func(cfg *v1.Config) {
+			applyConfigInstruction(cfg, c, cmdSet)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Labels) > 0 {
+		img, err = addLabels(img, opts.Labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	img, err = mutate.CreatedAt(img, created)
+	if err != nil {
+		return err
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %v", image, err)
+	}
+	log.Infof("Assembling and pushing image '%s' in-process", image)
+	return remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+}
+
+// checkInstructions verifies an image can be assembled with the instructions
+// of a stage
+func checkInstructions(cmds []instructions.Command) error {
+	for _, c := range cmds {
+		if strings.Contains(commandCode(c), "$") {
+			return fmt.Errorf("%w: variable in '%s'", errUnsupported, commandCode(c))
+		}
+
+		switch cmd := c.(type) {
+		case *instructions.CopyCommand:
+			if len(cmd.Chown) > 0 || len(cmd.Chmod) > 0 || len(cmd.SourceContents) > 0 {
+				return fmt.Errorf("%w: '%s'", errUnsupported, commandCode(c))
+			}
+		case *instructions.EnvCommand, *instructions.LabelCommand, *instructions.EntrypointCommand,
+			*instructions.CmdCommand, *instructions.WorkdirCommand, *instructions.UserCommand,
+			*instructions.ExposeCommand:
+		default:
+			return fmt.Errorf("%w: instruction %s", errUnsupported, strings.ToUpper(c.Name()))
+		}
+	}
+	return nil
+}
+
+// applyConfigInstruction updates an image configuration like an instruction
+// would do
+func applyConfigInstruction(cfg *v1.Config, c instructions.Command, cmdSet bool) {
+	switch cmd := c.(type) {
+	case *instructions.EnvCommand:
+		for _, kv := range cmd.Env {
+			cfg.Env = setEnv(cfg.Env, kv.Key, kv.Value)
+		}
+	case *instructions.LabelCommand:
+		if cfg.Labels == nil {
+			cfg.Labels = map[string]string{}
+		}
+		for _, kv := range cmd.Labels {
+			cfg.Labels[kv.Key] = kv.Value
+		}
+	case *instructions.EntrypointCommand:
+		cfg.Entrypoint = commandLine(cmd.ShellDependantCmdLine)
+		if !cmdSet {
+			cfg.Cmd = nil
+		}
+	case *instructions.CmdCommand:
+		cfg.Cmd = commandLine(cmd.ShellDependantCmdLine)
+	case *instructions.WorkdirCommand:
+		if path.IsAbs(cmd.Path) {
+			cfg.WorkingDir = path.Clean(cmd.Path)
+		} else {
+			cfg.WorkingDir = path.Join("/", cfg.WorkingDir, cmd.Path)
+		}
+	case *instructions.UserCommand:
+		cfg.User = cmd.User
+	case *instructions.ExposeCommand:
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = map[string]struct{}{}
+		}
+		for _, p := range cmd.Ports {
+			if !strings.Contains(p, "/") {
+				p = p + "/tcp"
+			}
+			cfg.ExposedPorts[p] = struct{}{}
+		}
+	}
+}
+
+func mutateConfig(img v1.Image, history v1.History, f func(cfg *v1.Config)) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	f(&cfg.Config)
+	cfg.History = append(cfg.History, history)
+	return mutate.ConfigFile(img, cfg)
+}
+
+// addLabels adds labels to the configuration of an image, like the --label
+// flag of 'docker build' does, without any history entry
+func addLabels(img v1.Image, labels map[string]string) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	if cfg.Config.Labels == nil {
+		cfg.Config.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		cfg.Config.Labels[k] = v
+	}
+	return mutate.ConfigFile(img, cfg)
+}
+
+// commandCode returns the source code of an instruction
+func commandCode(c instructions.Command) string {
+	if s, ok := c.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return c.Name()
+}
+
+func commandLine(cmdLine instructions.ShellDependantCmdLine) []string {
+	if cmdLine.PrependShell {
+		return []string{"/bin/sh", "-c", strings.Join(cmdLine.CmdLine, " ")}
+	}
+	return cmdLine.CmdLine
+}
+
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+func resolveAlias(aliases map[string]string, image string) string {
+	if v, ok := aliases[strings.ToLower(image)]; ok {
+		return v
+	}
+	return image
+}
@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+)
+
+// copyLayer writes a layer with the files a COPY instruction would add into a
+// temporary file. The files are taken from the image if one is given, or from
+// the context otherwise.
+func copyLayer(sources []string, dest, workdir string, from v1.Image, context string) (string, error) {
+	destIsDir := strings.HasSuffix(dest, "/") || len(sources) > 1
+	patterns := []string{}
+	for _, s := range sources {
+		if strings.ContainsAny(s, "*?[") {
+			destIsDir = true
+		}
+		patterns = append(patterns, normalizePath(s))
+	}
+	if !path.IsAbs(dest) {
+		dest = path.Join(workdir, dest)
+	}
+	dest = normalizePath(dest)
+
+	var src io.ReadCloser
+	if from != nil {
+		src = mutate.Extract(from)
+	} else {
+		src = contextTar(context)
+	}
+	defer src.Close()
+
+	f, err := ioutil.TempFile("", "layer")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	matched := map[string]bool{}
+	mapping := map[string]string{}
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return f.Name(), err
+		}
+
+		name := normalizePath(hdr.Name)
+		target, ok := copyTarget(patterns, name, hdr.Typeflag == tar.TypeDir, dest, destIsDir, matched)
+		if !ok || len(target) == 0 {
+			continue
+		}
+		mapping[name] = target
+
+		hdr.Name = target
+		if hdr.Typeflag == tar.TypeLink {
+			linkTarget, ok := mapping[normalizePath(hdr.Linkname)]
+			if !ok {
+				return f.Name(), fmt.Errorf("%w: hard link '%s' to a file outside of the copied ones", errUnsupported, name)
+			}
+			hdr.Linkname = linkTarget
+		}
+		if from == nil {
+			hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return f.Name(), err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return f.Name(), err
+		}
+	}
+
+	for _, p := range patterns {
+		if !matched[p] {
+			return f.Name(), fmt.Errorf("no source file matching '%s'", p)
+		}
+	}
+	return f.Name(), tw.Close()
+}
+
+// copyTarget returns where a file should be copied if it matches one of the
+// sources of a COPY instruction
+func copyTarget(patterns []string, name string, isDir bool, dest string, destIsDir bool, matched map[string]bool) (string, bool) {
+	for _, pattern := range patterns {
+		root, ok := sourceRoot(pattern, name)
+		if !ok {
+			continue
+		}
+		matched[pattern] = true
+
+		// Like Docker does, only the content of directories is copied
+		if name == root && !isDir && destIsDir {
+			return path.Join(dest, path.Base(name)), true
+		} else if name == root {
+			return dest, true
+		}
+		return path.Join(dest, strings.TrimPrefix(name, root+"/")), true
+	}
+	return "", false
+}
+
+// sourceRoot returns the path of name or of one of its parents matching a
+// source pattern
+func sourceRoot(pattern, name string) (string, bool) {
+	if len(pattern) == 0 {
+		return "", len(name) > 0
+	}
+
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		root := strings.Join(parts[:i+1], "/")
+		if ok, _ := path.Match(pattern, root); ok {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// contextTar streams a tar of the context, excluding the files ignored by its
+// .dockerignore file
+func contextTar(context string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeContextTar(context, w))
+	}()
+	return r
+}
+
+func writeContextTar(context string, w io.Writer) error {
+	matcher, err := dockerIgnoreMatcher(context)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(context, func(filePath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(context, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if matcher != nil {
+			excluded, err := matcher.MatchesOrParentMatches(relPath)
+			if err != nil || excluded {
+				return err
+			}
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = relPath
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func dockerIgnoreMatcher(context string) (*fileutils.PatternMatcher, error) {
+	f, err := os.Open(path.Join(context, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return fileutils.NewPatternMatcher(patterns)
+}
+
+func appendLayer(img v1.Image, layerFile string, history v1.History) (v1.Image, error) {
+	layer, err := tarball.LayerFromFile(layerFile)
+	if err != nil {
+		return nil, err
+	}
+	return mutate.Append(img, mutate.Addendum{Layer: layer, History: history})
+}
+
+// normalizePath returns a clean path relative to the root of a filesystem
+func normalizePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+)
+
+func startRegistry(t *testing.T) string {
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(stdlog.New(ioutil.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/base:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return host
+}
+
+func writeTestDockerfile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestDaemonlessAssemblesCopyOnlyDockerfile(t *testing.T) {
+	host := startRegistry(t)
+	fallback := newFallbackEngine()
+	e := newDaemonless(fallback)
+
+	dockerfile := writeTestDockerfile(t, `# ContextInclude some-file
+FROM `+host+`/base:latest AS base
+FROM base
+WORKDIR /app
+COPY some-file ./
+ENV GEM_HOME=/app/gems
+LABEL stage=release
+ENTRYPOINT ["/app/some-file"]
+`)
+	err := e.Build(context.Background(), dockerfile, host+"/app:release", "../../fixtures/folder-listing", BuildOptions{Labels: map[string]string{"org.opencontainers.image.title": "release"}})
+	assert.NoError(t, err)
+	assert.Empty(t, fallback.MethodCalls)
+	assert.NoError(t, e.Push(context.Background(), host+"/app:release"))
+	assert.Empty(t, fallback.MethodCalls)
+
+	ref, err := name.ParseReference(host + "/app:release")
+	assert.NoError(t, err)
+	img, err := remote.Image(ref)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg, err := img.ConfigFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "/app", cfg.Config.WorkingDir)
+	assert.Contains(t, cfg.Config.Env, "GEM_HOME=/app/gems")
+	assert.Equal(t, map[string]string{"stage": "release", "org.opencontainers.image.title": "release"}, cfg.Config.Labels)
+	assert.Equal(t, []string{"/app/some-file"}, cfg.Config.Entrypoint)
+
+	layers, err := img.Layers()
+	assert.NoError(t, err)
+	assert.Len(t, layers, 2)
+	assert.Equal(t, []string{"app/some-file"}, layerFiles(t, layers[1]))
+}
+
+func TestDaemonlessCopyFromImage(t *testing.T) {
+	host := startRegistry(t)
+	e := newDaemonless(newFallbackEngine())
+
+	dockerfile := writeTestDockerfile(t, "FROM scratch\nCOPY some-file /first/\n")
+	assert.NoError(t, e.Build(context.Background(), dockerfile, host+"/app:first", "../../fixtures/folder-listing", BuildOptions{}))
+
+	dockerfile = writeTestDockerfile(t, "FROM "+host+"/base:latest\nCOPY --from="+host+"/app:first /first /second\n")
+	assert.NoError(t, e.Build(context.Background(), dockerfile, host+"/app:second", "../../fixtures/empty", BuildOptions{}))
+
+	ref, err := name.ParseReference(host + "/app:second")
+	assert.NoError(t, err)
+	img, err := remote.Image(ref)
+	if !assert.NoError(t, err) {
+		return
+	}
+	layers, err := img.Layers()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"second/some-file"}, layerFiles(t, layers[len(layers)-1]))
+}
+
+func TestDaemonlessForPlatform(t *testing.T) {
+	host := startRegistry(t)
+	e := newDaemonless(newFallbackEngine())
+
+	dockerfile := writeTestDockerfile(t, "FROM scratch\nCOPY some-file /\n")
+	assert.NoError(t, e.Build(context.Background(), dockerfile, host+"/app:release-linux-arm64-v8", "../../fixtures/folder-listing", BuildOptions{Platform: "linux/arm64/v8"}))
+
+	ref, err := name.ParseReference(host + "/app:release-linux-arm64-v8")
+	assert.NoError(t, err)
+	img, err := remote.Image(ref)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg, err := img.ConfigFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux", "arm64", "v8"}, []string{cfg.OS, cfg.Architecture, cfg.Variant})
+}
+
+func TestDaemonlessFallsBackOnUnsupportedInstruction(t *testing.T) {
+	host := startRegistry(t)
+	fallback := newFallbackEngine()
+	e := newDaemonless(fallback)
+
+	assert.NoError(t, e.Pull(context.Background(), host+"/base:latest"))
+	assert.NoError(t, e.Tag(context.Background(), host+"/base:latest", host+"/app:base"))
+	assert.Empty(t, fallback.MethodCalls)
+
+	dockerfile := writeTestDockerfile(t, "FROM "+host+"/app:base\nRUN make\n")
+	assert.NoError(t, e.Build(context.Background(), dockerfile, "app:release", "../../fixtures/empty", BuildOptions{}))
+	assert.Equal(t, []string{"Name", "Pull(" + host + "/base:latest)", "Tag(" + host + "/base:latest," + host + "/app:base)", "Build(app:release)"}, fallback.MethodCalls)
+
+	assert.NoError(t, e.Push(context.Background(), "app:release"))
+	assert.Equal(t, "Push(app:release)", fallback.MethodCalls[4])
+}
+
+func TestDaemonlessTagsInRegistry(t *testing.T) {
+	host := startRegistry(t)
+	fallback := newFallbackEngine()
+	e := newDaemonless(fallback)
+
+	dockerfile := writeTestDockerfile(t, "FROM scratch\nCOPY some-file /\n")
+	assert.NoError(t, e.Build(context.Background(), dockerfile, host+"/app:release-v2-123", "../../fixtures/folder-listing", BuildOptions{}))
+	assert.NoError(t, e.Push(context.Background(), host+"/app:release-v2-123"))
+	assert.NoError(t, e.Tag(context.Background(), host+"/app:release-v2-123", host+"/app:latest"))
+	assert.Empty(t, fallback.MethodCalls)
+
+	built, err := remote.Get(mustParseReference(t, host+"/app:release-v2-123"))
+	assert.NoError(t, err)
+	tagged, err := remote.Get(mustParseReference(t, host+"/app:latest"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, built.Digest, tagged.Digest)
+	}
+}
+
+func TestDaemonlessFallsBackOnImageMissingFromRegistry(t *testing.T) {
+	host := startRegistry(t)
+	fallback := newFallbackEngine()
+	e := newDaemonless(fallback)
+
+	dockerfile := writeTestDockerfile(t, "FROM "+host+"/app:base\nCOPY some-file /\n")
+	assert.NoError(t, e.Build(context.Background(), dockerfile, host+"/app:release", "../../fixtures/folder-listing", BuildOptions{}))
+	assert.Equal(t, []string{"Name", "Build(" + host + "/app:release)"}, fallback.MethodCalls)
+}
+
+func TestDaemonlessReturnsAssemblyErrors(t *testing.T) {
+	host := startRegistry(t)
+	fallback := newFallbackEngine()
+	e := newDaemonless(fallback)
+
+	dockerfile := writeTestDockerfile(t, "FROM "+host+"/base:latest\nCOPY missing-file /\n")
+	err := e.Build(context.Background(), dockerfile, host+"/app:release", "../../fixtures/folder-listing", BuildOptions{})
+	assert.Error(t, err)
+	assert.Empty(t, fallback.MethodCalls)
+}
+
+func TestDaemonlessCopyTarget(t *testing.T) {
+	for _, tc := range []struct {
+		patterns  []string
+		name      string
+		isDir     bool
+		dest      string
+		destIsDir bool
+		expected  string
+		ok        bool
+	}{
+		{[]string{"Gemfile"}, "Gemfile", false, "app/Gemfile", false, "app/Gemfile", true},
+		{[]string{"Gemfile"}, "Gemfile", false, "app", true, "app/Gemfile", true},
+		{[]string{"Gemfile"}, "Gemfile.lock", false, "app", true, "", false},
+		{[]string{""}, "config/app.yml", false, "app", false, "app/config/app.yml", true},
+		{[]string{"gems"}, "gems", true, "app/gems", false, "app/gems", true},
+		{[]string{"gems"}, "gems/rails/init.rb", false, "app/gems", false, "app/gems/rails/init.rb", true},
+		{[]string{"*.rb"}, "init.rb", false, "app", true, "app/init.rb", true},
+	} {
+		target, ok := copyTarget(tc.patterns, tc.name, tc.isDir, tc.dest, tc.destIsDir, map[string]bool{})
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.expected, target, tc.name)
+	}
+}
+
+func mustParseReference(t *testing.T, ref string) name.Reference {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// fallbackEngine records the calls the daemonless engine makes to the engine
+// it falls back to. The fake of the engine/test package can't be used from
+// here as it depends on this package.
+type fallbackEngine struct {
+	MethodCalls []string
+}
+
+func newFallbackEngine() *fallbackEngine {
+	return &fallbackEngine{}
+}
+
+func (e *fallbackEngine) Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	e.MethodCalls = append(e.MethodCalls, fmt.Sprintf("Build(%s)", image))
+	return nil
+}
+
+func (e *fallbackEngine) Name() string {
+	e.MethodCalls = append(e.MethodCalls, "Name")
+	return "fake"
+}
+
+func (e *fallbackEngine) Push(ctx context.Context, image string) error {
+	e.MethodCalls = append(e.MethodCalls, fmt.Sprintf("Push(%s)", image))
+	return nil
+}
+
+func (e *fallbackEngine) Pull(ctx context.Context, image string) error {
+	e.MethodCalls = append(e.MethodCalls, fmt.Sprintf("Pull(%s)", image))
+	return nil
+}
+
+func (e *fallbackEngine) Tag(ctx context.Context, src, dst string) error {
+	e.MethodCalls = append(e.MethodCalls, fmt.Sprintf("Tag(%s,%s)", src, dst))
+	return nil
+}
+
+func (e *fallbackEngine) Version() (string, error) {
+	return "1.0.0", nil
+}
+
+func layerFiles(t *testing.T, layer v1.Layer) []string {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	files := []string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			files = append(files, hdr.Name)
+		}
+	}
+	return files
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 
@@ -18,8 +19,8 @@ func newDockerCli(exec executor.Executor) BuildEngine {
 	return &dockerCli{exec: exec}
 }
 
-func (cli *dockerCli) cmd(args ...string) error {
-	cmd := cli.exec.NewCommand("docker", args...)
+func (cli *dockerCli) cmd(ctx context.Context, args ...string) error {
+	cmd := cli.exec.NewCommandContext(ctx, "docker", args...)
 	var out bytes.Buffer
 
 	if log.GetLevel() >= log.InfoLevel {
@@ -34,24 +35,37 @@ func (cli *dockerCli) cmd(args ...string) error {
 	return err
 }
 
-func (cli *dockerCli) Build(dockerfile, image, dir string) error {
-	return cli.cmd("build", "-f", dockerfile, "-t", image, dir)
+func (cli *dockerCli) Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	args, err := opts.cliArgs(false)
+	if err != nil {
+		return err
+	}
+	// The legacy builder of Docker ignores the platform
+	build := []string{"build"}
+	if len(opts.Platform) > 0 {
+		build = []string{"buildx", "build", "--load"}
+	}
+	return cli.cmd(ctx, append(append(append(build, "-f", dockerfile, "-t", image), args...), dir)...)
 }
 
 func (cli *dockerCli) Name() string {
 	return "docker"
 }
 
-func (cli *dockerCli) Push(image string) error {
-	return cli.cmd("push", image)
+func (cli *dockerCli) Push(ctx context.Context, image string) error {
+	return cli.cmd(ctx, "push", image)
+}
+
+func (cli *dockerCli) Pull(ctx context.Context, image string) error {
+	return cli.cmd(ctx, "pull", image)
 }
 
-func (cli *dockerCli) Pull(image string) error {
-	return cli.cmd("pull", image)
+func (cli *dockerCli) Tag(ctx context.Context, src, dst string) error {
+	return cli.cmd(ctx, "tag", src, dst)
 }
 
-func (cli *dockerCli) Tag(src, dst string) error {
-	return cli.cmd("tag", src, dst)
+func (cli *dockerCli) RepoDigests(ctx context.Context, image string) ([]string, error) {
+	return inspectRepoDigests(ctx, cli.exec, "docker", image)
 }
 
 func (cli *dockerCli) Version() (string, error) {
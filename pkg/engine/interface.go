@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/maxlaverse/image-builder/pkg/executor"
@@ -8,22 +9,54 @@ import (
 
 // BuildEngine abstract container builder
 type BuildEngine interface {
-	Build(dockerfile, image, context string) error
+	Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error
 	Name() string
-	Push(image string) error
-	Pull(image string) error
+	Push(ctx context.Context, image string) error
+	Pull(ctx context.Context, image string) error
 	Version() (string, error)
-	Tag(src, dst string) error
+	Tag(ctx context.Context, src, dst string) error
+}
+
+// FileListBuilder is implemented by engines that can restrict the build
+// context to a list of files without copying them into a dedicated folder
+type FileListBuilder interface {
+	BuildWithFileList(ctx context.Context, dockerfile, image, dir string, files []string, opts BuildOptions) error
+}
+
+// Options holds the settings of engines that don't rely on a command line
+type Options struct {
+	// Daemonless assembles images in-process when a Dockerfile only copies
+	// files, and uses the engine for all the other ones
+	Daemonless bool
+
+	// BuildkitAddress is the address of the buildkitd daemon
+	BuildkitAddress string
+
+	// CacheFrom lists the external caches to import from
+	CacheFrom []string
+
+	// CacheTo lists the external caches to export to
+	CacheTo []string
 }
 
 // New returns a new container builder engine
-func New(name string, exec executor.Executor) (BuildEngine, error) {
+func New(name string, exec executor.Executor, opts Options) (BuildEngine, error) {
+	e, err := newEngine(name, exec, opts)
+	if err != nil || !opts.Daemonless {
+		return e, err
+	}
+	return newDaemonless(e), nil
+}
+
+func newEngine(name string, exec executor.Executor, opts Options) (BuildEngine, error) {
 	if name == "podman" {
 		return newPodmanCli(exec), nil
 	} else if name == "docker" {
 		return newDockerCli(exec), nil
 	} else if name == "buildah" {
 		return newbuildahCli(exec), nil
+	} else if name == "buildkit" {
+		return newBuildkit(opts)
 	} else {
 		return nil, fmt.Errorf("Unsupport engine: %s", name)
 	}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/maxlaverse/image-builder/pkg/executor"
+)
+
+// LocalImageStore is implemented by engines keeping the images they pull or
+// build in a local store
+type LocalImageStore interface {
+	// RepoDigests returns the repository digests of a local image, e.g
+	// 'debian@sha256:...'
+	RepoDigests(ctx context.Context, image string) ([]string, error)
+}
+
+// inspectRepoDigests returns the repository digests of an image using the
+// 'image inspect' command Docker and Podman have in common
+func inspectRepoDigests(ctx context.Context, exec executor.Executor, binary, image string) ([]string, error) {
+	var out bytes.Buffer
+	err := exec.NewCommandContext(ctx, binary, "image", "inspect", "--format", "{{json .RepoDigests}}", image).WithCombinedOutput(&out).Run()
+	if err != nil {
+		return nil, fmt.Errorf("command returned '%v': %s", err, out.String())
+	}
+
+	digests := []string{}
+	if err := json.Unmarshal(out.Bytes(), &digests); err != nil {
+		return nil, fmt.Errorf("error parsing the digests of image '%s': %w", image, err)
+	}
+	return digests, nil
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 
@@ -18,8 +19,8 @@ func newPodmanCli(exec executor.Executor) BuildEngine {
 	return &podmanCli{exec: exec}
 }
 
-func (cli *podmanCli) cmd(args ...string) error {
-	cmd := cli.exec.NewCommand("podman", args...)
+func (cli *podmanCli) cmd(ctx context.Context, args ...string) error {
+	cmd := cli.exec.NewCommandContext(ctx, "podman", args...)
 	var out bytes.Buffer
 
 	if log.GetLevel() >= log.InfoLevel {
@@ -34,24 +35,32 @@ func (cli *podmanCli) cmd(args ...string) error {
 	return err
 }
 
-func (cli *podmanCli) Build(dockerfile, image, context string) error {
-	return cli.cmd("build", "--format=docker", "--cgroup-manager", "cgroupfs", "-f", dockerfile, "-t", image, context)
+func (cli *podmanCli) Build(ctx context.Context, dockerfile, image, dir string, opts BuildOptions) error {
+	args, err := opts.cliArgs(true)
+	if err != nil {
+		return err
+	}
+	return cli.cmd(ctx, append(append([]string{"build", "--format=docker", "--cgroup-manager", "cgroupfs", "-f", dockerfile, "-t", image}, args...), dir)...)
 }
 
 func (cli *podmanCli) Name() string {
 	return "podman"
 }
 
-func (cli *podmanCli) Push(image string) error {
-	return cli.cmd("push", image)
+func (cli *podmanCli) Push(ctx context.Context, image string) error {
+	return cli.cmd(ctx, "push", image)
+}
+
+func (cli *podmanCli) Pull(ctx context.Context, image string) error {
+	return cli.cmd(ctx, "pull", image)
 }
 
-func (cli *podmanCli) Pull(image string) error {
-	return cli.cmd("pull", image)
+func (cli *podmanCli) Tag(ctx context.Context, src, dst string) error {
+	return cli.cmd(ctx, "tag", src, dst)
 }
 
-func (cli *podmanCli) Tag(src, dst string) error {
-	return cli.cmd("tag", src, dst)
+func (cli *podmanCli) RepoDigests(ctx context.Context, image string) ([]string, error) {
+	return inspectRepoDigests(ctx, cli.exec, "podman", image)
 }
 
 func (cli *podmanCli) Version() (string, error) {
@@ -1,35 +1,43 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"sync"
+
+	"github.com/maxlaverse/image-builder/pkg/engine"
 )
 
 type fakeCli struct {
 	MethodCalls   []string
-	BuildCallback func(string)
+	BuildOptions  map[string]engine.BuildOptions
+	BuildCallback func(context.Context, string) error
 	mux           sync.Mutex
 }
 
 // New returns a new engine based on Docker
 func New() *fakeCli {
-	return &fakeCli{}
+	return &fakeCli{BuildOptions: map[string]engine.BuildOptions{}}
 }
 
 // NewWithCallbacks returns a new engine based on Docker with callbacks on operations
-func NewWithCallbacks(buildCb func(string)) *fakeCli {
+func NewWithCallbacks(buildCb func(context.Context, string) error) *fakeCli {
 	return &fakeCli{
 		BuildCallback: buildCb,
+		BuildOptions:  map[string]engine.BuildOptions{},
 	}
 }
 
-func (cli *fakeCli) Build(dockerfile, image, context string) error {
+func (cli *fakeCli) Build(ctx context.Context, dockerfile, image, dir string, opts engine.BuildOptions) error {
 	if cli.BuildCallback != nil {
-		cli.BuildCallback(image)
+		if err := cli.BuildCallback(ctx, image); err != nil {
+			return err
+		}
 	}
 	cli.mux.Lock()
 	defer cli.mux.Unlock()
 	cli.MethodCalls = append(cli.MethodCalls, fmt.Sprintf("Build(%s)", image))
+	cli.BuildOptions[image] = opts
 	return nil
 }
 
@@ -40,21 +48,21 @@ func (cli *fakeCli) Name() string {
 	return "fake"
 }
 
-func (cli *fakeCli) Push(image string) error {
+func (cli *fakeCli) Push(ctx context.Context, image string) error {
 	cli.mux.Lock()
 	defer cli.mux.Unlock()
 	cli.MethodCalls = append(cli.MethodCalls, fmt.Sprintf("Push(%s)", image))
 	return nil
 }
 
-func (cli *fakeCli) Pull(image string) error {
+func (cli *fakeCli) Pull(ctx context.Context, image string) error {
 	cli.mux.Lock()
 	defer cli.mux.Unlock()
 	cli.MethodCalls = append(cli.MethodCalls, fmt.Sprintf("Pull(%s)", image))
 	return nil
 }
 
-func (cli *fakeCli) Tag(src, dst string) error {
+func (cli *fakeCli) Tag(ctx context.Context, src, dst string) error {
 	cli.mux.Lock()
 	defer cli.mux.Unlock()
 	cli.MethodCalls = append(cli.MethodCalls, fmt.Sprintf("Tag(%s,%s)", src, dst))
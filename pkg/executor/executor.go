@@ -1,6 +1,7 @@
 package executor
 
 import (
+	"context"
 	"io"
 	"os"
 	"os/exec"
@@ -13,6 +14,7 @@ type executor struct {
 
 type Executor interface {
 	NewCommand(cmd string, args ...string) Command
+	NewCommandContext(ctx context.Context, cmd string, args ...string) Command
 }
 
 func New() Executor {
@@ -25,6 +27,12 @@ func (e *executor) NewCommand(cmd string, args ...string) Command {
 	}
 }
 
+func (e *executor) NewCommandContext(ctx context.Context, cmd string, args ...string) Command {
+	return &command{
+		cmd: exec.CommandContext(ctx, cmd, args...),
+	}
+}
+
 type command struct {
 	cmd *exec.Cmd
 }
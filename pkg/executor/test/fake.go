@@ -1,7 +1,9 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"io"
 
 	"github.com/maxlaverse/image-builder/pkg/executor"
 )
@@ -17,7 +19,11 @@ func New() *fakeExecutor {
 
 func (cli *fakeExecutor) NewCommand(cmd string, args ...string) executor.Command {
 	cli.MethodCalls = append(cli.MethodCalls, fmt.Sprintf("NewCommand(%s,%s)", cmd, args))
-	return nil
+	return &fakeCommand{cmd: cmd}
+}
+
+func (cli *fakeExecutor) NewCommandContext(ctx context.Context, cmd string, args ...string) executor.Command {
+	return cli.NewCommand(cmd, args...)
 }
 
 func (cli *fakeExecutor) Build(dockerfile, image, context string) error {
@@ -39,3 +45,24 @@ func (cli *fakeExecutor) Tag(src, dst string) error {
 	cli.MethodCalls = append(cli.MethodCalls, fmt.Sprintf("Tag(%s,%s)", src, dst))
 	return nil
 }
+
+// fakeCommand is a command that can't be run
+type fakeCommand struct {
+	cmd string
+}
+
+func (c *fakeCommand) WithDir(dir string) executor.Command {
+	return c
+}
+
+func (c *fakeCommand) WithCombinedOutput(out io.Writer) executor.Command {
+	return c
+}
+
+func (c *fakeCommand) WithConsoleOutput() executor.Command {
+	return c
+}
+
+func (c *fakeCommand) Run() error {
+	return fmt.Errorf("command '%s' can't be run by the fake executor", c.cmd)
+}
@@ -1,72 +1,185 @@
 package fileutils
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
-	"hash/crc32"
+	"fmt"
 	"io"
 	"os"
 	"path"
-	"strings"
+)
+
+// HashScheme identifies the algorithm used to compute a Content Hash
+type HashScheme string
+
+const (
+	// HashSchemeCRC32 is a CRC32 of the content of the files and the
+	// Dockerfile. Its Content Hashes have no prefix.
+	HashSchemeCRC32 HashScheme = "v1"
 
-	log "github.com/sirupsen/logrus"
+	// HashSchemeSHA256 is a SHA-256 of the digests of each file, themselves
+	// covering the path, mode, symlink target and content of the file, and of
+	// the Dockerfile. Its Content Hashes are prefixed with the scheme version.
+	HashSchemeSHA256 HashScheme = "v2"
+
+	// DefaultHashScheme is the scheme used when none is specified
+	DefaultHashScheme = HashSchemeSHA256
 )
 
-func ContentHashing(basePath string, files []string, extraContent string) (string, error) {
-	//Initialize an empty return string now in case an error has to be returned
-	var returnCRC32String string
+// Modes of the entries of a SHA-256 Content Hash, as Git records them
+const (
+	modeDir        = 0040000
+	modeSymlink    = 0120000
+	modeRegular    = 0100644
+	modeExecutable = 0100755
+)
 
-	//Open the fhe file located at the given path and check for errors
+// FileDigest is the digest of a single entry of a SHA-256 Content Hash
+type FileDigest struct {
+	Path   string `json:"path"`
+	Mode   string `json:"mode"`
+	Link   string `json:"link,omitempty"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
 
-	//Create the table with the given polynomial
-	tablePolynomial := crc32.MakeTable(0xedb88320)
+// fileEntry holds the attributes of a file taken into account in a SHA-256
+// Content Hash, and the ones telling if a file changed since it was hashed
+type fileEntry struct {
+	path    string
+	mode    uint32
+	link    string
+	size    int64
+	modTime int64
+	inode   uint64
+}
 
-	//Open a new hash interface to write the file to
-	hash := crc32.New(tablePolynomial)
+// ContentHashing computes the Content Hash of a list of files relative to
+// basePath and of some extra content, using the given scheme
+func ContentHashing(scheme HashScheme, basePath string, files []string, extraContent string) (string, error) {
+	switch scheme {
+	case HashSchemeCRC32:
+		return contentHashingCRC32(basePath, files, extraContent)
+	case HashSchemeSHA256, "":
+		return contentHashingSHA256(basePath, files, extraContent)
+	}
+	return "", fmt.Errorf("unknown hash scheme '%s'", scheme)
+}
 
-	//Copy the file in the interface
+// contentHashingSHA256 hashes the digest of every file, followed by the extra
+// content. Digests have a fixed length and the extra content is preceded by
+// its length, so that two different lists of files can't produce the same
+// sequence of bytes.
+func contentHashingSHA256(basePath string, files []string, extraContent string) (string, error) {
+	digests, err := FileDigests(basePath, files)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "image-builder content hash %s\x00", HashSchemeSHA256)
+	for _, d := range digests {
+		fmt.Fprintf(h, "%s\x00", d.Digest)
+	}
+	fmt.Fprintf(h, "extra\x00%d\x00%s", len(extraContent), extraContent)
+
+	return string(HashSchemeSHA256) + "-" + hex.EncodeToString(h.Sum(nil)), nil
+}
 
+// FileDigests returns the digest of each entry a SHA-256 Content Hash is made
+// of. Digests are reused from the hash cache when the file didn't change.
+func FileDigests(basePath string, files []string) ([]FileDigest, error) {
+	digests := []FileDigest{}
 	for _, filePath := range files {
-		fi, err := os.Stat(path.Join(basePath, filePath))
+		entry, err := readEntry(basePath, filePath)
 		if err != nil {
-			log.Errorf("Could not stat: '%s'", path.Join(basePath, filePath))
-			continue
-			return "", err
-		}
-
-		if fi.IsDir() {
-			continue
+			return nil, err
 		}
 
-		err = func() error {
-			file, err := os.Open(path.Join(basePath, filePath))
+		digest, ok := currentHashCache().lookup(basePath, entry)
+		if !ok {
+			digest, err = digestEntry(basePath, entry)
 			if err != nil {
-				log.Errorf("Could not open: '%s'", path.Join(basePath, filePath))
-				return err
+				return nil, err
 			}
+			currentHashCache().store(basePath, entry, digest)
+		}
 
-			//Tell the program to close the file when the function returns
-			defer file.Close()
+		digests = append(digests, FileDigest{
+			Path:   entry.path,
+			Mode:   fmt.Sprintf("%06o", entry.mode),
+			Link:   entry.link,
+			Size:   entry.size,
+			Digest: digest,
+		})
+	}
+	return digests, nil
+}
 
-			// TODO: Include permissions
-			if _, err := io.Copy(hash, file); err != nil {
-				return err
-			}
-			return nil
-		}()
+// readEntry returns the attributes of a file relative to basePath
+func readEntry(basePath, filePath string) (fileEntry, error) {
+	fullPath := path.Join(basePath, filePath)
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return fileEntry{}, fmt.Errorf("could not stat '%s': %w", fullPath, err)
+	}
+
+	entry := fileEntry{path: filePath, modTime: fi.ModTime().UnixNano(), inode: inode(fi)}
+	entry.mode, err = hashedMode(fi)
+	if err != nil {
+		return fileEntry{}, fmt.Errorf("could not hash '%s': %w", fullPath, err)
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		entry.link, err = os.Readlink(fullPath)
 		if err != nil {
-			return "", err
+			return fileEntry{}, fmt.Errorf("could not read link '%s': %w", fullPath, err)
 		}
 	}
 
-	io.Copy(hash, strings.NewReader(strings.Join(files, "\n")))
-	io.Copy(hash, strings.NewReader(extraContent))
+	if fi.Mode().IsRegular() {
+		entry.size = fi.Size()
+	}
+	return entry, nil
+}
 
-	//Generate the hash
-	hashInBytes := hash.Sum(nil)[:]
+// digestEntry returns the SHA-256 of the path, mode, symlink target, content
+// length and content of a file
+func digestEntry(basePath string, entry fileEntry) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%06o\x00%s\x00%d\x00", entry.path, entry.mode, entry.link, entry.size)
+	if entry.mode == modeRegular || entry.mode == modeExecutable {
+		fullPath := path.Join(basePath, entry.path)
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return "", fmt.Errorf("could not open '%s': %w", fullPath, err)
+		}
+		defer file.Close()
 
-	//Encode the hash to a string
-	returnCRC32String = hex.EncodeToString(hashInBytes)
+		n, err := io.Copy(h, io.LimitReader(file, entry.size+1))
+		if err != nil {
+			return "", fmt.Errorf("could not read '%s': %w", fullPath, err)
+		}
+		if n != entry.size {
+			return "", fmt.Errorf("file '%s' changed while being hashed", fullPath)
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	//Return the output
-	return returnCRC32String, nil
+// hashedMode returns the mode of a file like Git records it. Only the file
+// type and the executable bit are kept, so that checkouts made with different
+// umasks share the same Content Hash.
+func hashedMode(fi os.FileInfo) (uint32, error) {
+	switch {
+	case fi.IsDir():
+		return modeDir, nil
+	case fi.Mode()&os.ModeSymlink != 0:
+		return modeSymlink, nil
+	case fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0:
+		return modeExecutable, nil
+	case fi.Mode().IsRegular():
+		return modeRegular, nil
+	}
+	return 0, fmt.Errorf("unsupported file type %v", fi.Mode().Type())
 }
@@ -0,0 +1,107 @@
+package fileutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentHashingLegacyScheme(t *testing.T) {
+	hash, err := ContentHashing(HashSchemeCRC32, "../../fixtures/empty", []string{}, "something")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "09da31fb", hash)
+}
+
+func TestContentHashingIsVersioned(t *testing.T) {
+	hash, err := ContentHashing(HashSchemeSHA256, "../../fixtures/folder-listing", []string{"some-file"}, "something")
+
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "v2-"), hash)
+	assert.Len(t, hash, 67)
+
+	defaultHash, err := ContentHashing("", "../../fixtures/folder-listing", []string{"some-file"}, "something")
+	assert.NoError(t, err)
+	assert.Equal(t, hash, defaultHash)
+
+	_, err = ContentHashing("v0", "../../fixtures/folder-listing", []string{"some-file"}, "something")
+	assert.EqualError(t, err, "unknown hash scheme 'v0'")
+}
+
+func TestContentHashingEncodesEntries(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "ab", "c", 0644)
+	writeFile(t, dir, "a", "bc", 0644)
+
+	hashAB, err := ContentHashing(HashSchemeSHA256, dir, []string{"ab"}, "")
+	assert.NoError(t, err)
+	hashA, err := ContentHashing(HashSchemeSHA256, dir, []string{"a"}, "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hashAB, hashA)
+
+	hashBoth, err := ContentHashing(HashSchemeSHA256, dir, []string{"a", "ab"}, "")
+	assert.NoError(t, err)
+	hashWithExtra, err := ContentHashing(HashSchemeSHA256, dir, []string{"a"}, "c")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hashBoth, hashWithExtra)
+}
+
+func TestContentHashingIncludesExecutableBit(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "script", "#!/bin/sh", 0644)
+
+	before, err := ContentHashing(HashSchemeSHA256, dir, []string{"script"}, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.Chmod(path.Join(dir, "script"), 0664))
+	sameMode, err := ContentHashing(HashSchemeSHA256, dir, []string{"script"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, before, sameMode)
+
+	assert.NoError(t, os.Chmod(path.Join(dir, "script"), 0755))
+	after, err := ContentHashing(HashSchemeSHA256, dir, []string{"script"}, "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func TestContentHashingIncludesSymlinkTarget(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "a", "content", 0644)
+	writeFile(t, dir, "b", "content", 0644)
+
+	assert.NoError(t, os.Symlink("a", path.Join(dir, "link")))
+	toA, err := ContentHashing(HashSchemeSHA256, dir, []string{"link"}, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.Remove(path.Join(dir, "link")))
+	assert.NoError(t, os.Symlink("b", path.Join(dir, "link")))
+	toB, err := ContentHashing(HashSchemeSHA256, dir, []string{"link"}, "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, toA, toB)
+}
+
+func TestContentHashingFailsOnMissingFile(t *testing.T) {
+	_, err := ContentHashing(HashSchemeSHA256, "../../fixtures/folder-listing", []string{"missing-file"}, "")
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not stat '../../fixtures/folder-listing/missing-file'")
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "content-hashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string, mode os.FileMode) {
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,315 @@
+package fileutils
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	gitIgnoreCache    = map[string][]gitIgnoreRule{}
+	gitIgnoreCacheMux sync.Mutex
+)
+
+const (
+	gitIgnoreName    = ".gitignore"
+	dockerIgnoreName = ".dockerignore"
+)
+
+// ContextFilter selects the files of a build context
+type ContextFilter struct {
+	// IncludePatterns are the patterns of the files to include
+	IncludePatterns []string
+
+	// ExcludePatterns are the patterns of the files to remove from the
+	// included ones. Excluding a directory excludes all its content.
+	ExcludePatterns []string
+
+	// HonorIgnoreFiles removes the files ignored by the .gitignore files and
+	// the .dockerignore file of the context
+	HonorIgnoreFiles bool
+}
+
+// ListContextFiles returns the files of a context matching a filter. When
+// files are excluded, the included directories are replaced by the files
+// they contain that are not excluded.
+func ListContextFiles(srcPath string, filter ContextFilter) ([]string, error) {
+	files, err := ListMatchingFiles(srcPath, filter.IncludePatterns)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter.ExcludePatterns) == 0 && !filter.HonorIgnoreFiles {
+		return files, nil
+	}
+
+	m, err := newExcludeMatcher(srcPath, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]struct{}{}
+	for _, file := range files {
+		if m.excluded(file, false) {
+			continue
+		}
+
+		err := filepath.WalkDir(path.Join(srcPath, file), func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relFilePath, err := filepath.Rel(srcPath, filePath)
+			if err != nil {
+				return err
+			}
+			relFilePath = filepath.ToSlash(relFilePath)
+
+			if m.excluded(relFilePath, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() {
+				selected[relFilePath] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := []string{}
+	for file := range selected {
+		result = append(result, file)
+	}
+	sort.Strings(result)
+	log.Tracef("%d files remain after exclusions", len(result))
+	return result, nil
+}
+
+// excludeMatcher tells if a file of a context is excluded
+type excludeMatcher struct {
+	srcPath         string
+	excludePatterns []string
+	gitIgnoreRules  []gitIgnoreRule
+	dockerIgnore    *fileutils.PatternMatcher
+}
+
+func newExcludeMatcher(srcPath string, filter ContextFilter) (*excludeMatcher, error) {
+	m := &excludeMatcher{
+		srcPath:         srcPath,
+		excludePatterns: filter.ExcludePatterns,
+	}
+	if !filter.HonorIgnoreFiles {
+		return m, nil
+	}
+
+	var err error
+	m.gitIgnoreRules, err = readGitIgnoreRules(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	m.dockerIgnore, err = readDockerIgnore(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// excluded returns if a file relative to the context is excluded. The
+// directory bit is only used to evaluate the .gitignore rules restricted to
+// directories, and is looked up if not given.
+func (m *excludeMatcher) excluded(filePath string, isDir bool) bool {
+	candidates := parentPaths(filePath)
+	for _, pattern := range m.excludePatterns {
+		for _, candidate := range candidates {
+			if match, _ := doublestar.Match(pattern, candidate); match {
+				return true
+			}
+		}
+	}
+
+	if m.dockerIgnore != nil {
+		if match, _ := m.dockerIgnore.MatchesOrParentMatches(filePath); match {
+			return true
+		}
+	}
+
+	if !isDir {
+		if fi, err := os.Lstat(path.Join(m.srcPath, filePath)); err == nil {
+			isDir = fi.IsDir()
+		}
+	}
+	return gitIgnored(m.gitIgnoreRules, candidates, isDir)
+}
+
+// gitIgnored returns if a file is ignored by a list of .gitignore rules, given
+// the file and all its parents. The last matching rule wins.
+func gitIgnored(rules []gitIgnoreRule, candidates []string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(candidates, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// gitIgnoreRule is a line of a .gitignore file, converted into a pattern
+// relative to the context
+type gitIgnoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// matches returns if a rule matches a file, given the file and all its
+// parents. Rules restricted to directories always match on the parents.
+func (r gitIgnoreRule) matches(candidates []string, isDir bool) bool {
+	for i, candidate := range candidates {
+		if r.dirOnly && i == len(candidates)-1 && !isDir {
+			continue
+		}
+		if match, _ := doublestar.Match(r.pattern, candidate); match {
+			return true
+		}
+	}
+	return false
+}
+
+// readGitIgnoreRules reads the rules of all the .gitignore files of a context,
+// the ones of the deepest files coming last as they take precedence. Like Git,
+// it doesn't look into ignored directories. The rules are read once per
+// context.
+func readGitIgnoreRules(srcPath string) ([]gitIgnoreRule, error) {
+	gitIgnoreCacheMux.Lock()
+	defer gitIgnoreCacheMux.Unlock()
+	if rules, ok := gitIgnoreCache[srcPath]; ok {
+		return rules, nil
+	}
+
+	rules := []gitIgnoreRule{}
+	err := filepath.WalkDir(srcPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		relFilePath, err := filepath.Rel(srcPath, filePath)
+		if err != nil {
+			return err
+		}
+		relFilePath = filepath.ToSlash(relFilePath)
+		if relFilePath != "." && gitIgnored(rules, parentPaths(relFilePath), true) {
+			return filepath.SkipDir
+		}
+
+		dirRules, err := readGitIgnoreFile(srcPath, relFilePath)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, dirRules...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gitIgnoreCache[srcPath] = rules
+	return rules, nil
+}
+
+// readGitIgnoreFile reads the rules of the .gitignore file of a directory of
+// a context, if there is one
+func readGitIgnoreFile(srcPath, dir string) ([]gitIgnoreRule, error) {
+	f, err := os.Open(path.Join(srcPath, dir, gitIgnoreName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []gitIgnoreRule{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseGitIgnoreLine(dir, scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseGitIgnoreLine converts a line of a .gitignore file located in dir into
+// a rule. Patterns without a slash match at any depth below dir.
+func parseGitIgnoreLine(dir, line string) (gitIgnoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return gitIgnoreRule{}, false
+	}
+
+	rule := gitIgnoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	line = strings.TrimPrefix(line, "/")
+	if dir != "." {
+		line = dir + "/" + line
+	}
+	rule.pattern = line
+	return rule, len(line) > 0
+}
+
+func readDockerIgnore(srcPath string) (*fileutils.PatternMatcher, error) {
+	f, err := os.Open(path.Join(srcPath, dockerIgnoreName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return fileutils.NewPatternMatcher(patterns)
+}
+
+// parentPaths returns all the parents of a relative path, followed by the
+// path itself
+func parentPaths(filePath string) []string {
+	parts := strings.Split(filePath, "/")
+	paths := []string{}
+	for i := range parts {
+		paths = append(paths, strings.Join(parts[:i+1], "/"))
+	}
+	return paths
+}
@@ -0,0 +1,107 @@
+package fileutils
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListContextFilesWithoutExclusion(t *testing.T) {
+	resetCache()
+
+	list, err := ListContextFiles("../../fixtures/folder-listing", ContextFilter{IncludePatterns: []string{"some-f*"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"some-file"}, list)
+}
+
+func TestListContextFilesWithExcludePatterns(t *testing.T) {
+	resetCache()
+	dir := appDir(t)
+
+	list, err := ListContextFiles(dir, ContextFilter{
+		IncludePatterns: []string{"app", "config/**", "Gemfile", "log/**"},
+		ExcludePatterns: []string{"log", "**/node_modules", "config/*.local.yml"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Gemfile", "app/.gitignore", "app/models/user.rb", "app/tmp/cache", "config/app.yml"}, list)
+}
+
+func TestListContextFilesHonoringIgnoreFiles(t *testing.T) {
+	resetCache()
+	dir := appDir(t)
+
+	list, err := ListContextFiles(dir, ContextFilter{
+		IncludePatterns:  []string{"**"},
+		HonorIgnoreFiles: true,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{".dockerignore", ".gitignore", "Gemfile", "app/.gitignore", "app/models/user.rb", "config/app.yml", "log/.keep"}, list)
+}
+
+func TestReadGitIgnoreRulesSkipsIgnoredDirectories(t *testing.T) {
+	resetCache()
+	dir := appDir(t)
+	writeFile(t, dir, "node_modules/.gitignore", "!*\n", 0644)
+	writeFile(t, dir, "app/tmp/.gitignore", "!*\n", 0644)
+
+	rules, err := readGitIgnoreRules(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []gitIgnoreRule{
+		{pattern: "**/*.log"},
+		{pattern: "node_modules"},
+		{pattern: "log/.keep", negate: true},
+		{pattern: "app/**/tmp", dirOnly: true},
+		{pattern: "app/**/node_modules", dirOnly: true},
+	}, rules)
+}
+
+func TestParseGitIgnoreLine(t *testing.T) {
+	for _, tc := range []struct {
+		dir      string
+		line     string
+		expected gitIgnoreRule
+		ok       bool
+	}{
+		{".", "# comment", gitIgnoreRule{}, false},
+		{".", "", gitIgnoreRule{}, false},
+		{".", "*.log", gitIgnoreRule{pattern: "**/*.log"}, true},
+		{".", "/tmp", gitIgnoreRule{pattern: "tmp"}, true},
+		{".", "tmp/", gitIgnoreRule{pattern: "**/tmp", dirOnly: true}, true},
+		{".", "!log/.keep", gitIgnoreRule{pattern: "log/.keep", negate: true}, true},
+		{"app", "tmp/", gitIgnoreRule{pattern: "app/**/tmp", dirOnly: true}, true},
+		{"app", "/cache", gitIgnoreRule{pattern: "app/cache"}, true},
+	} {
+		rule, ok := parseGitIgnoreLine(tc.dir, tc.line)
+		assert.Equal(t, tc.ok, ok, tc.line)
+		assert.Equal(t, tc.expected, rule, tc.line)
+	}
+}
+
+// appDir creates an application folder with files that are usually not
+// wanted in a build context
+func appDir(t *testing.T) string {
+	dir := tempDir(t)
+	for _, d := range []string{"app/models", "app/tmp", "config", "log", "node_modules/lib", "app/node_modules"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, dir, ".gitignore", "*.log\n/node_modules\n!log/.keep\n", 0644)
+	writeFile(t, dir, ".dockerignore", "config/*.local.yml\n", 0644)
+	writeFile(t, dir, "Gemfile", "source 'https://rubygems.org'", 0644)
+	writeFile(t, dir, "app/.gitignore", "tmp/\nnode_modules/\n", 0644)
+	writeFile(t, dir, "app/models/user.rb", "class User; end", 0644)
+	writeFile(t, dir, "app/tmp/cache", "", 0644)
+	writeFile(t, dir, "app/node_modules/index.js", "", 0644)
+	writeFile(t, dir, "config/app.yml", "", 0644)
+	writeFile(t, dir, "config/app.local.yml", "", 0644)
+	writeFile(t, dir, "log/.keep", "", 0644)
+	writeFile(t, dir, "log/production.log", "", 0644)
+	writeFile(t, dir, "node_modules/lib/index.js", "", 0644)
+	return dir
+}
@@ -0,0 +1,79 @@
+package fileutils
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CopyFiles recreates a list of files from srcPath into dstPath, keeping their
+// relative paths. Directories in the list are copied with all their content.
+// Regular files are hard linked when possible, and copied otherwise.
+func CopyFiles(srcPath, dstPath string, files []string) error {
+	for _, file := range files {
+		err := filepath.WalkDir(filepath.Join(srcPath, file), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relFilePath, err := filepath.Rel(srcPath, path)
+			if err != nil {
+				return err
+			}
+			return copyEntry(path, filepath.Join(dstPath, relFilePath), d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyEntry(src, dst string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		// Already copied as part of a directory listed earlier
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		return os.Mkdir(dst, info.Mode().Perm())
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case info.Mode().IsRegular():
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+		return copyFile(src, dst, info.Mode().Perm())
+	}
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,44 @@
+package fileutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyFilesOnlyCopiesListedFiles(t *testing.T) {
+	dst, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = CopyFiles("../../fixtures/folder-listing", dst, []string{"some-file"})
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "some-file"))
+	assert.NoError(t, err)
+	expected, _ := ioutil.ReadFile("../../fixtures/folder-listing/some-file")
+	assert.Equal(t, expected, content)
+
+	_, err = os.Stat(filepath.Join(dst, "some-other-file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopyFilesCopiesDirectories(t *testing.T) {
+	dst, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = CopyFiles("../../fixtures", dst, []string{"folder-listing", "folder-listing/some-file"})
+	assert.NoError(t, err)
+
+	list, err := ListMatchingFiles(dst, []string{"**"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"folder-listing", "folder-listing/some-file", "folder-listing/some-other-file"}, list)
+}
@@ -0,0 +1,203 @@
+package fileutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// hashCacheVersion is increased whenever the way digests are computed
+	// changes, in order to discard the caches written by older versions
+	hashCacheVersion = 1
+
+	// racyWindow is the age under which the digest of a file isn't cached.
+	// The file could still be modified without its modification time
+	// changing, if the filesystem has a coarse timestamp resolution.
+	racyWindow = 2 * time.Second
+
+	// unusedEntryTTL is the duration after which entries that haven't been
+	// used are removed from the cache
+	unusedEntryTTL = 30 * 24 * time.Hour
+)
+
+var (
+	hashCache    *HashCache
+	hashCacheMux sync.Mutex
+)
+
+// HashCache stores the digests of files on disk, to avoid reading them again
+// as long as their size, modification time and inode didn't change
+type HashCache struct {
+	path    string
+	entries map[string]hashCacheEntry
+	used    map[string]hashCacheEntry
+	mux     sync.Mutex
+}
+
+type hashCacheFile struct {
+	Version int                       `json:"version"`
+	Entries map[string]hashCacheEntry `json:"entries"`
+}
+
+type hashCacheEntry struct {
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"`
+	Inode    uint64 `json:"inode"`
+	Mode     uint32 `json:"mode"`
+	Link     string `json:"link,omitempty"`
+	Digest   string `json:"digest"`
+	LastUsed int64  `json:"lastUsed"`
+}
+
+// LoadHashCache returns the hash cache stored in a file. A cache that can't
+// be read is logged and considered empty, as it should never prevent a build.
+func LoadHashCache(path string) *HashCache {
+	c := &HashCache{
+		path:    path,
+		entries: readHashCacheFile(path),
+		used:    map[string]hashCacheEntry{},
+	}
+	log.Debugf("Loaded %d digests from the hash cache '%s'", len(c.entries), path)
+	return c
+}
+
+// UseHashCache makes ContentHashing and FileDigests reuse and store digests in
+// the given cache. A nil cache disables caching.
+func UseHashCache(c *HashCache) {
+	hashCacheMux.Lock()
+	defer hashCacheMux.Unlock()
+	hashCache = c
+}
+
+func currentHashCache() *HashCache {
+	hashCacheMux.Lock()
+	defer hashCacheMux.Unlock()
+	return hashCache
+}
+
+// Save writes the digests used or computed since the cache was loaded. The
+// entries written in the meantime by other processes are kept, and the file
+// is replaced atomically so that concurrent processes never read a partial
+// cache.
+func (c *HashCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.used) == 0 {
+		return nil
+	}
+
+	entries := readHashCacheFile(c.path)
+	for k, v := range c.used {
+		entries[k] = v
+	}
+	expiry := time.Now().Add(-unusedEntryTTL).Unix()
+	for k, v := range entries {
+		if v.LastUsed < expiry {
+			delete(entries, k)
+		}
+	}
+
+	data, err := json.Marshal(hashCacheFile{Version: hashCacheVersion, Entries: entries})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// lookup returns the digest of a file if it didn't change since it was cached
+func (c *HashCache) lookup(basePath string, entry fileEntry) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	key := hashCacheKey(basePath, entry.path)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	cached, ok := c.entries[key]
+	if !ok || cached.Size != entry.size || cached.ModTime != entry.modTime || cached.Inode != entry.inode ||
+		cached.Mode != entry.mode || cached.Link != entry.link {
+		return "", false
+	}
+
+	cached.LastUsed = time.Now().Unix()
+	c.used[key] = cached
+	return cached.Digest, true
+}
+
+// store adds the digest of a file into the cache, unless it was modified too
+// recently to be trusted
+func (c *HashCache) store(basePath string, entry fileEntry, digest string) {
+	if c == nil || time.Since(time.Unix(0, entry.modTime)) < racyWindow {
+		return
+	}
+	key := hashCacheKey(basePath, entry.path)
+	cached := hashCacheEntry{
+		Size:     entry.size,
+		ModTime:  entry.modTime,
+		Inode:    entry.inode,
+		Mode:     entry.mode,
+		Link:     entry.link,
+		Digest:   digest,
+		LastUsed: time.Now().Unix(),
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries[key] = cached
+	c.used[key] = cached
+}
+
+// hashCacheKey returns the key of a file in the cache. Digests include the
+// path relative to the base path, so both are part of the key.
+func hashCacheKey(basePath, filePath string) string {
+	if absPath, err := filepath.Abs(basePath); err == nil {
+		basePath = absPath
+	}
+	return basePath + "\x00" + filePath
+}
+
+func readHashCacheFile(path string) map[string]hashCacheEntry {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]hashCacheEntry{}
+	} else if err != nil {
+		log.Warnf("Ignoring hash cache '%s': %v", path, err)
+		return map[string]hashCacheEntry{}
+	}
+
+	cache := hashCacheFile{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Warnf("Ignoring hash cache '%s': %v", path, err)
+		return map[string]hashCacheEntry{}
+	}
+	if cache.Version != hashCacheVersion || cache.Entries == nil {
+		return map[string]hashCacheEntry{}
+	}
+	return cache.Entries
+}
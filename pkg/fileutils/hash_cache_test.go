@@ -0,0 +1,101 @@
+package fileutils
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashCacheReusesDigestOfUnchangedFiles(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "Gemfile", "source 'https://rubygems.org'", 0644)
+	setModTime(t, dir, "Gemfile", time.Now().Add(-time.Hour))
+
+	cache := LoadHashCache(path.Join(dir, "cache.json"))
+	UseHashCache(cache)
+	defer UseHashCache(nil)
+
+	expected, err := FileDigests(dir, []string{"Gemfile"})
+	assert.NoError(t, err)
+	assert.Len(t, cache.entries, 1)
+
+	// Only the cached digest can be returned if the content isn't read
+	for k, v := range cache.entries {
+		v.Digest = "sha256:cached"
+		cache.entries[k] = v
+	}
+	digests, err := FileDigests(dir, []string{"Gemfile"})
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:cached", digests[0].Digest)
+
+	// A change in the modification time invalidates the entry
+	setModTime(t, dir, "Gemfile", time.Now().Add(-time.Minute))
+	digests, err = FileDigests(dir, []string{"Gemfile"})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, digests)
+}
+
+func TestHashCacheIgnoresRecentlyModifiedFiles(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "Gemfile", "source 'https://rubygems.org'", 0644)
+
+	cache := LoadHashCache(path.Join(dir, "cache.json"))
+	UseHashCache(cache)
+	defer UseHashCache(nil)
+
+	_, err := FileDigests(dir, []string{"Gemfile"})
+	assert.NoError(t, err)
+	assert.Empty(t, cache.entries)
+}
+
+func TestHashCacheSaveMergesEntries(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "Gemfile", "source 'https://rubygems.org'", 0644)
+	writeFile(t, dir, "Gemfile.lock", "GEM", 0644)
+	setModTime(t, dir, "Gemfile", time.Now().Add(-time.Hour))
+	setModTime(t, dir, "Gemfile.lock", time.Now().Add(-time.Hour))
+	cachePath := path.Join(dir, "cache", "cache.json")
+
+	first := LoadHashCache(cachePath)
+	second := LoadHashCache(cachePath)
+
+	UseHashCache(first)
+	_, err := FileDigests(dir, []string{"Gemfile"})
+	assert.NoError(t, err)
+	UseHashCache(second)
+	_, err = FileDigests(dir, []string{"Gemfile.lock"})
+	assert.NoError(t, err)
+	UseHashCache(nil)
+
+	assert.NoError(t, first.Save())
+	assert.NoError(t, second.Save())
+
+	reloaded := LoadHashCache(cachePath)
+	assert.Len(t, reloaded.entries, 2)
+}
+
+func TestHashCacheIgnoresInvalidFile(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "cache.json", "{invalid", 0644)
+
+	cache := LoadHashCache(path.Join(dir, "cache.json"))
+	assert.Empty(t, cache.entries)
+}
+
+func TestNilHashCache(t *testing.T) {
+	var cache *HashCache
+
+	_, ok := cache.lookup("/", fileEntry{path: "Gemfile"})
+	assert.False(t, ok)
+	cache.store("/", fileEntry{path: "Gemfile"}, "sha256:123")
+	assert.NoError(t, cache.Save())
+}
+
+func setModTime(t *testing.T, dir, name string, modTime time.Time) {
+	if err := os.Chtimes(path.Join(dir, name), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,10 @@
+package fileutils
+
+import (
+	"os"
+)
+
+// inode returns 0 as inode numbers aren't exposed by os.FileInfo on Windows
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/bmatcuk/doublestar"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +15,7 @@ import (
 var (
 	matchCache    = map[string][]string{}
 	filelistCache = map[string][]string{}
+	cacheMux      sync.Mutex
 )
 
 func cacheKey(srcPath string, includePatterns []string) string {
@@ -22,6 +24,8 @@ func cacheKey(srcPath string, includePatterns []string) string {
 
 func ListMatchingFiles(srcPath string, includePatterns []string) ([]string, error) {
 	log.Tracef("Include patterns are: %v", includePatterns)
+	cacheMux.Lock()
+	defer cacheMux.Unlock()
 
 	if v, ok := matchCache[cacheKey(srcPath, includePatterns)]; ok {
 		log.Tracef("Found %d matching files in cache", len(v))
@@ -28,4 +28,5 @@ func TestListMatchingFilesDontIncludeRoot(t *testing.T) {
 func resetCache() {
 	matchCache = map[string][]string{}
 	filelistCache = map[string][]string{}
+	gitIgnoreCache = map[string][]gitIgnoreRule{}
 }
@@ -0,0 +1,225 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	log "github.com/sirupsen/logrus"
+)
+
+const digestCacheVersion = 1
+
+var (
+	digestCache *DigestCache
+	offline     bool
+	localStore  LocalImageStore
+	offlineMux  sync.Mutex
+)
+
+// LocalImageStore returns the repository digests of an image found in the
+// local store of a container engine, e.g 'debian@sha256:...'
+type LocalImageStore func(ref string) ([]string, error)
+
+// DigestCache stores the digests and creation dates external images resolved
+// to, for them to be reused when working offline
+type DigestCache struct {
+	path    string
+	entries map[string]digestCacheEntry
+	changed bool
+	mux     sync.Mutex
+}
+
+type digestCacheFile struct {
+	Version int                         `json:"version"`
+	Entries map[string]digestCacheEntry `json:"entries"`
+}
+
+type digestCacheEntry struct {
+	Digest  string    `json:"digest,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// LoadDigestCache returns the digest cache stored in a file. A cache that
+// can't be read is logged and considered empty.
+func LoadDigestCache(path string) *DigestCache {
+	return &DigestCache{
+		path:    path,
+		entries: readDigestCacheFile(path),
+	}
+}
+
+// UseDigestCache makes ImageWithDigest and ImageAge record their results in
+// the given cache. A nil cache disables caching.
+func UseDigestCache(c *DigestCache) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	digestCache = c
+}
+
+// SetOffline makes ImageWithDigest and ImageAge answer from the digest cache,
+// and then from the local image store if any, instead of the registries
+func SetOffline(enabled bool, store LocalImageStore) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	offline = enabled
+	localStore = store
+}
+
+func offlineState() (*DigestCache, bool, LocalImageStore) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	return digestCache, offline, localStore
+}
+
+// Save writes the cache if it changed. The entries written in the meantime by
+// other processes are kept, and the file is replaced atomically.
+func (c *DigestCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.changed {
+		return nil
+	}
+
+	entries := readDigestCacheFile(c.path)
+	for k, v := range c.entries {
+		entries[k] = v
+	}
+	data, err := json.Marshal(digestCacheFile{Version: digestCacheVersion, Entries: entries})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+func (c *DigestCache) lookup(ref string) (digestCacheEntry, bool) {
+	if c == nil {
+		return digestCacheEntry{}, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[ref]
+	return entry, ok
+}
+
+func (c *DigestCache) storeDigest(ref, digest string) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry := c.entries[ref]
+	if entry.Digest != digest {
+		entry.Digest = digest
+		c.entries[ref] = entry
+		c.changed = true
+	}
+}
+
+func (c *DigestCache) storeCreated(ref string, created time.Time) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry := c.entries[ref]
+	if !entry.Created.Equal(created) {
+		entry.Created = created
+		c.entries[ref] = entry
+		c.changed = true
+	}
+}
+
+// offlineImageWithDigest resolves an image from the digest cache, or from
+// the local image store
+func offlineImageWithDigest(ref string) (string, error) {
+	cache, _, store := offlineState()
+	if entry, ok := cache.lookup(ref); ok && len(entry.Digest) > 0 {
+		log.Debugf("Resolved image '%s' from the digest cache", ref)
+		return entry.Digest, nil
+	}
+	if store != nil {
+		repoDigests, err := store(ref)
+		if err != nil {
+			log.Debugf("Image '%s' was not found in the local image store: %v", ref, err)
+		} else if digest, ok := matchingRepoDigest(ref, repoDigests); ok {
+			log.Debugf("Resolved image '%s' from the local image store", ref)
+			return digest, nil
+		}
+	}
+	return "", fmt.Errorf("the digest of image '%s' is not available offline, as it was never resolved online nor pulled", ref)
+}
+
+// matchingRepoDigest returns the repository digest of the repository of an
+// image, formatted like ImageWithDigest does
+func matchingRepoDigest(ref string, repoDigests []string) (string, bool) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", false
+	}
+	for _, repoDigest := range repoDigests {
+		d, err := name.NewDigest(repoDigest)
+		if err != nil || d.Context().Name() != r.Context().Name() {
+			continue
+		}
+		context := strings.Replace(d.Context().String(), "index.docker.io", "docker.io", -1)
+		return fmt.Sprintf("%s@%s", context, d.DigestStr()), true
+	}
+	return "", false
+}
+
+// offlineImageCreated returns the creation date of an image from the digest
+// cache
+func offlineImageCreated(ref string) (time.Time, error) {
+	cache, _, _ := offlineState()
+	if entry, ok := cache.lookup(ref); ok && !entry.Created.IsZero() {
+		return entry.Created, nil
+	}
+	return time.Time{}, fmt.Errorf("the age of image '%s' is not available offline, as it was never resolved online", ref)
+}
+
+func readDigestCacheFile(path string) map[string]digestCacheEntry {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]digestCacheEntry{}
+	} else if err != nil {
+		log.Warnf("Ignoring digest cache '%s': %v", path, err)
+		return map[string]digestCacheEntry{}
+	}
+
+	cache := digestCacheFile{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Warnf("Ignoring digest cache '%s': %v", path, err)
+		return map[string]digestCacheEntry{}
+	}
+	if cache.Version != digestCacheVersion || cache.Entries == nil {
+		return map[string]digestCacheEntry{}
+	}
+	return cache.Entries
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineImageWithDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := LoadDigestCache(path.Join(dir, "digest-cache.json"))
+	cache.storeDigest("debian:buster", "docker.io/library/debian@sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	cache.storeCreated("debian:buster", time.Now().Add(-time.Hour))
+	assert.NoError(t, cache.Save())
+
+	UseDigestCache(LoadDigestCache(path.Join(dir, "digest-cache.json")))
+	defer UseDigestCache(nil)
+	SetOffline(true, func(ref string) ([]string, error) {
+		if ref == "alpine:3.16" {
+			return []string{"other/alpine@sha256:2222222222222222222222222222222222222222222222222222222222222222", "alpine@sha256:3333333333333333333333333333333333333333333333333333333333333333"}, nil
+		}
+		return nil, errors.New("no such image")
+	})
+	defer SetOffline(false, nil)
+
+	digest, err := ImageWithDigest("debian:buster")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/debian@sha256:1111111111111111111111111111111111111111111111111111111111111111", digest)
+
+	age, err := ImageAge("debian:buster")
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), age.Seconds(), 60)
+
+	digest, err = ImageWithDigest("alpine:3.16")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine@sha256:3333333333333333333333333333333333333333333333333333333333333333", digest)
+
+	_, err = ImageWithDigest("ubuntu:focal")
+	assert.EqualError(t, err, "the digest of image 'ubuntu:focal' is not available offline, as it was never resolved online nor pulled")
+
+	_, err = ImageAge("alpine:3.16")
+	assert.EqualError(t, err, "the age of image 'alpine:3.16' is not available offline, as it was never resolved online")
+}
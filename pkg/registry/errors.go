@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrorKind is the category of an error returned by a registry
+type ErrorKind string
+
+const (
+	// ErrorNotFound means the image or its repository doesn't exist
+	ErrorNotFound ErrorKind = "not found"
+
+	// ErrorUnauthorized means the credentials are missing or not allowed to
+	// access the image
+	ErrorUnauthorized ErrorKind = "unauthorized"
+
+	// ErrorTransient means the registry is rate limiting or temporarily
+	// unavailable, or couldn't be reached. The request can be retried.
+	ErrorTransient ErrorKind = "transient"
+
+	// ErrorUnknown covers any other error
+	ErrorUnknown ErrorKind = "unknown"
+)
+
+// LookupError is returned when a registry failed to tell if an image exists
+type LookupError struct {
+	Kind ErrorKind
+	Ref  string
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("%s error: %v", e.Kind, e.Err)
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError returns the category of an error returned by
+// go-containerregistry
+func ClassifyError(err error) ErrorKind {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isCertificateError(err) {
+		return ErrorUnknown
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		for _, d := range terr.Errors {
+			switch d.Code {
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode:
+				return ErrorNotFound
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return ErrorUnauthorized
+			case transport.TooManyRequestsErrorCode, transport.UnavailableErrorCode:
+				return ErrorTransient
+			}
+		}
+		switch {
+		case terr.StatusCode == http.StatusNotFound:
+			return ErrorNotFound
+		case terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden:
+			return ErrorUnauthorized
+		case terr.StatusCode == http.StatusTooManyRequests || terr.StatusCode >= 500:
+			return ErrorTransient
+		}
+		return ErrorUnknown
+	}
+
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return ErrorTransient
+	}
+	return ErrorUnknown
+}
+
+// isCertificateError returns if an error is about the certificate of a
+// registry, which retrying won't fix
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// PlatformImageWithDigest returns the reference of the image of a platform by
+// its digest. For a manifest list, it's the digest of the manifest of the
+// platform. The result is recorded in the digest cache like with
+// ImageWithDigest.
+func PlatformImageWithDigest(ref, platform string) (string, error) {
+	key := fmt.Sprintf("%s (%s)", ref, platform)
+	cache, isOffline, _ := offlineState()
+	if isOffline {
+		if entry, ok := cache.lookup(key); ok && len(entry.Digest) > 0 {
+			return entry.Digest, nil
+		}
+		return "", fmt.Errorf("the digest of image '%s' for platform '%s' is not available offline, as it was never resolved online", ref, platform)
+	}
+
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return "", fmt.Errorf("invalid platform '%s': %w", platform, err)
+	}
+	desc, err := getManifest(context.Background(), ref)
+	if err != nil {
+		return "", err
+	}
+
+	digest := desc.Digest
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+		found := false
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil && matchesPlatform(*m.Platform, *p) {
+				digest, found = m.Digest, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("image '%s' is not available for platform '%s'", ref, platform)
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return "", err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return "", err
+		}
+		if !matchesPlatform(v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}, *p) {
+			return "", fmt.Errorf("image '%s' is built for platform '%s/%s', not '%s'", ref, cfg.OS, cfg.Architecture, platform)
+		}
+	}
+
+	context := strings.Replace(desc.Ref.Context().String(), "index.docker.io", "docker.io", -1)
+	withDigest := fmt.Sprintf("%s@%s", context, digest.String())
+	cache.storeDigest(key, withDigest)
+	return withDigest, nil
+}
+
+// WriteManifestList pushes a manifest list referencing images already in the
+// registry, one per platform. The platform of each image is read from its
+// configuration. It's a Docker manifest list if all the images are Docker
+// images, and an OCI image index otherwise.
+func WriteManifestList(ctx context.Context, ref string, images []string) error {
+	dst, err := name.ParseReference(ref)
+	if err != nil {
+		return fmt.Errorf("invalid reference '%s': %w", ref, err)
+	}
+
+	var idx v1.ImageIndex = empty.Index
+	mediaType := types.DockerManifestList
+	for _, image := range images {
+		r, err := name.ParseReference(image)
+		if err != nil {
+			return fmt.Errorf("invalid reference '%s': %w", image, err)
+		}
+		desc, err := remote.Get(r, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("error fetching image '%s': %w", image, err)
+		}
+		img, err := desc.Image()
+		if err != nil {
+			return fmt.Errorf("error fetching image '%s': %w", image, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("error fetching the configuration of image '%s': %w", image, err)
+		}
+		if desc.MediaType != types.DockerManifestSchema2 {
+			mediaType = types.OCIImageIndex
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				MediaType: desc.MediaType,
+				Platform:  &v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant, OSVersion: cfg.OSVersion},
+			},
+		})
+	}
+	idx = mutate.IndexMediaType(idx, mediaType)
+
+	if err := remote.WriteIndex(dst, idx, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx)); err != nil {
+		return fmt.Errorf("error pushing manifest list '%s': %w", ref, err)
+	}
+	return nil
+}
+
+// matchesPlatform returns whether a platform satisfies the one requested. A
+// requested platform without variant accepts any variant.
+func matchesPlatform(p, requested v1.Platform) bool {
+	if p.OS != requested.OS || p.Architecture != requested.Architecture {
+		return false
+	}
+	return len(requested.Variant) == 0 || p.Variant == requested.Variant
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteManifestList(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := strings.TrimPrefix(server.URL, "http://") + "/app"
+
+	amd64 := pushPlatformImage(t, repo+":release-linux-amd64", "linux", "amd64", "", types.DockerManifestSchema2)
+	arm64 := pushPlatformImage(t, repo+":release-linux-arm64-v8", "linux", "arm64", "v8", types.DockerManifestSchema2)
+	err := WriteManifestList(context.Background(), repo+":release", []string{repo + ":release-linux-amd64", repo + ":release-linux-arm64-v8"})
+	assert.NoError(t, err)
+
+	desc, err := getManifest(context.Background(), repo+":release")
+	if assert.NoError(t, err) {
+		assert.Equal(t, types.DockerManifestList, desc.MediaType)
+	}
+
+	digest, err := PlatformImageWithDigest(repo+":release", "linux/arm64")
+	assert.NoError(t, err)
+	assert.Equal(t, repo+"@"+arm64, digest)
+
+	digest, err = PlatformImageWithDigest(repo+":release", "linux/amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, repo+"@"+amd64, digest)
+
+	_, err = PlatformImageWithDigest(repo+":release", "linux/s390x")
+	assert.EqualError(t, err, "image '"+repo+":release' is not available for platform 'linux/s390x'")
+
+	digest, err = PlatformImageWithDigest(repo+":release-linux-amd64", "linux/amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, repo+"@"+amd64, digest)
+
+	_, err = PlatformImageWithDigest(repo+":release-linux-amd64", "linux/arm64")
+	assert.EqualError(t, err, "image '"+repo+":release-linux-amd64' is built for platform 'linux/amd64', not 'linux/arm64'")
+}
+
+func TestWriteManifestListWithOCIImages(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := strings.TrimPrefix(server.URL, "http://") + "/app"
+
+	pushPlatformImage(t, repo+":release-linux-amd64", "linux", "amd64", "", types.DockerManifestSchema2)
+	pushPlatformImage(t, repo+":release-linux-arm64-v8", "linux", "arm64", "v8", types.OCIManifestSchema1)
+	err := WriteManifestList(context.Background(), repo+":release", []string{repo + ":release-linux-amd64", repo + ":release-linux-arm64-v8"})
+	assert.NoError(t, err)
+
+	desc, err := getManifest(context.Background(), repo+":release")
+	if assert.NoError(t, err) {
+		assert.Equal(t, types.OCIImageIndex, desc.MediaType)
+	}
+
+	err = WriteManifestList(context.Background(), repo+":release", []string{repo + ":missing"})
+	assert.Equal(t, ErrorNotFound, ClassifyError(err))
+}
+
+func pushPlatformImage(t *testing.T, ref, os, arch, variant string, mediaType types.MediaType) string {
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.OS, cfg.Architecture, cfg.Variant = os, arch, variant
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+	img = mutate.MediaType(img, mediaType)
+
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(r, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest.String()
+}
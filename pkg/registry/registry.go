@@ -1,28 +1,61 @@
 package registry
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// lookupAttempts is the number of times ImageExists tries to reach a
+	// registry returning transient errors
+	lookupAttempts = 4
+
+	// lookupBackoff is the delay before the first retry of ImageExists. It is
+	// doubled after each attempt.
+	lookupBackoff = 500 * time.Millisecond
+)
+
+// ImageWithDigest returns the reference of an image by its digest. The result
+// is recorded in the digest cache, and read from it when offline.
 func ImageWithDigest(ref string) (string, error) {
-	desc, err := getManifest(ref)
+	cache, isOffline, _ := offlineState()
+	if isOffline {
+		return offlineImageWithDigest(ref)
+	}
+
+	desc, err := getManifest(context.Background(), ref)
 	if err != nil {
 		return "", err
 	}
 
 	// See https://github.com/google/go-containerregistry/issues/68
 	context := strings.Replace(desc.Ref.Context().String(), "index.docker.io", "docker.io", -1)
-	return fmt.Sprintf("%s@%s", context, desc.Digest.String()), nil
+	digest := fmt.Sprintf("%s@%s", context, desc.Digest.String())
+	cache.storeDigest(ref, digest)
+	return digest, nil
 }
 
+// ImageAge returns the time elapsed since an image was created. The creation
+// date is recorded in the digest cache, and read from it when offline.
 func ImageAge(ref string) (time.Duration, error) {
-	desc, err := getManifest(ref)
+	cache, isOffline, _ := offlineState()
+	if isOffline {
+		created, err := offlineImageCreated(ref)
+		if err != nil {
+			return time.Duration(0), err
+		}
+		return time.Since(created), nil
+	}
+
+	desc, err := getManifest(context.Background(), ref)
 	if err != nil {
 		return time.Duration(0), err
 	}
@@ -34,38 +67,73 @@ func ImageAge(ref string) (time.Duration, error) {
 	if err != nil {
 		return time.Duration(0), err
 	}
-	time.Now().Sub(cfg.Created.Time)
-	return time.Now().Sub(cfg.Created.Time), nil
+	cache.storeCreated(ref, cfg.Created.Time)
+	return time.Since(cfg.Created.Time), nil
 }
 
-func TagImage(source, dest string) error {
+func TagImage(ctx context.Context, source, dest string) error {
 	ref, err := name.ParseReference(source)
 	if err != nil {
 		return fmt.Errorf("parsing reference %q: %v", source, err)
 	}
-	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("fetching %q: %v", source, err)
 	}
 
 	dst := ref.Context().Tag(dest)
 
-	return remote.Tag(dst, desc, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return remote.Tag(dst, desc, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
 }
 
-func ImageExists(ref string) (bool, error) {
-	_, err := getManifest(ref)
-	if err != nil {
-		// TODO: Fix this
-		return false, nil
+func CopyImage(ctx context.Context, source, dest string) error {
+	if err := crane.Copy(source, dest, crane.WithAuthFromKeychain(authn.DefaultKeychain), crane.WithContext(ctx)); err != nil {
+		return fmt.Errorf("copying %q to %q: %v", source, dest, err)
+	}
+	return nil
+}
+
+// ImageExists returns if an image exists in its registry. Transient errors
+// are retried with an exponential backoff, and a LookupError is returned for
+// any error other than the image not being found.
+func ImageExists(ctx context.Context, ref string) (bool, error) {
+	digest, err := ImageDigest(ctx, ref)
+	return len(digest) > 0, err
+}
+
+// ImageDigest returns the digest of an image, or an empty string if the image
+// doesn't exist. Errors are handled like in ImageExists, and the retries stop
+// as soon as the context is done.
+func ImageDigest(ctx context.Context, ref string) (string, error) {
+	backoff := lookupBackoff
+	for attempt := 1; ; attempt++ {
+		desc, err := getManifest(ctx, ref)
+		if err == nil {
+			return desc.Digest.String(), nil
+		}
+
+		kind := ClassifyError(err)
+		switch {
+		case kind == ErrorNotFound:
+			return "", nil
+		case kind == ErrorTransient && attempt < lookupAttempts:
+			log.Debugf("Retrying the lookup of '%s' in %v after a transient error: %v", ref, backoff, err)
+			select {
+			case <-ctx.Done():
+				return "", &LookupError{Kind: kind, Ref: ref, Err: ctx.Err()}
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		default:
+			return "", &LookupError{Kind: kind, Ref: ref, Err: err}
+		}
 	}
-	return true, nil
 }
 
-func getManifest(r string) (*remote.Descriptor, error) {
+func getManifest(ctx context.Context, r string) (*remote.Descriptor, error) {
 	ref, err := name.ParseReference(r, name.StrictValidation)
 	if err != nil {
 		return nil, fmt.Errorf("parsing reference %q: %v", r, err)
 	}
-	return remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
 }
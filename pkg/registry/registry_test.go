@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected ErrorKind
+	}{
+		"manifest unknown": {
+			err:      &transport.Error{StatusCode: http.StatusNotFound, Errors: []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode}}},
+			expected: ErrorNotFound,
+		},
+		"name unknown behind a 401": {
+			err:      &transport.Error{StatusCode: http.StatusUnauthorized, Errors: []transport.Diagnostic{{Code: transport.NameUnknownErrorCode}}},
+			expected: ErrorNotFound,
+		},
+		"bare 404": {
+			err:      &transport.Error{StatusCode: http.StatusNotFound},
+			expected: ErrorNotFound,
+		},
+		"forbidden": {
+			err:      &transport.Error{StatusCode: http.StatusForbidden},
+			expected: ErrorUnauthorized,
+		},
+		"rate limited": {
+			err:      &transport.Error{StatusCode: http.StatusTooManyRequests, Errors: []transport.Diagnostic{{Code: transport.TooManyRequestsErrorCode}}},
+			expected: ErrorTransient,
+		},
+		"bad gateway": {
+			err:      &transport.Error{StatusCode: http.StatusBadGateway},
+			expected: ErrorTransient,
+		},
+		"bad request": {
+			err:      &transport.Error{StatusCode: http.StatusBadRequest},
+			expected: ErrorUnknown,
+		},
+		"connection refused": {
+			err:      &url.Error{Op: "Get", URL: "https://registry/v2/", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}},
+			expected: ErrorTransient,
+		},
+		"timeout": {
+			err:      &url.Error{Op: "Get", URL: "https://registry/v2/", Err: context.DeadlineExceeded},
+			expected: ErrorUnknown,
+		},
+		"untrusted certificate": {
+			err:      &url.Error{Op: "Get", URL: "https://registry/v2/", Err: x509.UnknownAuthorityError{}},
+			expected: ErrorUnknown,
+		},
+		"other": {
+			err:      errors.New("parsing reference"),
+			expected: ErrorUnknown,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, ClassifyError(test.err))
+		})
+	}
+}
+
+func TestImageExists(t *testing.T) {
+	defer fastRetries()()
+
+	tests := map[string]struct {
+		statuses         []int
+		expectedExists   bool
+		expectedKind     ErrorKind
+		expectedAttempts int32
+	}{
+		"found": {
+			statuses:         []int{http.StatusOK},
+			expectedExists:   true,
+			expectedAttempts: 1,
+		},
+		"not found": {
+			statuses:         []int{http.StatusNotFound},
+			expectedAttempts: 1,
+		},
+		"unauthorized": {
+			statuses:         []int{http.StatusUnauthorized},
+			expectedKind:     ErrorUnauthorized,
+			expectedAttempts: 1,
+		},
+		"found after transient errors": {
+			statuses:         []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK},
+			expectedExists:   true,
+			expectedAttempts: 3,
+		},
+		"transient errors exhausting retries": {
+			statuses:         []int{http.StatusBadGateway},
+			expectedKind:     ErrorTransient,
+			expectedAttempts: 4,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					return
+				}
+				i := int(atomic.AddInt32(&attempts, 1)) - 1
+				if i >= len(test.statuses) {
+					i = len(test.statuses) - 1
+				}
+				if test.statuses[i] == http.StatusOK {
+					w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+					w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json"}`))
+					return
+				}
+				w.WriteHeader(test.statuses[i])
+			}))
+			defer server.Close()
+
+			ref := strings.TrimPrefix(server.URL, "http://") + "/app:builder-v2-123"
+			exists, err := ImageExists(context.Background(), ref)
+			assert.Equal(t, test.expectedExists, exists)
+			assert.Equal(t, test.expectedAttempts, atomic.LoadInt32(&attempts))
+			if len(test.expectedKind) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var lookupErr *LookupError
+			if assert.True(t, errors.As(err, &lookupErr)) {
+				assert.Equal(t, test.expectedKind, lookupErr.Kind)
+			}
+		})
+	}
+}
+
+func TestImageDigestStopsRetryingWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		atomic.AddInt32(&attempts, 1)
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := ImageDigest(ctx, strings.TrimPrefix(server.URL, "http://")+"/app:builder-v2-123")
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	assert.Less(t, time.Since(start), lookupBackoff)
+}
+
+func fastRetries() func() {
+	previous := lookupBackoff
+	lookupBackoff = time.Millisecond
+	return func() {
+		lookupBackoff = previous
+	}
+}
@@ -1,13 +1,13 @@
 package template
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -20,6 +20,30 @@ import (
 
 type StageResolver func(string) (string, error)
 
+var (
+	// placeholders makes the helpers referencing images return placeholders
+	// instead of resolving them
+	placeholders    bool
+	placeholdersMux sync.Mutex
+)
+
+// SetPlaceholders makes ExternalImage and ImageAgeGeneration return
+// placeholders instead of digests and ages, for Dockerfiles to be rendered
+// without reaching any registry. BuilderStage doesn't need any registry and
+// still returns the image of the stage, so that the Content Hash of a stage
+// keeps depending on the ones of the stages it references.
+func SetPlaceholders(enabled bool) {
+	placeholdersMux.Lock()
+	defer placeholdersMux.Unlock()
+	placeholders = enabled
+}
+
+func usePlaceholders() bool {
+	placeholdersMux.Lock()
+	defer placeholdersMux.Unlock()
+	return placeholders
+}
+
 // data represents the buildData provided to the Go templating
 // engine when rendering Dockerfiles
 type data struct {
@@ -27,6 +51,8 @@ type data struct {
 	currentContext string
 	deps           map[string]struct{}
 	exec           executor.Executor
+	externalImages map[string]string
+	platform       string
 	resolver       StageResolver
 	stageName      string
 }
@@ -39,19 +65,27 @@ func newTemplateData(buildConf config.BuildConfiguration, currentContext string,
 		resolver:       resolver,
 		exec:           exec,
 		deps:           map[string]struct{}{},
+		externalImages: map[string]string{},
 		stageName:      stageName,
 	}
 }
 
 // FuncMaps returns all functions that are available from
-// inside a Dockerfile template
+// inside a Dockerfile template. They all return an error as second value,
+// which aborts the rendering.
 func (d *data) FuncMaps() template.FuncMap {
 	return template.FuncMap{
 		"BuilderStage":       d.BuilderStage,
 		"Concat":             d.Concat,
 		"ExternalImage":      d.ExternalImage,
 		"ImageAgeGeneration": d.ImageAgeGeneration,
+		"GitBranch":          d.GitBranch,
+		"GitCommit":          d.GitCommit,
 		"GitCommitShort":     d.GitCommitShort,
+		"GitCommitTimestamp": d.GitCommitTimestamp,
+		"GitDescribe":        d.GitDescribe,
+		"GitIsDirty":         d.GitIsDirty,
+		"GitTag":             d.GitTag,
 		"HasFile":            d.HasFile,
 		"MandatoryParameter": d.MandatoryParameter,
 		"Parameter":          d.ParameterWithOptionalDefault,
@@ -60,95 +94,108 @@ func (d *data) FuncMaps() template.FuncMap {
 }
 
 // BuilderStage returns the imageURL corresponding to a given stage
-func (d *data) BuilderStage(stageName string) string {
+func (d *data) BuilderStage(stageName string) (string, error) {
 	d.deps[stageName] = struct{}{}
 	imageURL, err := d.resolver(stageName)
 	if err != nil {
-		err = fmt.Errorf("cannot replace BuilderStage('%s'): %w", stageName, err)
-		log.Error(err)
-		panic(err)
+		return "", fmt.Errorf("cannot replace BuilderStage('%s'): %w", stageName, err)
 	}
 	if len(imageURL) == 0 {
-		return fmt.Sprintf("{{ BuilderStage \"%s\"}}", stageName)
+		return fmt.Sprintf("{{ BuilderStage \"%s\"}}", stageName), nil
 	}
 	log.Debugf("Replacing BuilderStage('%s') with '%s'", stageName, imageURL)
-	return imageURL
+	return imageURL, nil
 }
 
-// ExternalImage returns an imageURL referenced by its sha256
-func (d *data) ExternalImage(imageURL string) string {
-	digest, err := registry.ImageWithDigest(imageURL)
+// ExternalImage returns an imageURL referenced by its sha256. When rendering
+// for a platform, it's the digest of the image of that platform.
+func (d *data) ExternalImage(imageURL string) (string, error) {
+	if usePlaceholders() {
+		d.externalImages[imageURL] = fmt.Sprintf("<ExternalImage:%s>", imageURL)
+		return d.externalImages[imageURL], nil
+	}
+
+	var digest string
+	var err error
+	if len(d.platform) > 0 {
+		digest, err = registry.PlatformImageWithDigest(imageURL, d.platform)
+	} else {
+		digest, err = registry.ImageWithDigest(imageURL)
+	}
 	if err != nil {
-		log.Fatalf("Error when calling ImageWithDigest('%s'): %v", imageURL, err)
+		return "", fmt.Errorf("cannot resolve ExternalImage('%s'): %w", imageURL, err)
 	}
 
 	log.Debugf("Replacing ExternalImage('%s') with '%s'", imageURL, digest)
-	return digest
+	d.externalImages[imageURL] = digest
+	return digest, nil
 }
 
-// ImageAgeGeneration returns the age of an image
-func (d *data) ImageAgeGeneration(imageURL, generation string) float64 {
-	// TODO: Cache result of this call
-	age, err := registry.ImageAge(imageURL)
+// ImageAgeGeneration returns the age of an image, or 0 with placeholders
+func (d *data) ImageAgeGeneration(imageURL, generation string) (float64, error) {
+	b, err := time.ParseDuration(generation)
 	if err != nil {
-		log.Fatalf("Error when calling ImageAge('%s'): %v", imageURL, err)
+		return 0, fmt.Errorf("cannot parse generation '%s' of ImageAgeGeneration('%s'): %w", generation, imageURL, err)
 	}
-	b, err := time.ParseDuration(generation)
+	if usePlaceholders() {
+		return 0, nil
+	}
+
+	// TODO: Cache result of this call
+	age, err := registry.ImageAge(imageURL)
 	if err != nil {
-		log.Fatalf("Error when calling ParseDuration('%s'): %v", generation, err)
+		return 0, fmt.Errorf("cannot compute ImageAgeGeneration('%s'): %w", imageURL, err)
 	}
-	return math.Floor(age.Seconds() / b.Seconds())
+	return math.Floor(age.Seconds() / b.Seconds()), nil
 }
 
 // HasFile returns whether a file exist in the local context or not
-func (d *data) HasFile(filePath string) bool {
+func (d *data) HasFile(filePath string) (bool, error) {
 	_, err := os.Stat(path.Join(d.currentContext, filePath))
-	return err == nil
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("cannot check HasFile('%s'): %w", filePath, err)
+	}
+	return true, nil
 }
 
 // Concat concats an array of string together
-func (d *data) Concat(args ...string) string {
-	return strings.Join(args, "")
-}
-
-// GitCommitShort returns the git commit of the local context
-func (d *data) GitCommitShort() string {
-	out := bytes.Buffer{}
-	err := d.exec.NewCommand("git", "rev-parse", "HEAD").WithDir(d.currentContext).WithCombinedOutput(&out).Run()
-	if err != nil {
-		log.Fatal(out.String())
-	}
-	return utils.Chomp(out.String())
+func (d *data) Concat(args ...string) (string, error) {
+	return strings.Join(args, ""), nil
 }
 
 // MandatoryParameter returns a parameter from GlobalSpec or fails
-func (d *data) MandatoryParameter(parameterName string) interface{} {
+func (d *data) MandatoryParameter(parameterName string) (interface{}, error) {
 	value, ok := d.buildConf.SpecAttribute(d.stageName, parameterName)
 	if !ok {
-		log.Fatalf("Could not find mandatory parameter in: %v", d.buildConf.SpecAttributeNames(d.stageName))
+		return nil, fmt.Errorf("cannot find MandatoryParameter('%s') in the spec of stage '%s', which has: %v", parameterName, d.stageName, d.buildConf.SpecAttributeNames(d.stageName))
 	}
-	return value
+	return value, nil
 }
 
 // ParameterWithOptionalDefault returns a parameter from GlobalSpec or a default value
-func (d *data) ParameterWithOptionalDefault(args ...string) interface{} {
+func (d *data) ParameterWithOptionalDefault(args ...string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Parameter expects a parameter name and an optional default value")
+	}
 	if len(args[0]) == 0 {
-		return ""
+		return "", nil
 	}
 	value, ok := d.buildConf.SpecAttribute(d.stageName, args[0])
 	if ok {
-		return value
+		return value, nil
 	} else if len(args) > 1 {
-		return args[1]
+		return args[1], nil
 	}
-	return ""
+	return "", nil
 }
 
 // File read the content of a file from the local context
-func (d *data) File(filePath string) interface{} {
+func (d *data) File(filePath string) (string, error) {
 	buildData, err := ioutil.ReadFile(path.Join(d.currentContext, filePath))
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("cannot read File('%s'): %w", filePath, err)
 	}
-	return utils.Chomp(string(buildData))
+	return utils.Chomp(string(buildData)), nil
 }
@@ -2,14 +2,18 @@ package template
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"regexp"
+	"sort"
 	"strings"
 	"text/template"
+	"text/template/parse"
 
 	"github.com/maxlaverse/image-builder/pkg/config"
 	"github.com/maxlaverse/image-builder/pkg/executor"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -26,6 +30,16 @@ const (
 	// dirContextInclude includes files from the Docker context
 	dirContextInclude = "ContextInclude"
 
+	// dirContextExclude excludes files from the Docker context
+	dirContextExclude = "ContextExclude"
+
+	// dirBuildArg sets a build argument, in the form NAME=value
+	dirBuildArg = "BuildArg"
+
+	// dirPlatform adds platforms to build the image for, e.g linux/arm64. Several
+	// platforms can be separated by commas.
+	dirPlatform = "Platform"
+
 	// dirUseBuilderContext changes the build context for the directory where the builder
 	// is defined
 	dirUseBuilderContext = "UseBuilderContext"
@@ -34,6 +48,13 @@ const (
 var (
 	// regExpDirectives is the regular expression to parse those directives
 	regExpDirectives = regexp.MustCompile(`# ([a-zA-Z]+)(?: (.*))?`)
+
+	// regExpInvalidTagChars matches the characters an image tag can't contain
+	regExpInvalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+	// regExpExecError is the regular expression to extract the position and
+	// the cause of a template execution error
+	regExpExecError = regexp.MustCompile(`(?s)^template: ([^:]+:\d+:\d+): executing "[^"]*" at <.*?>: (.*)$`)
 )
 
 type dockerfile struct {
@@ -41,51 +62,74 @@ type dockerfile struct {
 	content        *bytes.Buffer
 	currentContext string
 	data           map[string][]string
+	partials       map[string]string
+	source         []byte
+	usedPartials   map[string]string
 	templateData   data
 }
 
 // Dockerfile is the interface for a parsed Dockerfile
 type Dockerfile interface {
+	GetBuildArgs() map[string]string
 	GetBuildContext() string
 	GetContent() string
 	GetContentWithoutIgnoredLines() string
+	GetContextExcludes() []string
 	GetContextIncludes() []string
+	GetExternalImages() map[string]string
 	GetFriendlyTag() string
+	GetPartials() map[string]string
 	GetTagAliases() []string
 	GetRequiredStages() []string
+	GetPlatforms() []string
+	ForPlatform(platform string) (Dockerfile, error)
 	Render() error
 }
 
-// NewDockerfile renders a given Dockerfile based on provided BuildData
-func NewDockerfile(content []byte, stageName string, buildConf config.BuildConfiguration, currentContext, builderContext string, resolver StageResolver, exec executor.Executor) Dockerfile {
+// NewDockerfile renders a given Dockerfile based on provided BuildData.
+// Partials are templates the Dockerfile can include by name.
+func NewDockerfile(content []byte, partials map[string]string, stageName string, buildConf config.BuildConfiguration, currentContext, builderContext string, resolver StageResolver, exec executor.Executor) Dockerfile {
 	return &dockerfile{
 		builderContext: builderContext,
 		content:        bytes.NewBuffer(content),
 		currentContext: currentContext,
 		data:           map[string][]string{},
+		partials:       partials,
+		source:         content,
+		usedPartials:   map[string]string{},
 		templateData:   newTemplateData(buildConf, currentContext, resolver, exec, stageName),
 	}
 }
 
 // NewDockerfileFromFile renders a given Dockerfile based on provided BuildData
-func NewDockerfileFromFile(filepath, stageName string, buildConf config.BuildConfiguration, currentContext, builderContext string, resolver StageResolver, exec executor.Executor) (Dockerfile, error) {
+func NewDockerfileFromFile(filepath string, partials map[string]string, stageName string, buildConf config.BuildConfiguration, currentContext, builderContext string, resolver StageResolver, exec executor.Executor) (Dockerfile, error) {
 	content, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read the Dockerfile template: %v", err)
 	}
-	return NewDockerfile(content, stageName, buildConf, currentContext, builderContext, resolver, exec), nil
+	return NewDockerfile(content, partials, stageName, buildConf, currentContext, builderContext, resolver, exec), nil
 }
 
 func (d *dockerfile) Render() error {
-	tmpl, err := template.New("dockerfile").Funcs(d.templateData.FuncMaps()).Parse(d.content.String())
+	tmpl := template.New("Dockerfile").Funcs(d.templateData.FuncMaps())
+	partialOf, err := d.parsePartials(tmpl)
+	if err != nil {
+		return err
+	}
+	tmpl, err = tmpl.Parse(d.content.String())
 	if err != nil {
-		return fmt.Errorf("failed to parse the Dockerfile template: %w, %s", err, d.content)
+		return fmt.Errorf("failed to parse the Dockerfile of %s: %w", d.description(), err)
+	}
+	for name := range usedTemplates(tmpl, tmpl.Name(), map[string]struct{}{}) {
+		if partial, ok := partialOf[name]; ok {
+			d.usedPartials[partial] = d.partials[partial]
+		}
 	}
 
 	newContent := bytes.NewBufferString("")
 	err = tmpl.Execute(newContent, d.templateData)
 	if err != nil {
-		return fmt.Errorf("failed to render the Dockerfile template: %w", err)
+		return d.renderError(err)
 	}
 
 	d.content = newContent
@@ -99,6 +143,98 @@ func (d *dockerfile) Render() error {
 	return nil
 }
 
+// renderError returns an error locating where the rendering of a Dockerfile
+// failed, and why
+func (d *dockerfile) renderError(err error) error {
+	var execErr template.ExecError
+	if errors.As(err, &execErr) {
+		if m := regExpExecError.FindStringSubmatch(execErr.Error()); m != nil {
+			cause := errors.Unwrap(execErr.Err)
+			if cause == nil {
+				cause = errors.New(m[2])
+			}
+			return fmt.Errorf("failed to render the Dockerfile of %s at %s: %w", d.description(), m[1], cause)
+		}
+	}
+	return fmt.Errorf("failed to render the Dockerfile of %s: %w", d.description(), err)
+}
+
+// description returns the stage the Dockerfile belongs to, and the platform
+// it's rendered for if any
+func (d *dockerfile) description() string {
+	if len(d.templateData.platform) > 0 {
+		return fmt.Sprintf("stage '%s' for platform '%s'", d.templateData.stageName, d.templateData.platform)
+	}
+	return fmt.Sprintf("stage '%s'", d.templateData.stageName)
+}
+
+// parsePartials adds the partials to a template set, and returns the partial
+// each template is defined in
+func (d *dockerfile) parsePartials(tmpl *template.Template) (map[string]string, error) {
+	partialOf := map[string]string{}
+	names := []string{}
+	for name := range d.partials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// Parsed alone first, to know which templates the partial defines
+		t, err := template.New(name).Funcs(d.templateData.FuncMaps()).Parse(d.partials[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the partial '%s': %w", name, err)
+		}
+		for _, defined := range t.Templates() {
+			partialOf[defined.Name()] = name
+		}
+		if _, err := tmpl.New(name).Parse(d.partials[name]); err != nil {
+			return nil, fmt.Errorf("failed to parse the partial '%s': %w", name, err)
+		}
+	}
+	return partialOf, nil
+}
+
+// usedTemplates returns the templates a template includes, directly or not
+func usedTemplates(tmpl *template.Template, name string, used map[string]struct{}) map[string]struct{} {
+	t := tmpl.Lookup(name)
+	if t == nil || t.Tree == nil {
+		return used
+	}
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.IfNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			if _, ok := used[n.Name]; !ok {
+				used[n.Name] = struct{}{}
+				usedTemplates(tmpl, n.Name, used)
+			}
+		}
+	}
+	walk(t.Tree.Root)
+	return used
+}
+
+// GetPartials returns the content of the partials the Dockerfile uses
+func (d *dockerfile) GetPartials() map[string]string {
+	return d.usedPartials
+}
+
 // Returns the rendered content of the Dockerfile
 func (d *dockerfile) GetContent() string {
 	return d.content.String()
@@ -129,12 +265,79 @@ func (d *dockerfile) GetContextIncludes() []string {
 	return d.data[dirContextInclude]
 }
 
-// GetTagAliases returns the list of tag aliases
-func (d *dockerfile) GetTagAliases() []string {
-	if d.data[dirTagAlias] == nil {
+// GetContextExcludes returns the list of files to exclude from the build context
+func (d *dockerfile) GetContextExcludes() []string {
+	if d.data[dirContextExclude] == nil {
 		return []string{}
 	}
-	return d.data[dirTagAlias]
+	return d.data[dirContextExclude]
+}
+
+// GetExternalImages returns the external images the Dockerfile references,
+// along with the digest they were replaced with
+func (d *dockerfile) GetExternalImages() map[string]string {
+	return d.templateData.externalImages
+}
+
+// GetBuildArgs returns the build arguments set by directives
+func (d *dockerfile) GetBuildArgs() map[string]string {
+	args := map[string]string{}
+	for _, arg := range d.data[dirBuildArg] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			log.Warnf("Ignoring directive '# %s %s': expected NAME=value", dirBuildArg, arg)
+			continue
+		}
+		args[parts[0]] = parts[1]
+	}
+	return args
+}
+
+// GetPlatforms returns the platforms set by directives
+func (d *dockerfile) GetPlatforms() []string {
+	platforms := []string{}
+	for _, value := range d.data[dirPlatform] {
+		for _, platform := range strings.Split(value, ",") {
+			if platform = strings.TrimSpace(platform); len(platform) > 0 {
+				platforms = append(platforms, platform)
+			}
+		}
+	}
+	return platforms
+}
+
+// ForPlatform returns the Dockerfile rendered for a given platform, in which
+// external images are resolved to the digest of their image for that
+// platform
+func (d *dockerfile) ForPlatform(platform string) (Dockerfile, error) {
+	t := d.templateData
+	variant := &dockerfile{
+		builderContext: d.builderContext,
+		content:        bytes.NewBuffer(d.source),
+		currentContext: t.currentContext,
+		data:           map[string][]string{},
+		partials:       d.partials,
+		source:         d.source,
+		usedPartials:   map[string]string{},
+		templateData:   newTemplateData(t.buildConf, t.currentContext, t.resolver, t.exec, t.stageName),
+	}
+	variant.templateData.platform = platform
+	if err := variant.Render(); err != nil {
+		return nil, err
+	}
+	return variant, nil
+}
+
+// GetTagAliases returns the list of tag aliases. Aliases rendered empty, as
+// with a GitTag on a commit without tag, are ignored.
+func (d *dockerfile) GetTagAliases() []string {
+	aliases := []string{}
+	for _, alias := range d.data[dirTagAlias] {
+		if alias = sanitizeTag(alias); len(alias) > 0 {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
 }
 
 // GetFriendlyTag returns the friendly tag
@@ -142,7 +345,18 @@ func (d *dockerfile) GetFriendlyTag() string {
 	if d.data[dirFriendlyTag] == nil {
 		return ""
 	}
-	return d.data[dirFriendlyTag][0]
+	return sanitizeTag(d.data[dirFriendlyTag][0])
+}
+
+// sanitizeTag replaces the characters an image tag can't contain, like the
+// slashes of a Git branch, with dashes
+func sanitizeTag(tag string) string {
+	tag = regExpInvalidTagChars.ReplaceAllString(strings.TrimSpace(tag), "-")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
 }
 
 // GetRequiredStages returns the dependency of the Dockerfile
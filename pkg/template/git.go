@@ -0,0 +1,237 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/maxlaverse/image-builder/pkg/executor"
+	"github.com/maxlaverse/image-builder/pkg/utils"
+)
+
+var (
+	// commitEnvs are the environment variables CI systems expose the commit
+	// being built in
+	commitEnvs = []string{"GITHUB_SHA", "CI_COMMIT_SHA", "BUILDKITE_COMMIT", "CIRCLE_SHA1", "GIT_COMMIT"}
+
+	// branchEnvs are the environment variables CI systems expose the branch
+	// being built in, for checkouts with a detached HEAD
+	branchEnvs = []string{"GITHUB_HEAD_REF", "CI_COMMIT_BRANCH", "BUILDKITE_BRANCH", "CIRCLE_BRANCH", "BRANCH_NAME", "GIT_BRANCH"}
+
+	// tagEnvs are the environment variables CI systems expose the tag being
+	// built in
+	tagEnvs = []string{"CI_COMMIT_TAG", "BUILDKITE_TAG", "CIRCLE_TAG", "TAG_NAME"}
+
+	// repositoryEnvs are the environment variables CI systems expose the URL
+	// of the repository being built in
+	repositoryEnvs = []string{"CI_PROJECT_URL", "BUILDKITE_REPO", "CIRCLE_REPOSITORY_URL", "GIT_URL"}
+
+	// gitRepositories are the repositories Git metadata was read from, by
+	// directory. The metadata is only read once per build.
+	gitRepositories    = map[string]*gitRepository{}
+	gitRepositoriesMux sync.Mutex
+)
+
+// gitRepository runs Git commands in a directory, and remembers their output
+type gitRepository struct {
+	dir     string
+	exec    executor.Executor
+	outputs map[string]gitOutput
+	mux     sync.Mutex
+}
+
+type gitOutput struct {
+	out string
+	err error
+}
+
+// repositoryAt returns the Git repository of a directory
+func repositoryAt(exec executor.Executor, dir string) *gitRepository {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	gitRepositoriesMux.Lock()
+	defer gitRepositoriesMux.Unlock()
+	if r, ok := gitRepositories[dir]; ok {
+		return r
+	}
+	r := &gitRepository{dir: dir, exec: exec, outputs: map[string]gitOutput{}}
+	gitRepositories[dir] = r
+	return r
+}
+
+// run returns the output of a Git command
+func (r *gitRepository) run(args ...string) (string, error) {
+	key := strings.Join(args, " ")
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if o, ok := r.outputs[key]; ok {
+		return o.out, o.err
+	}
+
+	out := bytes.Buffer{}
+	err := r.exec.NewCommand("git", args...).WithDir(r.dir).WithCombinedOutput(&out).Run()
+	o := gitOutput{out: utils.Chomp(out.String())}
+	if err != nil {
+		o = gitOutput{err: fmt.Errorf("%w: %s", err, o.out)}
+	}
+	r.outputs[key] = o
+	return o.out, o.err
+}
+
+// GitCommit returns the commit of the local context
+func (d *data) GitCommit() (string, error) {
+	commit, err := d.git().run("rev-parse", "HEAD")
+	if err != nil {
+		if commit = firstEnv(commitEnvs...); len(commit) == 0 {
+			return "", fmt.Errorf("cannot resolve GitCommit(): %w", err)
+		}
+	}
+	return commit, nil
+}
+
+// GitCommitShort returns the abbreviated commit of the local context
+func (d *data) GitCommitShort() (string, error) {
+	commit, err := d.git().run("rev-parse", "--short", "HEAD")
+	if err != nil {
+		if commit = firstEnv(commitEnvs...); len(commit) == 0 {
+			return "", fmt.Errorf("cannot resolve GitCommitShort(): %w", err)
+		} else if len(commit) > 7 {
+			commit = commit[:7]
+		}
+	}
+	return commit, nil
+}
+
+// GitBranch returns the branch of the local context, or an empty string for
+// a detached HEAD the CI system doesn't tell the branch of
+func (d *data) GitBranch() (string, error) {
+	branch, err := d.git().run("rev-parse", "--abbrev-ref", "HEAD")
+	if err == nil && branch != "HEAD" {
+		return branch, nil
+	}
+	if os.Getenv("GITHUB_REF_TYPE") == "branch" && len(os.Getenv("GITHUB_HEAD_REF")) == 0 {
+		return os.Getenv("GITHUB_REF_NAME"), nil
+	}
+	if branch = firstEnv(branchEnvs...); len(branch) > 0 {
+		return strings.TrimPrefix(branch, "origin/"), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve GitBranch(): %w", err)
+	}
+	return "", nil
+}
+
+// GitTag returns the tag pointing at the commit of the local context, or an
+// empty string if there is none
+func (d *data) GitTag() (string, error) {
+	if tag, err := d.git().run("describe", "--tags", "--exact-match", "HEAD"); err == nil {
+		return tag, nil
+	}
+	if os.Getenv("GITHUB_REF_TYPE") == "tag" {
+		return os.Getenv("GITHUB_REF_NAME"), nil
+	}
+	return firstEnv(tagEnvs...), nil
+}
+
+// GitDescribe returns the most recent tag reachable from the commit of the
+// local context, with the number of commits since then and whether the
+// working tree is dirty, as in v1.2.3-4-g1a2b3c4-dirty
+func (d *data) GitDescribe() (string, error) {
+	description, err := d.git().run("describe", "--tags", "--always", "--dirty")
+	if err == nil {
+		return description, nil
+	}
+	if tag, _ := d.GitTag(); len(tag) > 0 {
+		return tag, nil
+	}
+	if commit, err := d.GitCommitShort(); err == nil {
+		return commit, nil
+	}
+	return "", fmt.Errorf("cannot resolve GitDescribe(): %w", err)
+}
+
+// GitIsDirty returns whether the local context has uncommitted changes
+func (d *data) GitIsDirty() (bool, error) {
+	status, err := d.git().run("status", "--porcelain")
+	if err != nil {
+		return false, fmt.Errorf("cannot resolve GitIsDirty(): %w", err)
+	}
+	return len(status) > 0, nil
+}
+
+// GitCommitTimestamp returns the time of the commit of the local context,
+// in seconds since the epoch
+func (d *data) GitCommitTimestamp() (int64, error) {
+	out, err := d.git().run("show", "-s", "--format=%ct", "HEAD")
+	if err != nil {
+		return 0, fmt.Errorf("cannot resolve GitCommitTimestamp(): %w", err)
+	}
+	timestamp, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot resolve GitCommitTimestamp(): %w", err)
+	}
+	return timestamp, nil
+}
+
+// SourceRevision returns the abbreviated commit of a directory like
+// GitCommitShort does, or an empty string if it can't be resolved
+func SourceRevision(exec executor.Executor, dir string) string {
+	d := data{exec: exec, currentContext: dir}
+	commit, _ := d.GitCommitShort()
+	return commit
+}
+
+// SourceURL returns the URL of the 'origin' remote of a directory, or the URL
+// of the repository the CI system exposes. Credentials are removed from it.
+func SourceURL(exec executor.Executor, dir string) string {
+	remote, err := repositoryAt(exec, dir).run("remote", "get-url", "origin")
+	if err != nil {
+		remote = firstEnv(repositoryEnvs...)
+		if server, repo := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"); len(server) > 0 && len(repo) > 0 {
+			remote = server + "/" + repo
+		}
+	}
+	return withoutCredentials(remote)
+}
+
+// CheckoutRevision returns the commit checked out in a directory, or an empty
+// string if it isn't part of a Git repository. Unlike GitCommit, it never
+// reads the environment of CI systems, which describes the application.
+func CheckoutRevision(exec executor.Executor, dir string) string {
+	commit, err := repositoryAt(exec, dir).run("rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return commit
+}
+
+// withoutCredentials removes the user and password of a URL
+func withoutCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+func (d *data) git() *gitRepository {
+	return repositoryAt(d.exec, d.currentContext)
+}
+
+// firstEnv returns the value of the first environment variable that is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}